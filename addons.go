@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-zoo/bone"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// PlanAddOn allows an add-on on the subscriptions of a base plan, it is stored
+// in the plan_addons table. A MaxQuantity of 0 is no maximum.
+type PlanAddOn struct {
+	PlanKey     string `json:"-"            db:"plan_key"`
+	AddOnKey    string `json:"addon"        db:"addon_key"`
+	MaxQuantity int64  `json:"max_quantity" db:"max_quantity"`
+}
+
+// addOnRequest attaches an add-on, or changes its quantity.
+type addOnRequest struct {
+	AddOn    string `json:"addon"`
+	Quantity int64  `json:"quantity"`
+}
+
+// getPlanAddOns lists the add-ons available with a base plan.
+func getPlanAddOns(w http.ResponseWriter, r *http.Request) {
+	cp, ok := getSubscribablePlan(bone.GetValue(r, "key"))
+	if !ok {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	addOns, err := listPlanAddOns(cp.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type availableAddOn struct {
+		AddOn       string        `json:"addon"`
+		MaxQuantity int64         `json:"max_quantity"`
+		Price       *stripe.Price `json:"price"`
+	}
+	list := []availableAddOn{}
+	for _, a := range addOns {
+		addOn, ok := getAvailablePlan(a.AddOnKey)
+		if !ok || !addOn.Visible || addOn.Kind != catalogKindAddOn {
+			continue
+		}
+		list = append(list, availableAddOn{AddOn: a.AddOnKey, MaxQuantity: a.MaxQuantity, Price: addOn.Price()})
+	}
+	writeJSON(w, list)
+}
+
+func adminGetPlanAddOns(w http.ResponseWriter, r *http.Request) {
+	addOns, err := listPlanAddOns(bone.GetValue(r, "key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, addOns)
+}
+
+// adminSetPlanAddOns replaces the add-ons allowed with a base plan. The
+// subscriptions that already have an add-on that is no longer allowed keep it
+// until it is removed. Metered plans listed are added to every new
+// subscription of the plan, their max_quantity is not used.
+func adminSetPlanAddOns(w http.ResponseWriter, r *http.Request) {
+	key := bone.GetValue(r, "key")
+	cp, err := getCatalogPlan(key)
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if cp.Kind != catalogKindBase {
+		http.Error(w, "add-ons are only allowed on base plans", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var addOns []PlanAddOn
+	if err := json.NewDecoder(r.Body).Decode(&addOns); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	for i := range addOns {
+		addOns[i].PlanKey = key
+		addOns[i].AddOnKey = strings.TrimSpace(addOns[i].AddOnKey)
+		addOn, err := getCatalogPlan(addOns[i].AddOnKey)
+		if err != nil || (addOn.Kind != catalogKindAddOn && addOn.Kind != catalogKindMetered) {
+			http.Error(w, "unknown add-on "+addOns[i].AddOnKey, http.StatusUnprocessableEntity)
+			return
+		}
+		if addOns[i].MaxQuantity < 0 {
+			http.Error(w, "max_quantity can not be negative, use 0 for no maximum", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if err := replacePlanAddOns(key, addOns); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, addOns)
+}
+
+func addSubscriptionAddOn(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	var req addOnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+
+	s, err := stripeAPI.GetSubscription(sub.ID, nil)
+	if err != nil {
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, base, ok := subscriptionBaseItem(s)
+	if !ok {
+		http.Error(w, "subscription "+s.ID+" has no base plan", http.StatusUnprocessableEntity)
+		return
+	}
+	addOn, err := checkAddOn(base, req.AddOn, req.Quantity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if item := subscriptionItemByPrice(s, addOn.PriceID); item != nil {
+		http.Error(w, "add-on "+addOn.Key+" is already attached, change its quantity instead", http.StatusConflict)
+		return
+	}
+
+	updateSubscriptionItems(w, organization, s.ID, &stripe.SubscriptionItemsParams{
+		Price:    stripe.String(addOn.PriceID),
+		Quantity: stripe.Int64(req.Quantity),
+	})
+}
+
+func updateSubscriptionAddOn(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	var req addOnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s, item, addOn, ok := subscriptionAddOnItem(w, sub.ID, bone.GetValue(r, "addon"))
+	if !ok {
+		return
+	}
+	_, base, ok := subscriptionBaseItem(s)
+	if !ok {
+		http.Error(w, "subscription "+s.ID+" has no base plan", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkAddOnAllowed(base, addOn, req.Quantity); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	updateSubscriptionItems(w, organization, s.ID, &stripe.SubscriptionItemsParams{
+		ID:       stripe.String(item.ID),
+		Quantity: stripe.Int64(req.Quantity),
+	})
+}
+
+func removeSubscriptionAddOn(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	s, item, _, ok := subscriptionAddOnItem(w, sub.ID, bone.GetValue(r, "addon"))
+	if !ok {
+		return
+	}
+
+	updateSubscriptionItems(w, organization, s.ID, &stripe.SubscriptionItemsParams{
+		ID:      stripe.String(item.ID),
+		Deleted: stripe.Bool(true),
+	})
+}
+
+// routeSubscription returns the subscription of the routes that exist under
+// both /sub and /subscriptions/:subId, the one of the subId parameter or the
+// primary subscription of the organization.
+func routeSubscription(w http.ResponseWriter, r *http.Request) (Organization, Subscription, bool) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return organization, Subscription{}, false
+	}
+	subID := bone.GetValue(r, "subId")
+	if subID == "" {
+		subID = strings.TrimSpace(organization.StripeSubID)
+	}
+	if subID == "" {
+		http.Error(w, "not subscribed to any plan , create plan", http.StatusUnprocessableEntity)
+		return organization, Subscription{}, false
+	}
+	sub, ok := orgSubscription(w, organization, subID)
+	return organization, sub, ok
+}
+
+// subscriptionAddOnItem returns the Stripe subscription, the item of the
+// add-on and the catalog add-on, it answers 404 when the add-on is not
+// attached.
+func subscriptionAddOnItem(w http.ResponseWriter, subID, key string) (*stripe.Subscription, *stripe.SubscriptionItem, CatalogPlan, bool) {
+	s, err := stripeAPI.GetSubscription(subID, nil)
+	if err != nil {
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		return nil, nil, CatalogPlan{}, false
+	}
+	// Retired add-ons can still be changed and removed.
+	addOn, err := getCatalogPlan(key)
+	if err != nil || addOn.Kind != catalogKindAddOn {
+		http.Error(w, "unknown add-on "+key, http.StatusNotFound)
+		return nil, nil, addOn, false
+	}
+	item := subscriptionItemByPrice(s, addOn.PriceID)
+	if item == nil {
+		http.Error(w, "add-on "+key+" is not attached to subscription "+s.ID, http.StatusNotFound)
+		return nil, nil, addOn, false
+	}
+	return s, item, addOn, true
+}
+
+// updateSubscriptionItems applies the item changes and answers the stored
+// subscription with its resulting items. The pending plan change keeps them.
+func updateSubscriptionItems(w http.ResponseWriter, organization Organization, subID string, items ...*stripe.SubscriptionItemsParams) {
+	params := &stripe.SubscriptionParams{Items: items}
+	params.AddExpand("latest_invoice.payment_intent")
+	s, err := stripeAPI.UpdateSubscription(subID, params)
+	if err != nil {
+		http.Error(w, "Failed to update subscription "+err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("sub.Update: %v", err)
+		return
+	}
+	if err := updateSub(*s); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	if err := refreshPendingChange(organization, s); err != nil {
+		http.Error(w, "failed to reschedule the pending plan change : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeStoredSubscription(w, organization, s.ID)
+}
+
+// checkAddOn returns the catalog add-on for key if it can be attached to a
+// subscription of the base plan with quantity.
+func checkAddOn(base CatalogPlan, key string, quantity int64) (CatalogPlan, error) {
+	addOn, ok := getAvailablePlan(key)
+	if !ok || addOn.Kind != catalogKindAddOn {
+		return addOn, fmt.Errorf("invalid add-on %s", key)
+	}
+	if err := checkAddOnAllowed(base, addOn, quantity); err != nil {
+		return addOn, err
+	}
+	return addOn, nil
+}
+
+// checkAddOnAllowed checks that the base plan allows the add-on with quantity.
+// Stripe bills every item of a subscription together, so both must also share
+// their interval and currency.
+func checkAddOnAllowed(base, addOn CatalogPlan, quantity int64) error {
+	pa, err := getPlanAddOn(base.Key, addOn.Key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("add-on %s is not available with plan %s", addOn.Key, base.Key)
+		}
+		return err
+	}
+	if addOn.Interval != base.Interval || addOn.Currency != base.Currency {
+		return fmt.Errorf("add-on %s is billed per %s in %s, plan %s per %s in %s", addOn.Key, addOn.Interval, addOn.Currency, base.Key, base.Interval, base.Currency)
+	}
+	if quantity < 1 {
+		return fmt.Errorf("quantity of add-on %s must be at least 1", addOn.Key)
+	}
+	if pa.MaxQuantity > 0 && quantity > pa.MaxQuantity {
+		return fmt.Errorf("quantity of add-on %s can not be more than %d with plan %s", addOn.Key, pa.MaxQuantity, base.Key)
+	}
+	return nil
+}
+
+// subscriptionBaseItem returns the item of the base plan of the subscription.
+func subscriptionBaseItem(s *stripe.Subscription) (*stripe.SubscriptionItem, CatalogPlan, bool) {
+	if s.Items == nil {
+		return nil, CatalogPlan{}, false
+	}
+	for _, item := range s.Items.Data {
+		if item.Price == nil {
+			continue
+		}
+		// Retired catalog plans are still resolved here on purpose.
+		if cp, err := getCatalogPlanByPrice(item.Price.ID); err == nil && cp.Kind == catalogKindBase {
+			return item, cp, true
+		}
+	}
+	return nil, CatalogPlan{}, false
+}
+
+func subscriptionItemByPrice(s *stripe.Subscription, priceID string) *stripe.SubscriptionItem {
+	if s.Items == nil {
+		return nil
+	}
+	for _, item := range s.Items.Data {
+		if item.Price != nil && item.Price.ID == priceID {
+			return item
+		}
+	}
+	return nil
+}
+
+func listPlanAddOns(planKey string) ([]PlanAddOn, error) {
+	addOns := []PlanAddOn{}
+	err := db.Select(&addOns, db.Rebind("SELECT * FROM plan_addons WHERE plan_key = ? ORDER BY addon_key"), planKey)
+	return addOns, err
+}
+
+func getPlanAddOn(planKey, addOnKey string) (PlanAddOn, error) {
+	var pa PlanAddOn
+	err := db.Get(&pa, db.Rebind("SELECT * FROM plan_addons WHERE plan_key = ? AND addon_key = ?"), planKey, addOnKey)
+	return pa, err
+}
+
+func replacePlanAddOns(planKey string, addOns []PlanAddOn) error {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM plan_addons WHERE plan_key = ?"), planKey); err != nil {
+		return err
+	}
+	for _, a := range addOns {
+		if _, err := tx.Exec(tx.Rebind("INSERT INTO plan_addons (plan_key, addon_key, max_quantity) VALUES (?, ?, ?)"), planKey, a.AddOnKey, a.MaxQuantity); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// catalogMetadataKey is the price metadata flag that makes a Stripe price part
+// of the catalog, its value is used as the plan key.
+// An optional "sort_order" metadata sets the initial position of the plan, and
+// a "kind" metadata of "addon" creates it as an add-on. A "kind" of "metered"
+// creates a metered plan of the "metric" metadata.
+const catalogMetadataKey = "plan_key"
+
+// runCatalogSync syncs the catalog at startup and then every interval.
+func runCatalogSync(interval time.Duration) {
+	for {
+		if err := syncCatalog(); err != nil {
+			log.Printf("syncCatalog: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// catalogSyncInterval reads CATALOG_SYNC_INTERVAL, a zero interval disables
+// the periodic sync.
+func catalogSyncInterval() time.Duration {
+	v := os.Getenv("CATALOG_SYNC_INTERVAL")
+	if v == "" {
+		return time.Hour
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid CATALOG_SYNC_INTERVAL %q, using 1h : %v", v, err)
+		return time.Hour
+	}
+	return d
+}
+
+func adminSyncPlans(w http.ResponseWriter, r *http.Request) {
+	if err := syncCatalog(); err != nil {
+		http.Error(w, "catalog sync failed : "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	adminListPlans(w, r)
+}
+
+// syncCatalog imports every price tagged with catalogMetadataKey and refreshes
+// the remaining catalog entries, which were created by hand, from their price.
+func syncCatalog() error {
+	seen := map[string]bool{}
+
+	params := &stripe.PriceListParams{}
+	params.AddExpand("data.product")
+	prices, err := stripeAPI.ListPrices(params)
+	if err != nil {
+		return fmt.Errorf("failed to list prices : %w", err)
+	}
+	for _, pr := range prices {
+		if pr.Metadata[catalogMetadataKey] == "" {
+			continue
+		}
+		seen[pr.ID] = true
+		if err := upsertCatalogPrice(pr); err != nil {
+			return err
+		}
+	}
+
+	catalog, err := listCatalogPlans(true)
+	if err != nil {
+		return err
+	}
+	for _, cp := range catalog {
+		if seen[cp.PriceID] {
+			continue
+		}
+		if err := refreshCatalogPlan(&cp); err != nil {
+			log.Printf("refreshCatalogPlan %s: %v", cp.Key, err)
+		}
+	}
+	return nil
+}
+
+// refreshCatalogPlan reloads the Stripe details of a single catalog plan.
+func refreshCatalogPlan(cp *CatalogPlan) error {
+	pr, err := getPrice(cp.PriceID)
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+			cp.Active = false
+			return setCatalogPriceActive(cp.PriceID, false)
+		}
+		return err
+	}
+	applyStripePrice(cp, pr)
+	return updateCatalogPlanDetails(*cp)
+}
+
+// upsertCatalogPrice creates or refreshes the catalog plan of a tagged price.
+// An active price takes over the plan key from the price it was previously
+// pointing to, an inactive price never does. The price taken over keeps
+// resolving to the plan for its subscribers but no longer describes it.
+func upsertCatalogPrice(pr *stripe.Price) error {
+	key := strings.TrimSpace(pr.Metadata[catalogMetadataKey])
+
+	cp, err := getCatalogPlanByPrice(pr.ID)
+	switch {
+	case err == nil:
+		if cp.Key != key {
+			log.Printf("price %s is tagged %q but is already in the catalog as %q, skipping", pr.ID, key, cp.Key)
+			return nil
+		}
+		if cp.PriceID != pr.ID {
+			return nil
+		}
+		applyStripePrice(&cp, pr)
+		return updateCatalogPlanDetails(cp)
+	case err != sql.ErrNoRows:
+		return err
+	}
+
+	cp, err = getCatalogPlan(key)
+	switch {
+	case err == sql.ErrNoRows:
+		cp = CatalogPlan{Key: key, Kind: catalogKindBase, PriceID: pr.ID, Visible: true}
+		if so, err := strconv.Atoi(pr.Metadata["sort_order"]); err == nil {
+			cp.SortOrder = so
+		}
+		switch pr.Metadata["kind"] {
+		case catalogKindAddOn:
+			cp.Kind = catalogKindAddOn
+		case catalogKindMetered:
+			cp.Kind = catalogKindMetered
+			cp.Metric = strings.TrimSpace(pr.Metadata["metric"])
+		}
+		applyStripePrice(&cp, pr)
+		if err := createCatalogPlan(cp); err != nil {
+			return err
+		}
+		return updateCatalogPlanDetails(cp)
+	case err != nil:
+		return err
+	}
+
+	if !pr.Active || pr.Deleted {
+		return nil
+	}
+	cp.PriceID = pr.ID
+	if err := updateCatalogPlan(cp); err != nil {
+		return err
+	}
+	applyStripePrice(&cp, pr)
+	return updateCatalogPlanDetails(cp)
+}
+
+// applyStripePrice copies the Stripe owned fields of pr into cp. The product
+// is used only when it has been expanded.
+func applyStripePrice(cp *CatalogPlan, pr *stripe.Price) {
+	cp.UnitAmount = pr.UnitAmount
+	cp.Currency = string(pr.Currency)
+	cp.Active = pr.Active && !pr.Deleted
+	if pr.Recurring != nil {
+		cp.Interval = string(pr.Recurring.Interval)
+	}
+	if metadata, err := json.Marshal(pr.Metadata); err == nil && pr.Metadata != nil {
+		cp.Metadata = string(metadata)
+	}
+	if pr.Product != nil {
+		cp.ProductID = pr.Product.ID
+		if pr.Product.Name != "" {
+			cp.Name = pr.Product.Name
+			cp.Description = pr.Product.Description
+			cp.Active = cp.Active && pr.Product.Active && !pr.Product.Deleted
+		}
+	}
+	cp.SyncedAt = time.Now().Unix()
+}
+
+// handleCatalogEvent keeps the catalog current from product.* and price.*
+// webhook events.
+func handleCatalogEvent(event stripe.Event) error {
+	switch {
+	case strings.HasPrefix(event.Type, "price."):
+		var pr stripe.Price
+		if err := json.Unmarshal(event.Data.Raw, &pr); err != nil {
+			return fmt.Errorf("failed to unmarshal price : %w", err)
+		}
+		if event.Type == "price.deleted" {
+			pr.Deleted = true
+		}
+		if pr.Product != nil && !pr.Deleted {
+			if prod, err := stripeAPI.GetProduct(pr.Product.ID, nil); err == nil {
+				pr.Product = prod
+			}
+		}
+		if pr.Metadata[catalogMetadataKey] == "" {
+			// Plans created by hand are not tagged but are kept current too.
+			cp, err := getCatalogPlanByPrice(pr.ID)
+			switch {
+			case err == sql.ErrNoRows || err == nil && cp.PriceID != pr.ID:
+				return nil
+			case err != nil:
+				return err
+			}
+			applyStripePrice(&cp, &pr)
+			return updateCatalogPlanDetails(cp)
+		}
+		return upsertCatalogPrice(&pr)
+
+	case strings.HasPrefix(event.Type, "product."):
+		var prod stripe.Product
+		if err := json.Unmarshal(event.Data.Raw, &prod); err != nil {
+			return fmt.Errorf("failed to unmarshal product : %w", err)
+		}
+		if event.Type == "product.deleted" {
+			prod.Deleted = true
+		}
+		return updateCatalogProduct(prod)
+	}
+	return nil
+}
+
+func updateCatalogPlanDetails(cp CatalogPlan) error {
+	query := `
+	UPDATE plans
+	SET
+		name = ?,
+		description = ?,
+		product_id = ?,
+		unit_amount = ?,
+		currency = ?,
+		interval = ?,
+		metadata = ?,
+		active = ?,
+		synced_at = ?
+	WHERE
+		key = ? ;
+	`
+	_, err := db.ExecContext(context.Background(), db.Rebind(query), cp.Name, cp.Description, cp.ProductID, cp.UnitAmount, cp.Currency, cp.Interval, cp.Metadata, cp.Active, cp.SyncedAt, cp.Key)
+	return err
+}
+
+func updateCatalogProduct(prod stripe.Product) error {
+	if prod.Deleted || !prod.Active {
+		_, err := db.ExecContext(context.Background(), db.Rebind("UPDATE plans SET active = FALSE, synced_at = ? WHERE product_id = ?"), time.Now().Unix(), prod.ID)
+		return err
+	}
+	// Reactivating a product does not reactivate its prices, the next price
+	// event or sync takes care of that.
+	query := `
+	UPDATE plans
+	SET
+		name = ?,
+		description = ?,
+		synced_at = ?
+	WHERE
+		product_id = ? ;
+	`
+	_, err := db.ExecContext(context.Background(), db.Rebind(query), prod.Name, prod.Description, time.Now().Unix(), prod.ID)
+	return err
+}
+
+func setCatalogPriceActive(priceID string, active bool) error {
+	_, err := db.ExecContext(context.Background(), db.Rebind("UPDATE plans SET active = ?, synced_at = ? WHERE price_id = ?"), active, time.Now().Unix(), priceID)
+	return err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// SubscriptionDiscount is the discount of a subscription, from a coupon or a
+// promotion code. End is only set when the coupon repeats for some months.
+type SubscriptionDiscount struct {
+	Coupon        string  `json:"coupon"`
+	Name          string  `json:"name"`
+	PromotionCode string  `json:"promotionCode,omitempty"`
+	PercentOff    float64 `json:"percentOff,omitempty"`
+	AmountOff     int64   `json:"amountOff,omitempty"`
+	Currency      string  `json:"currency,omitempty"`
+	Duration      string  `json:"duration"`
+	Start         int64   `json:"start"`
+	End           int64   `json:"end,omitempty"`
+}
+
+func newSubscriptionDiscount(d *stripe.Discount) *SubscriptionDiscount {
+	if d == nil || d.Coupon == nil {
+		return nil
+	}
+	sd := &SubscriptionDiscount{
+		Coupon:     d.Coupon.ID,
+		Name:       d.Coupon.Name,
+		PercentOff: d.Coupon.PercentOff,
+		AmountOff:  d.Coupon.AmountOff,
+		Currency:   string(d.Coupon.Currency),
+		Duration:   string(d.Coupon.Duration),
+		Start:      d.Start,
+		End:        d.End,
+	}
+	if d.PromotionCode != nil {
+		sd.PromotionCode = d.PromotionCode.Code
+		if sd.PromotionCode == "" {
+			sd.PromotionCode = d.PromotionCode.ID
+		}
+	}
+	return sd
+}
+
+// findPromotionCode returns the active promotion code of Stripe for code once
+// it is checked that the organization may redeem it on a subscription to the
+// base plan. subID is the subscription changing plan, empty for a new one. The
+// error is meant for the caller.
+func findPromotionCode(organization Organization, code string, base CatalogPlan, subID string) (*stripe.PromotionCode, error) {
+	params := &stripe.PromotionCodeListParams{
+		Active: stripe.Bool(true),
+		Code:   stripe.String(code),
+	}
+	params.AddExpand("data.coupon.applies_to")
+	codes, err := stripeAPI.ListPromotionCodes(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check promotion code %q : %w", code, err)
+	}
+	var pc *stripe.PromotionCode
+	for _, c := range codes {
+		if c.Customer == nil || c.Customer.ID == organization.StripeID {
+			pc = c
+			break
+		}
+	}
+	if pc == nil || pc.Coupon == nil || !pc.Coupon.Valid {
+		return nil, fmt.Errorf("promotion code %q is not valid", code)
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case pc.ExpiresAt != 0 && pc.ExpiresAt <= now:
+		return nil, fmt.Errorf("promotion code %q has expired", code)
+	case pc.MaxRedemptions != 0 && pc.TimesRedeemed >= pc.MaxRedemptions:
+		return nil, fmt.Errorf("promotion code %q has been fully redeemed", code)
+	case pc.Coupon.MaxRedemptions != 0 && pc.Coupon.TimesRedeemed >= pc.Coupon.MaxRedemptions:
+		return nil, fmt.Errorf("promotion code %q has been fully redeemed", code)
+	}
+	if pc.Coupon.AppliesTo != nil && len(pc.Coupon.AppliesTo.Products) > 0 {
+		// The product of a plan the catalog did not sync yet comes from its
+		// price.
+		productID := base.ProductID
+		if productID == "" {
+			pr, err := stripeAPI.GetPrice(base.PriceID, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the price of plan %s : %w", base.Key, err)
+			}
+			if pr.Product != nil {
+				productID = pr.Product.ID
+			}
+		}
+		applies := false
+		for _, p := range pc.Coupon.AppliesTo.Products {
+			applies = applies || p == productID
+		}
+		if !applies {
+			return nil, fmt.Errorf("promotion code %q does not apply to plan %s", code, base.Key)
+		}
+	}
+	if pc.Restrictions != nil && pc.Restrictions.FirstTimeTransaction {
+		prior, err := hasPriorTransaction(organization.ID, subID)
+		if err != nil {
+			return nil, err
+		}
+		if prior {
+			return nil, fmt.Errorf("promotion code %q is only valid for a first subscription", code)
+		}
+	}
+	return pc, nil
+}
+
+// hasPriorTransaction tells whether the organization paid an invoice or had
+// a subscription other than subID, one that was never paid for aside.
+func hasPriorTransaction(orgID int, subID string) (bool, error) {
+	paid, err := hasPaidInvoice(orgID)
+	if err != nil || paid {
+		return paid, err
+	}
+	subs, err := store.ListSubscriptions(orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, sub := range subs {
+		switch stripe.SubscriptionStatus(sub.Status) {
+		case stripe.SubscriptionStatusIncomplete, stripe.SubscriptionStatusIncompleteExpired:
+			continue
+		}
+		if sub.ID != subID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// adminSetOrgCoupon applies the coupon to the primary subscription of the
+// organization, replacing its discount.
+func adminSetOrgCoupon(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+	subID := strings.TrimSpace(organization.StripeSubID)
+	if subID == "" {
+		http.Error(w, "organization has no subscription", http.StatusUnprocessableEntity)
+		return
+	}
+	var req struct {
+		Coupon string `json:"coupon"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	req.Coupon = strings.TrimSpace(req.Coupon)
+	if req.Coupon == "" {
+		http.Error(w, "coupon is required", http.StatusUnprocessableEntity)
+		return
+	}
+
+	c, err := stripeAPI.GetCoupon(req.Coupon, nil)
+	switch {
+	case err != nil && strings.Contains(err.Error(), "resource_missing"):
+		http.Error(w, "coupon "+req.Coupon+" not found", http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, "failed to get coupon "+err.Error(), http.StatusInternalServerError)
+		return
+	case !c.Valid:
+		http.Error(w, "coupon "+req.Coupon+" can no longer be redeemed", http.StatusUnprocessableEntity)
+		return
+	}
+
+	params := &stripe.SubscriptionParams{Coupon: stripe.String(c.ID)}
+	params.AddExpand("latest_invoice.payment_intent")
+	params.AddExpand("discount.promotion_code")
+	s, err := stripeAPI.UpdateSubscription(subID, params)
+	if err != nil {
+		http.Error(w, "Failed to apply coupon "+err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("sub.Update: %v", err)
+		return
+	}
+	if err := updateSub(*s); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	writeJSON(w, newSubscriptionResult(s))
+}
+
+// adminDeleteOrgCoupon removes the discount of the primary subscription of
+// the organization, whether it comes from a coupon or a promotion code.
+func adminDeleteOrgCoupon(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+	subID := strings.TrimSpace(organization.StripeSubID)
+	if subID == "" {
+		http.Error(w, "organization has no subscription", http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err := stripeAPI.DeleteSubscriptionDiscount(subID, nil)
+	switch {
+	case err != nil && strings.Contains(err.Error(), "resource_missing"):
+		http.Error(w, "subscription "+subID+" has no discount", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, "Failed to remove the discount "+err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("sub.DeleteDiscount: %v", err)
+		return
+	}
+	// Stripe answers with the deleted discount, not the subscription.
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice.payment_intent")
+	params.AddExpand("discount.promotion_code")
+	s, err := stripeAPI.GetSubscription(subID, params)
+	if err != nil {
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := updateSub(*s); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	writeJSON(w, newSubscriptionResult(s))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Dunning stages of an organization whose renewal payment failed. The
+// product keeps working during the grace period, is restricted once it ends,
+// and suspended once the restriction period ends too.
+const (
+	dunningStageNone       = ""
+	dunningStageGrace      = "grace"
+	dunningStageRestricted = "restricted"
+	dunningStageSuspended  = "suspended"
+)
+
+// dunningConfig holds the durations of the dunning stages, read from
+// DUNNING_GRACE_PERIOD and DUNNING_RESTRICT_PERIOD.
+type dunningConfig struct {
+	GracePeriod    time.Duration
+	RestrictPeriod time.Duration
+}
+
+func loadDunningConfig() dunningConfig {
+	return dunningConfig{
+		GracePeriod:    durationEnv("DUNNING_GRACE_PERIOD", 7*24*time.Hour),
+		RestrictPeriod: durationEnv("DUNNING_RESTRICT_PERIOD", 7*24*time.Hour),
+	}
+}
+
+func durationEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s %q, using %s : %v", name, v, def, err)
+		return def
+	}
+	return d
+}
+
+// dunningTransition is a dunning stage change of an organization.
+type dunningTransition struct {
+	OrgID    int
+	From     string
+	To       string
+	Deadline int64
+}
+
+func (t dunningTransition) String() string {
+	return fmt.Sprintf("dunning of organization %d : %q -> %q, deadline %d", t.OrgID, t.From, t.To, t.Deadline)
+}
+
+// dunningOnPaymentFailed starts the grace period, from the time of the
+// failure, unless the organization is already in dunning.
+func dunningOnPaymentFailed(org Organization, failedAt int64, cfg dunningConfig) (dunningTransition, bool) {
+	if org.DunningStage != dunningStageNone {
+		return dunningTransition{}, false
+	}
+	return dunningTransition{
+		OrgID:    org.ID,
+		From:     org.DunningStage,
+		To:       dunningStageGrace,
+		Deadline: failedAt + int64(cfg.GracePeriod.Seconds()),
+	}, true
+}
+
+// dunningOnPaymentSucceeded ends the dunning of the organization.
+func dunningOnPaymentSucceeded(org Organization) (dunningTransition, bool) {
+	if org.DunningStage == dunningStageNone {
+		return dunningTransition{}, false
+	}
+	return dunningTransition{OrgID: org.ID, From: org.DunningStage, To: dunningStageNone}, true
+}
+
+// dunningOnSubscriptionStatus follows the status of the subscription. Stripe
+// marks it unpaid once all the payment retries failed, which restricts the
+// organization right away.
+func dunningOnSubscriptionStatus(org Organization, status stripe.SubscriptionStatus, at int64, cfg dunningConfig) (dunningTransition, bool) {
+	switch status {
+	case stripe.SubscriptionStatusPastDue:
+		return dunningOnPaymentFailed(org, at, cfg)
+	case stripe.SubscriptionStatusUnpaid:
+		if org.DunningStage == dunningStageNone || org.DunningStage == dunningStageGrace {
+			return dunningTransition{
+				OrgID:    org.ID,
+				From:     org.DunningStage,
+				To:       dunningStageRestricted,
+				Deadline: at + int64(cfg.RestrictPeriod.Seconds()),
+			}, true
+		}
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing, stripe.SubscriptionStatusCanceled:
+		return dunningOnPaymentSucceeded(org)
+	}
+	return dunningTransition{}, false
+}
+
+// nextDunningStage returns the transition due when the deadline of the
+// current stage has passed.
+func nextDunningStage(org Organization, cfg dunningConfig) (dunningTransition, bool) {
+	switch org.DunningStage {
+	case dunningStageGrace:
+		return dunningTransition{
+			OrgID:    org.ID,
+			From:     org.DunningStage,
+			To:       dunningStageRestricted,
+			Deadline: org.DunningDeadline + int64(cfg.RestrictPeriod.Seconds()),
+		}, true
+	case dunningStageRestricted:
+		return dunningTransition{OrgID: org.ID, From: org.DunningStage, To: dunningStageSuspended}, true
+	}
+	return dunningTransition{}, false
+}
+
+// runDunningScheduler advances the dunning stages whose deadline passed,
+// every interval.
+func runDunningScheduler(interval time.Duration, cfg dunningConfig) {
+	for {
+		if err := advanceDunningStages(time.Now().Unix(), cfg); err != nil {
+			log.Printf("advanceDunningStages: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func advanceDunningStages(now int64, cfg dunningConfig) error {
+	// Loop as an organization may have skipped more than one stage while
+	// the scheduler was not running.
+	for {
+		var orgs []Organization
+		query := "SELECT * FROM organization WHERE dunning_stage IN (?, ?) AND dunning_deadline > 0 AND dunning_deadline <= ?"
+		if err := db.Select(&orgs, db.Rebind(query), dunningStageGrace, dunningStageRestricted, now); err != nil {
+			return err
+		}
+		if len(orgs) == 0 {
+			return nil
+		}
+		for _, org := range orgs {
+			t, ok := nextDunningStage(org, cfg)
+			if !ok {
+				continue
+			}
+			if _, err := applyDunningTransition(t, org.DunningDeadline); err != nil {
+				return err
+			}
+			log.Printf("dunning of organization %d : %q -> %q, deadline %d", t.OrgID, t.From, t.To, t.Deadline)
+		}
+	}
+}
+
+// applyDunningTransition writes t if the organization is still in the stage
+// and deadline it was computed from.
+func applyDunningTransition(t dunningTransition, fromDeadline int64) (bool, error) {
+	query := `
+	UPDATE organization
+	SET
+		dunning_stage = ?,
+		dunning_deadline = ?
+	WHERE
+		id = ? AND dunning_stage = ? AND dunning_deadline = ? ;
+	`
+	res, err := db.ExecContext(context.Background(), db.Rebind(query), t.To, t.Deadline, t.OrgID, t.From, fromDeadline)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"autha-stripe/entitlements"
+
+	"github.com/go-zoo/bone"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// PlanFeature is a feature granted by a catalog plan, stored in the
+// plan_features table. A nil Limit means unlimited.
+type PlanFeature struct {
+	PlanKey string `json:"-"       db:"plan_key"`
+	Feature string `json:"feature" db:"feature"`
+	Limit   *int64 `json:"limit"   db:"limit_value"`
+}
+
+func getOrgEntitlements(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	e, err := resolveOrgEntitlements(organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, e)
+}
+
+func adminGetPlanFeatures(w http.ResponseWriter, r *http.Request) {
+	features, err := listPlanFeatures(bone.GetValue(r, "key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, features)
+}
+
+// adminSetPlanFeatures replaces the features of a plan.
+func adminSetPlanFeatures(w http.ResponseWriter, r *http.Request) {
+	key := bone.GetValue(r, "key")
+	if _, err := getCatalogPlan(key); err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var features []PlanFeature
+	if err := json.NewDecoder(r.Body).Decode(&features); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	for i := range features {
+		features[i].PlanKey = key
+		features[i].Feature = strings.TrimSpace(features[i].Feature)
+		if features[i].Feature == "" {
+			http.Error(w, "feature is required", http.StatusUnprocessableEntity)
+			return
+		}
+		if features[i].Limit != nil && *features[i].Limit < 0 {
+			http.Error(w, "limit can not be negative, omit it for unlimited", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	if err := replacePlanFeatures(key, features); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, features)
+}
+
+// resolveOrgEntitlements resolves the entitlements of org from its active
+// plans, its subscription status, its dunning stage and whether it is paused.
+// The plans of the other subscriptions of the organization are added while
+// they are paid for and not paused.
+func resolveOrgEntitlements(org Organization) (entitlements.Entitlements, error) {
+	in := entitlements.Input{
+		OrgID:        org.ID,
+		Status:       org.SubStatus,
+		DunningStage: org.DunningStage,
+		Paused:       org.Pause != nil || org.SubStatus == string(stripe.SubscriptionStatusPaused),
+	}
+	plans := org.Plans
+	subs, err := store.ListSubscriptions(org.ID)
+	if err != nil {
+		return entitlements.Entitlements{}, err
+	}
+	for _, sub := range subs {
+		switch stripe.SubscriptionStatus(sub.Status) {
+		case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing, stripe.SubscriptionStatusPastDue:
+		default:
+			continue
+		}
+		if sub.ID == org.StripeSubID || sub.PauseBehavior != "" {
+			continue
+		}
+		for _, item := range sub.Items {
+			plans = append(plans, item.Plan())
+		}
+	}
+	for _, p := range plans {
+		if !p.Active {
+			continue
+		}
+		// Retired plans still grant their features to existing subscribers.
+		cp, err := getCatalogPlanByPrice(p.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return entitlements.Entitlements{}, err
+		}
+		features, err := listPlanFeatures(cp.Key)
+		if err != nil {
+			return entitlements.Entitlements{}, err
+		}
+		ep := entitlements.Plan{Key: cp.Key}
+		for _, f := range features {
+			// Every unit of an add-on grants its limits again.
+			if cp.Kind == catalogKindAddOn && f.Limit != nil && p.Quantity > 1 {
+				l := *f.Limit * p.Quantity
+				f.Limit = &l
+			}
+			ep.Features = append(ep.Features, entitlements.Feature{Key: f.Feature, Limit: f.Limit})
+		}
+		in.Plans = append(in.Plans, ep)
+	}
+	return entitlements.Resolve(in), nil
+}
+
+func listPlanFeatures(planKey string) ([]PlanFeature, error) {
+	features := []PlanFeature{}
+	err := db.Select(&features, db.Rebind("SELECT * FROM plan_features WHERE plan_key = ? ORDER BY feature"), planKey)
+	return features, err
+}
+
+func replacePlanFeatures(planKey string, features []PlanFeature) error {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM plan_features WHERE plan_key = ?"), planKey); err != nil {
+		return err
+	}
+	for _, f := range features {
+		if _, err := tx.Exec(tx.Rebind("INSERT INTO plan_features (plan_key, feature, limit_value) VALUES (?, ?, ?)"), planKey, f.Feature, f.Limit); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
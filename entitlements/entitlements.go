@@ -0,0 +1,144 @@
+// Package entitlements resolves what an organization may use, and up to which
+// limit, from the plans it is subscribed to and the state of its billing.
+package entitlements
+
+import "sort"
+
+// Access is the overall access level of an organization.
+type Access string
+
+const (
+	// AccessFull grants every feature of the subscribed plans.
+	AccessFull Access = "full"
+	// AccessRestricted keeps the features listed, with their limits, but
+	// none of them is enabled. The product is expected to stay readable.
+	AccessRestricted Access = "restricted"
+	// AccessNone grants nothing.
+	AccessNone Access = "none"
+)
+
+// Feature is a feature granted by a plan. A nil Limit means unlimited.
+type Feature struct {
+	Key   string `json:"feature"`
+	Limit *int64 `json:"limit"`
+}
+
+// Plan is a subscribed plan with the features it grants.
+type Plan struct {
+	Key      string    `json:"key"`
+	Features []Feature `json:"features"`
+}
+
+// Input is the billing state of an organization.
+type Input struct {
+	OrgID int
+	// Status is the Stripe status of the organization subscription.
+	Status string
+	// DunningStage is "", "grace", "restricted" or "suspended".
+	DunningStage string
+	// Paused is set while the collection of the subscription is paused.
+	Paused bool
+	// Plans are the active plans of the subscription.
+	Plans []Plan
+}
+
+// Grant is the effective entitlement to a feature. A nil Limit means
+// unlimited.
+type Grant struct {
+	Enabled bool   `json:"enabled"`
+	Limit   *int64 `json:"limit"`
+}
+
+// Entitlements are the effective entitlements of an organization.
+type Entitlements struct {
+	OrgID        int              `json:"org_id"`
+	Status       string           `json:"status"`
+	DunningStage string           `json:"dunning_stage"`
+	Paused       bool             `json:"paused"`
+	Access       Access           `json:"access"`
+	Plans        []string         `json:"plans"`
+	Features     map[string]Grant `json:"features"`
+}
+
+// Resolve computes the entitlements of an organization. A feature granted by
+// several plans is enabled if any of them grants it, and its limits add up,
+// unlimited winning over any limit.
+func Resolve(in Input) Entitlements {
+	e := Entitlements{
+		OrgID:        in.OrgID,
+		Status:       in.Status,
+		DunningStage: in.DunningStage,
+		Paused:       in.Paused,
+		Access:       access(in.Status, in.DunningStage, in.Paused),
+		Plans:        []string{},
+		Features:     map[string]Grant{},
+	}
+	if e.Access == AccessNone {
+		return e
+	}
+
+	unlimited := map[string]bool{}
+	for _, p := range in.Plans {
+		e.Plans = append(e.Plans, p.Key)
+		for _, f := range p.Features {
+			g := e.Features[f.Key]
+			g.Enabled = e.Access == AccessFull
+			switch {
+			case unlimited[f.Key]:
+			case f.Limit == nil:
+				unlimited[f.Key] = true
+				g.Limit = nil
+			case g.Limit == nil:
+				l := *f.Limit
+				g.Limit = &l
+			default:
+				l := *g.Limit + *f.Limit
+				g.Limit = &l
+			}
+			e.Features[f.Key] = g
+		}
+	}
+	sort.Strings(e.Plans)
+	return e
+}
+
+// Allows reports whether the feature is enabled.
+func (e Entitlements) Allows(feature string) bool {
+	return e.Features[feature].Enabled
+}
+
+// Limit returns the limit of an enabled feature, ok is false when the
+// feature is not enabled and limit is -1 when it is unlimited.
+func (e Entitlements) Limit(feature string) (limit int64, ok bool) {
+	g := e.Features[feature]
+	if !g.Enabled {
+		return 0, false
+	}
+	if g.Limit == nil {
+		return -1, true
+	}
+	return *g.Limit, true
+}
+
+func access(status, dunningStage string, paused bool) Access {
+	switch dunningStage {
+	case "suspended":
+		return AccessNone
+	case "restricted":
+		return AccessRestricted
+	}
+	// A paused subscription is not paid for but is not ended either.
+	if paused {
+		switch status {
+		case "active", "trialing", "past_due", "unpaid", "paused":
+			return AccessRestricted
+		}
+	}
+	switch status {
+	case "active", "trialing", "past_due":
+		return AccessFull
+	case "unpaid", "paused":
+		return AccessRestricted
+	}
+	return AccessNone
+}
@@ -0,0 +1,125 @@
+package entitlements
+
+import (
+	"reflect"
+	"testing"
+)
+
+func limit(n int64) *int64 {
+	return &n
+}
+
+func TestResolve(t *testing.T) {
+	pro := Plan{Key: "pro", Features: []Feature{{Key: "seats", Limit: limit(10)}, {Key: "sso"}}}
+	storage := Plan{Key: "storage", Features: []Feature{{Key: "seats", Limit: limit(5)}, {Key: "gb", Limit: limit(100)}}}
+	unlimited := Plan{Key: "unlimited", Features: []Feature{{Key: "seats"}}}
+
+	tests := []struct {
+		name   string
+		in     Input
+		access Access
+		plans  []string
+		want   map[string]Grant
+	}{
+		{
+			name:   "active",
+			in:     Input{Status: "active", Plans: []Plan{pro}},
+			access: AccessFull,
+			plans:  []string{"pro"},
+			want:   map[string]Grant{"seats": {true, limit(10)}, "sso": {true, nil}},
+		},
+		{
+			name:   "limits add up",
+			in:     Input{Status: "active", Plans: []Plan{storage, pro}},
+			access: AccessFull,
+			plans:  []string{"pro", "storage"},
+			want:   map[string]Grant{"seats": {true, limit(15)}, "sso": {true, nil}, "gb": {true, limit(100)}},
+		},
+		{
+			name:   "unlimited first",
+			in:     Input{Status: "active", Plans: []Plan{unlimited, pro}},
+			access: AccessFull,
+			plans:  []string{"pro", "unlimited"},
+			want:   map[string]Grant{"seats": {true, nil}, "sso": {true, nil}},
+		},
+		{
+			name:   "unlimited last",
+			in:     Input{Status: "trialing", Plans: []Plan{pro, storage, unlimited}},
+			access: AccessFull,
+			plans:  []string{"pro", "storage", "unlimited"},
+			want:   map[string]Grant{"seats": {true, nil}, "sso": {true, nil}, "gb": {true, limit(100)}},
+		},
+		{
+			name:   "past due",
+			in:     Input{Status: "past_due", DunningStage: "grace", Plans: []Plan{pro}},
+			access: AccessFull,
+			plans:  []string{"pro"},
+			want:   map[string]Grant{"seats": {true, limit(10)}, "sso": {true, nil}},
+		},
+		{
+			name:   "unpaid",
+			in:     Input{Status: "unpaid", Plans: []Plan{pro}},
+			access: AccessRestricted,
+			plans:  []string{"pro"},
+			want:   map[string]Grant{"seats": {false, limit(10)}, "sso": {false, nil}},
+		},
+		{
+			name:   "paused",
+			in:     Input{Status: "active", Paused: true, Plans: []Plan{pro}},
+			access: AccessRestricted,
+			plans:  []string{"pro"},
+			want:   map[string]Grant{"seats": {false, limit(10)}, "sso": {false, nil}},
+		},
+		{
+			name:   "dunning restricted",
+			in:     Input{Status: "past_due", DunningStage: "restricted", Plans: []Plan{pro}},
+			access: AccessRestricted,
+			plans:  []string{"pro"},
+			want:   map[string]Grant{"seats": {false, limit(10)}, "sso": {false, nil}},
+		},
+		{
+			name:   "dunning suspended",
+			in:     Input{Status: "past_due", DunningStage: "suspended", Plans: []Plan{pro}},
+			access: AccessNone,
+			plans:  []string{},
+			want:   map[string]Grant{},
+		},
+		{
+			name:   "canceled",
+			in:     Input{Status: "canceled", Plans: []Plan{pro}},
+			access: AccessNone,
+			plans:  []string{},
+			want:   map[string]Grant{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Resolve(tt.in)
+			if e.Access != tt.access || !reflect.DeepEqual(e.Plans, tt.plans) || !reflect.DeepEqual(e.Features, tt.want) {
+				t.Fatalf("got %s access to %v with %+v, want %s access to %v with %+v", e.Access, e.Plans, e.Features, tt.access, tt.plans, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	plans := []Plan{{Key: "pro", Features: []Feature{{Key: "seats", Limit: limit(10)}, {Key: "sso"}}}}
+	e := Resolve(Input{Status: "active", Plans: plans})
+	for _, tt := range []struct {
+		feature string
+		limit   int64
+		ok      bool
+	}{
+		{"seats", 10, true},
+		{"sso", -1, true},
+		{"audit", 0, false},
+	} {
+		if l, ok := e.Limit(tt.feature); l != tt.limit || ok != tt.ok || e.Allows(tt.feature) != tt.ok {
+			t.Fatalf("got limit %d, %v of %s, want %d, %v", l, ok, tt.feature, tt.limit, tt.ok)
+		}
+	}
+	restricted := Resolve(Input{Status: "unpaid", Plans: plans})
+	if _, ok := restricted.Limit("seats"); ok || restricted.Allows("seats") {
+		t.Fatal("got seats allowed while restricted")
+	}
+}
@@ -0,0 +1,202 @@
+package entitlements
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens are JWTs signed with Ed25519 ("EdDSA"). The billing server publishes
+// its public keys as a JWKS so that other services verify tokens locally.
+
+var (
+	ErrInvalidToken = errors.New("entitlements: invalid token")
+	ErrExpiredToken = errors.New("entitlements: token expired")
+	ErrUnknownKey   = errors.New("entitlements: unknown signing key")
+)
+
+// Claims are the content of an entitlement token.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Entitlements
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Sign returns the token of claims signed by key, kid identifies the key in
+// the JWKS.
+func Sign(claims Claims, kid string, key ed25519.PrivateKey) (string, error) {
+	h, err := json.Marshal(header{Alg: "EdDSA", Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64(h) + "." + b64(c)
+	sig := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + b64(sig), nil
+}
+
+// Verify checks the signature, issuer and expiry of token and returns its
+// claims.
+func Verify(token, issuer string, keys KeySet, now time.Time) (Claims, error) {
+	var claims Claims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return claims, err
+	}
+	if h.Alg != "EdDSA" {
+		return claims, fmt.Errorf("%w : unsupported alg %q", ErrInvalidToken, h.Alg)
+	}
+	pub, err := keys.PublicKey(h.Kid)
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return claims, ErrInvalidToken
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	if claims.Issuer != issuer {
+		return claims, fmt.Errorf("%w : unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+// KeySet resolves the public key of a key ID.
+type KeySet interface {
+	PublicKey(kid string) (ed25519.PublicKey, error)
+}
+
+// JWK is an Ed25519 public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// NewJWK returns the JWK of an Ed25519 public key.
+func NewJWK(kid string, pub ed25519.PublicKey) JWK {
+	return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub), Kid: kid, Use: "sig", Alg: "EdDSA"}
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKey implements KeySet.
+func (s JWKS) PublicKey(kid string) (ed25519.PublicKey, error) {
+	for _, k := range s.Keys {
+		if k.Kid != kid {
+			continue
+		}
+		if k.Kty != "OKP" || k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w : key %q is not an Ed25519 key", ErrUnknownKey, kid)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w : key %q is malformed", ErrUnknownKey, kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// RemoteKeySet is a KeySet fetched from the JWKS endpoint of the billing
+// server. It is fetched again when a token is signed by an unknown key, at
+// most once per MinRefresh, so that key rotations are picked up.
+type RemoteKeySet struct {
+	URL        string
+	MinRefresh time.Duration
+	Client     *http.Client
+
+	mu        sync.Mutex
+	jwks      JWKS
+	fetchedAt time.Time
+}
+
+// NewRemoteKeySet returns a RemoteKeySet for the JWKS published at url.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{URL: url, MinRefresh: time.Minute, Client: http.DefaultClient}
+}
+
+// PublicKey implements KeySet.
+func (s *RemoteKeySet) PublicKey(kid string) (ed25519.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pub, err := s.jwks.PublicKey(kid)
+	if err == nil || time.Since(s.fetchedAt) < s.MinRefresh {
+		return pub, err
+	}
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	return s.jwks.PublicKey(kid)
+}
+
+func (s *RemoteKeySet) fetch() error {
+	s.fetchedAt = time.Now()
+	resp, err := s.Client.Get(s.URL)
+	if err != nil {
+		return fmt.Errorf("entitlements: failed to fetch jwks : %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("entitlements: failed to fetch jwks : %s", resp.Status)
+	}
+	var jwks JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("entitlements: failed to decode jwks : %w", err)
+	}
+	s.jwks = jwks
+	return nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package entitlements
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testIssuer = "autha-stripe"
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testClaims(now time.Time) Claims {
+	return Claims{
+		Issuer:    testIssuer,
+		Subject:   "1",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(5 * time.Minute).Unix(),
+		Entitlements: Entitlements{
+			OrgID:    1,
+			Status:   "active",
+			Access:   AccessFull,
+			Plans:    []string{"planA"},
+			Features: map[string]Grant{"sso": {Enabled: true}},
+		},
+	}
+}
+
+func sign(t *testing.T, claims Claims, kid string, key ed25519.PrivateKey) string {
+	t.Helper()
+
+	token, err := Sign(claims, kid, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// resign replaces the header and claims of the token, keeping its signature
+// unless key is set.
+func resign(t *testing.T, token string, h header, claims Claims, key ed25519.PrivateKey) string {
+	t.Helper()
+
+	hb, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := b64(hb) + "." + b64(cb)
+	if key == nil {
+		return signingInput + "." + strings.Split(token, ".")[2]
+	}
+	return signingInput + "." + b64(ed25519.Sign(key, []byte(signingInput)))
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	key := newTestKey(t)
+	keys := JWKS{Keys: []JWK{NewJWK("k1", key.Public().(ed25519.PublicKey))}}
+	claims := testClaims(now)
+	token := sign(t, claims, "k1", key)
+
+	got, err := Verify(token, testIssuer, keys, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != claims.Subject || got.ExpiresAt != claims.ExpiresAt || got.Access != AccessFull ||
+		len(got.Plans) != 1 || !got.Features["sso"].Enabled {
+		t.Fatalf("got claims %+v, want %+v", got, claims)
+	}
+
+	tampered := claims
+	tampered.Access = AccessRestricted
+	forged := claims
+	forged.ExpiresAt = now.Add(time.Hour).Unix()
+	other := newTestKey(t)
+	sig, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[0] ^= 0xff
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name   string
+		token  string
+		issuer string
+		keys   KeySet
+		now    time.Time
+		want   error
+	}{
+		{"tampered payload", resign(t, token, header{Alg: "EdDSA", Typ: "JWT", Kid: "k1"}, tampered, nil), testIssuer, keys, now, ErrInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + b64(sig), testIssuer, keys, now, ErrInvalidToken},
+		{"signed by another key", resign(t, token, header{Alg: "EdDSA", Typ: "JWT", Kid: "k1"}, forged, other), testIssuer, keys, now, ErrInvalidToken},
+		{"alg none", resign(t, token, header{Alg: "none", Typ: "JWT", Kid: "k1"}, claims, nil), testIssuer, keys, now, ErrInvalidToken},
+		{"alg HS256", resign(t, token, header{Alg: "HS256", Typ: "JWT", Kid: "k1"}, claims, nil), testIssuer, keys, now, ErrInvalidToken},
+		{"unknown kid", resign(t, token, header{Alg: "EdDSA", Typ: "JWT", Kid: "k2"}, claims, nil), testIssuer, keys, now, ErrUnknownKey},
+		{"other issuer", token, "other", keys, now, ErrInvalidToken},
+		{"expired", token, testIssuer, keys, time.Unix(claims.ExpiresAt, 0), ErrExpiredToken},
+		{"malformed", parts[0] + "." + parts[1], testIssuer, keys, now, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(tt.token, tt.issuer, tt.keys, tt.now); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteKeySetRotation(t *testing.T) {
+	now := time.Now()
+	previous, current := newTestKey(t), newTestKey(t)
+	var jwks atomic.Value
+	jwks.Store(JWKS{Keys: []JWK{NewJWK("k1", previous.Public().(ed25519.PublicKey))}})
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(jwks.Load())
+	}))
+	defer srv.Close()
+
+	keys := NewRemoteKeySet(srv.URL)
+	keys.MinRefresh = 0
+	before := sign(t, testClaims(now), "k1", previous)
+	if _, err := Verify(before, testIssuer, keys, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated JWKS publishes the retired key until the tokens it signed
+	// expire, the key set fetches it for the new kid.
+	jwks.Store(JWKS{Keys: []JWK{
+		NewJWK("k2", current.Public().(ed25519.PublicKey)),
+		NewJWK("k1", previous.Public().(ed25519.PublicKey)),
+	}})
+	after := sign(t, testClaims(now), "k2", current)
+	for _, token := range []string{after, before} {
+		if _, err := Verify(token, testIssuer, keys, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("got %d fetches of the jwks, want 2", n)
+	}
+
+	// Once the retired key is no longer published its tokens are rejected.
+	jwks.Store(JWKS{Keys: []JWK{NewJWK("k2", current.Public().(ed25519.PublicKey))}})
+	keys = NewRemoteKeySet(srv.URL)
+	if _, err := Verify(before, testIssuer, keys, now); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v verifying a token of the retired key, want %v", err, ErrUnknownKey)
+	}
+
+	// Unknown keys are fetched at most once per MinRefresh.
+	keys.MinRefresh = time.Hour
+	fetched := atomic.LoadInt32(&fetches)
+	if _, err := Verify(before, testIssuer, keys, now); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownKey)
+	}
+	if n := atomic.LoadInt32(&fetches); n != fetched {
+		t.Fatalf("got %d fetches of the jwks within MinRefresh, want %d", n, fetched)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+const (
+	eventStatusPending    = "pending"
+	eventStatusProcessing = "processing"
+	eventStatusProcessed  = "processed"
+	eventStatusFailed     = "failed"
+)
+
+// eventProcessingLease is how long a delivery may hold an event in the
+// processing state before another delivery of the same event can take over.
+const eventProcessingLease = 5 * time.Minute
+
+// StripeEvent is a webhook event as stored in the stripe_events table.
+type StripeEvent struct {
+	ID          string `json:"id"           db:"id"`
+	Type        string `json:"type"         db:"type"`
+	Payload     []byte `json:"-"            db:"payload"`
+	CustomerID  string `json:"customer_id"  db:"customer_id"`
+	Created     int64  `json:"created"      db:"created"`
+	ReceivedAt  int64  `json:"received_at"  db:"received_at"`
+	Status      string `json:"status"       db:"status"`
+	Error       string `json:"error"        db:"error"`
+	Attempts    int    `json:"attempts"     db:"attempts"`
+	ClaimedAt   int64  `json:"-"            db:"claimed_at"`
+	ProcessedAt int64  `json:"processed_at" db:"processed_at"`
+}
+
+// recordEvent stores the event unless it is already known.
+func recordEvent(event stripe.Event, payload []byte) error {
+	query := `
+	INSERT INTO stripe_events (id, type, payload, customer_id, created, received_at, status)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO NOTHING;
+	`
+	_, err := db.ExecContext(context.Background(), db.Rebind(query), event.ID, event.Type, payload, eventCustomerID(event), event.Created, time.Now().Unix(), eventStatusPending)
+	return err
+}
+
+// claimEvent marks the event as being processed. It returns false when the
+// event was already processed or another delivery is processing it.
+func claimEvent(id string) (bool, error) {
+	return claimEventFrom(id, eventStatusPending, eventStatusFailed)
+}
+
+// claimEventForReplay is claimEvent for a replay, which processes the event
+// again once it was processed.
+func claimEventForReplay(id string) (bool, error) {
+	return claimEventFrom(id, eventStatusPending, eventStatusFailed, eventStatusProcessed)
+}
+
+// claimEventFrom marks the event as being processed if it has one of the
+// statuses, or if the lease of the delivery processing it expired.
+func claimEventFrom(id string, statuses ...string) (bool, error) {
+	now := time.Now()
+	query := `
+	UPDATE stripe_events
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		claimed_at = ?
+	WHERE
+		id = ? AND (status IN (?` + strings.Repeat(", ?", len(statuses)-1) + `) OR (status = ? AND claimed_at < ?)) ;
+	`
+	args := []interface{}{eventStatusProcessing, now.Unix(), id}
+	for _, s := range statuses {
+		args = append(args, s)
+	}
+	args = append(args, eventStatusProcessing, now.Add(-eventProcessingLease).Unix())
+	res, err := db.ExecContext(context.Background(), db.Rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func markEventProcessed(id string) error {
+	query := "UPDATE stripe_events SET status = ?, error = '', processed_at = ? WHERE id = ?"
+	_, err := db.ExecContext(context.Background(), db.Rebind(query), eventStatusProcessed, time.Now().Unix(), id)
+	return err
+}
+
+func markEventFailed(id string, procErr error) error {
+	query := "UPDATE stripe_events SET status = ?, error = ? WHERE id = ?"
+	_, err := db.ExecContext(context.Background(), db.Rebind(query), eventStatusFailed, procErr.Error(), id)
+	return err
+}
+
+func getStoredEvent(id string) (StripeEvent, error) {
+	var se StripeEvent
+	err := db.Get(&se, db.Rebind("SELECT * FROM stripe_events WHERE id = ?"), id)
+	return se, err
+}
+
+// eventCustomerID returns the customer the event object belongs to, if any.
+func eventCustomerID(event stripe.Event) string {
+	if event.Data == nil {
+		return ""
+	}
+	if event.GetObjectValue("object") == "customer" {
+		return event.GetObjectValue("id")
+	}
+	// The customer is an object when the payload expanded it.
+	if c, ok := event.Data.Object["customer"].(map[string]interface{}); ok {
+		id, _ := c["id"].(string)
+		return id
+	}
+	return event.GetObjectValue("customer")
+}
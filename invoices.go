@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Invoice is the local copy of a Stripe invoice, kept current by the
+// invoice.* webhooks so that the billing history is served without calling
+// Stripe.
+type Invoice struct {
+	ID               string `json:"id"                 db:"id"`
+	OrgID            int    `json:"org_id"             db:"org_id"`
+	CustomerID       string `json:"customer_id"        db:"customer_id"`
+	SubscriptionID   string `json:"subscription_id"    db:"subscription_id"`
+	Number           string `json:"number"             db:"number"`
+	Status           string `json:"status"             db:"status"`
+	Currency         string `json:"currency"           db:"currency"`
+	AmountDue        int64  `json:"amount_due"         db:"amount_due"`
+	AmountPaid       int64  `json:"amount_paid"        db:"amount_paid"`
+	AmountRemaining  int64  `json:"amount_remaining"   db:"amount_remaining"`
+	HostedInvoiceURL string `json:"hosted_invoice_url" db:"hosted_invoice_url"`
+	InvoicePDF       string `json:"invoice_pdf"        db:"invoice_pdf"`
+	PeriodStart      int64  `json:"period_start"       db:"period_start"`
+	PeriodEnd        int64  `json:"period_end"         db:"period_end"`
+	AttemptCount     int64  `json:"attempt_count"      db:"attempt_count"`
+	NextAttemptAt    int64  `json:"next_attempt_at"    db:"next_attempt_at"`
+	Created          int64  `json:"created"            db:"created"`
+	EventAt          int64  `json:"-"                  db:"event_at"`
+}
+
+func getOrgInvoices(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	invoices, err := listOrgInvoices(organization.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, invoices)
+}
+
+// handleInvoiceEvent stores the invoice of an invoice.paid,
+// invoice.payment_failed or invoice.finalized event.
+func handleInvoiceEvent(event stripe.Event, opts eventOptions) ([]string, error) {
+	var in stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &in); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal invoice : %w", err)
+	}
+	if in.Customer == nil {
+		return nil, fmt.Errorf("invoice %s has no customer", in.ID)
+	}
+	org, err := store.GetOrganizationByStripeID(in.Customer.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []string{"skip : no organization for customer " + in.Customer.ID}, nil
+		}
+		return nil, err
+	}
+
+	inv := newInvoice(in, org.ID)
+	inv.EventAt = event.Created
+	changes := []string{fmt.Sprintf("store invoice %s of organization %d : status %q, amount due %d, amount paid %d", inv.ID, org.ID, inv.Status, inv.AmountDue, inv.AmountPaid)}
+
+	// Only the renewals of the primary subscription drive the dunning.
+	var dt dunningTransition
+	var dunning bool
+	if inv.SubscriptionID != "" && inv.SubscriptionID == org.StripeSubID {
+		switch event.Type {
+		case "invoice.payment_failed":
+			dt, dunning = dunningOnPaymentFailed(org, event.Created, loadDunningConfig())
+		case "invoice.paid":
+			dt, dunning = dunningOnPaymentSucceeded(org)
+		}
+	}
+	if dunning {
+		changes = append(changes, dt.String())
+	}
+	if opts.DryRun {
+		return changes, nil
+	}
+
+	stored, err := upsertInvoice(inv)
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		return []string{"skip : a newer event was already applied to invoice " + inv.ID}, nil
+	}
+	if dunning {
+		if _, err := applyDunningTransition(dt, org.DunningDeadline); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+func newInvoice(in stripe.Invoice, orgID int) Invoice {
+	inv := Invoice{
+		ID:               in.ID,
+		OrgID:            orgID,
+		CustomerID:       in.Customer.ID,
+		Number:           in.Number,
+		Status:           string(in.Status),
+		Currency:         string(in.Currency),
+		AmountDue:        in.AmountDue,
+		AmountPaid:       in.AmountPaid,
+		AmountRemaining:  in.AmountRemaining,
+		HostedInvoiceURL: in.HostedInvoiceURL,
+		InvoicePDF:       in.InvoicePDF,
+		PeriodStart:      in.PeriodStart,
+		PeriodEnd:        in.PeriodEnd,
+		AttemptCount:     in.AttemptCount,
+		NextAttemptAt:    in.NextPaymentAttempt,
+		Created:          in.Created,
+	}
+	if in.Subscription != nil {
+		inv.SubscriptionID = in.Subscription.ID
+	}
+	// The invoice period of a renewal is the period that just ended, the
+	// lines carry the period that is billed.
+	if in.Lines != nil {
+		for i, line := range in.Lines.Data {
+			if line.Period == nil {
+				continue
+			}
+			if i == 0 || line.Period.Start < inv.PeriodStart {
+				inv.PeriodStart = line.Period.Start
+			}
+			if i == 0 || line.Period.End > inv.PeriodEnd {
+				inv.PeriodEnd = line.Period.End
+			}
+		}
+	}
+	return inv
+}
+
+// upsertInvoice stores inv unless the stored copy comes from a newer event.
+func upsertInvoice(inv Invoice) (bool, error) {
+	query := `
+	INSERT INTO invoices (id, org_id, customer_id, subscription_id, number, status, currency,
+		amount_due, amount_paid, amount_remaining, hosted_invoice_url, invoice_pdf,
+		period_start, period_end, attempt_count, next_attempt_at, created, event_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		org_id = excluded.org_id,
+		subscription_id = excluded.subscription_id,
+		number = excluded.number,
+		status = excluded.status,
+		currency = excluded.currency,
+		amount_due = excluded.amount_due,
+		amount_paid = excluded.amount_paid,
+		amount_remaining = excluded.amount_remaining,
+		hosted_invoice_url = excluded.hosted_invoice_url,
+		invoice_pdf = excluded.invoice_pdf,
+		period_start = excluded.period_start,
+		period_end = excluded.period_end,
+		attempt_count = excluded.attempt_count,
+		next_attempt_at = excluded.next_attempt_at,
+		event_at = excluded.event_at
+	WHERE
+		invoices.event_at <= excluded.event_at ;
+	`
+	res, err := db.ExecContext(context.Background(), db.Rebind(query), inv.ID, inv.OrgID, inv.CustomerID, inv.SubscriptionID, inv.Number, inv.Status, inv.Currency,
+		inv.AmountDue, inv.AmountPaid, inv.AmountRemaining, inv.HostedInvoiceURL, inv.InvoicePDF,
+		inv.PeriodStart, inv.PeriodEnd, inv.AttemptCount, inv.NextAttemptAt, inv.Created, inv.EventAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// hasPaidInvoice tells whether the organization paid an invoice with a non
+// zero amount, the invoices of trials are free.
+func hasPaidInvoice(orgID int) (bool, error) {
+	var n int
+	query := "SELECT COUNT(*) FROM invoices WHERE org_id = ? AND status = ? AND amount_paid > 0"
+	err := db.Get(&n, db.Rebind(query), orgID, string(stripe.InvoiceStatusPaid))
+	return n > 0, err
+}
+
+func listOrgInvoices(orgID int) ([]Invoice, error) {
+	invoices := []Invoice{}
+	err := db.Select(&invoices, db.Rebind("SELECT * FROM invoices WHERE org_id = ? ORDER BY created DESC"), orgID)
+	return invoices, err
+}
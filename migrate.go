@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are the numbered SQL files of the migrations directory of the
+// store dialect, named <version>_<name>.up.sql and <version>_<name>.down.sql.
+// Both dialects have the same versions. Every migration is applied in a
+// transaction together with its schema_migrations row.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// baselineVersion is the last migration of the schema that initSchema used to
+// create at startup, before migrations existed.
+const baselineVersion = 8
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// AppliedMigration is a row of the schema_migrations table.
+type AppliedMigration struct {
+	Version   int    `db:"version"`
+	Name      string `db:"name"`
+	AppliedAt int64  `db:"applied_at"`
+}
+
+func autoMigrate() bool {
+	v := os.Getenv("AUTO_MIGRATE")
+	if v == "" {
+		return true
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid AUTO_MIGRATE %q, migrating : %v", v, err)
+		return true
+	}
+	return b
+}
+
+// checkMigrations migrates the database at startup, or refuses to start on a
+// database that is not up to date when AUTO_MIGRATE is off.
+func checkMigrations() error {
+	if autoMigrate() {
+		applied, err := migrateUp(0)
+		for _, m := range applied {
+			log.Printf("applied migration %04d %s", m.Version, m.Name)
+		}
+		return err
+	}
+	pending, err := pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d pending migrations, run the migrate command or set AUTO_MIGRATE", len(pending))
+	}
+	return nil
+}
+
+// runMigrateCommand runs `migrate up|down|status`.
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage : migrate up [-to version] | down [-steps n | -to version] | status")
+	}
+	fset := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	to := fset.Int("to", 0, "version to migrate to, up defaults to the latest")
+	steps := fset.Int("steps", 1, "number of migrations to revert, when -to is not set")
+	if err := fset.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrateUp(*to)
+		for _, m := range applied {
+			fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+		}
+		return err
+	case "down":
+		target := *to
+		toSet := false
+		fset.Visit(func(f *flag.Flag) { toSet = toSet || f.Name == "to" })
+		if !toSet {
+			versions, err := appliedMigrationVersions()
+			if err != nil {
+				return err
+			}
+			target = 0
+			if *steps < len(versions) {
+				target = versions[len(versions)-1-*steps]
+			}
+		}
+		reverted, err := migrateDown(target)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d %s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		applied, err := listAppliedMigrations()
+		if err != nil {
+			return err
+		}
+		pending, err := pendingMigrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range applied {
+			fmt.Printf("%04d %s applied at %s\n", m.Version, m.Name, time.Unix(m.AppliedAt, 0).UTC().Format(time.RFC3339))
+		}
+		for _, m := range pending {
+			fmt.Printf("%04d %s pending\n", m.Version, m.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
+
+// loadMigrations returns the embedded migrations of the store dialect ordered
+// by version.
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/"+store.Dialect()+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		base := path.Base(f)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s is neither .up.sql nor .down.sql", base)
+		}
+		versionName := strings.TrimSuffix(base, "."+direction+".sql")
+		v, name, ok := strings.Cut(versionName, "_")
+		version, err := strconv.Atoi(v)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a version", base)
+		}
+		b, err := migrationFiles.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %04d is named both %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d %s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// migrateUp applies the pending migrations up to target, 0 applies all of them.
+func migrateUp(target int) ([]migration, error) {
+	pending, err := pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var applied []migration
+	for _, m := range pending {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if err := applyMigration(m, m.Up, true); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// migrateDown reverts the applied migrations newer than target, newest first.
+func migrateDown(target int) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := appliedMigrationVersions()
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]migration{}
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	var reverted []migration
+	for i := len(versions) - 1; i >= 0 && versions[i] > target; i-- {
+		m, ok := byVersion[versions[i]]
+		if !ok {
+			return reverted, fmt.Errorf("migration %04d is applied but unknown", versions[i])
+		}
+		if m.Down == "" {
+			return reverted, fmt.Errorf("migration %04d %s can not be reverted", m.Version, m.Name)
+		}
+		if err := applyMigration(m, m.Down, false); err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+func applyMigration(m migration, script string, up bool) error {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("migration %04d %s failed : %w", m.Version, m.Name, err)
+	}
+	if up {
+		_, err = tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"), m.Version, m.Name, time.Now().Unix())
+	} else {
+		_, err = tx.Exec(tx.Rebind("DELETE FROM schema_migrations WHERE version = ?"), m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func pendingMigrations() ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := appliedMigrationVersions()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	for _, v := range versions {
+		applied[v] = true
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+func appliedMigrationVersions() ([]int, error) {
+	applied, err := listAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, m := range applied {
+		versions = append(versions, m.Version)
+	}
+	return versions, nil
+}
+
+func listAppliedMigrations() ([]AppliedMigration, error) {
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	var applied []AppliedMigration
+	err := db.Select(&applied, db.Rebind("SELECT * FROM schema_migrations ORDER BY version"))
+	return applied, err
+}
+
+// ensureMigrationsTable creates the schema_migrations table. A database
+// created by initSchema before migrations existed already has the baseline
+// schema, which is recorded as applied.
+func ensureMigrationsTable() error {
+	exists, err := tableExists("schema_migrations")
+	if err != nil || exists {
+		return err
+	}
+	baseline, err := tableExists("signing_keys")
+	if err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+	CREATE TABLE schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	);
+	`); err != nil {
+		return err
+	}
+	if baseline {
+		for _, m := range migrations {
+			if m.Version > baselineVersion {
+				break
+			}
+			if _, err := tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, 0)"), m.Version, m.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func tableExists(name string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if store.Dialect() == "postgres" {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	}
+	var n int
+	err := db.Get(&n, db.Rebind(query), name)
+	return n > 0, err
+}
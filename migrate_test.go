@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestMigrateUpDown(t *testing.T) {
+	openTestStore(t)
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		applied, err := migrateUp(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != len(migrations) {
+			t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations))
+		}
+		if pending, err := pendingMigrations(); err != nil || len(pending) != 0 {
+			t.Fatalf("%d pending migrations after up : %v", len(pending), err)
+		}
+
+		reverted, err := migrateDown(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reverted) != len(migrations) {
+			t.Fatalf("reverted %d migrations, want %d", len(reverted), len(migrations))
+		}
+		var tables []string
+		for _, table := range []string{"organization", "plans", "stripe_events", "invoices", "plan_features", "signing_keys", "subscriptions", "subscription_items", "plan_addons", "organization_members", "usage_events", "usage_reports", "subscription_changes", "plan_prices"} {
+			exists, err := tableExists(table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists {
+				tables = append(tables, table)
+			}
+		}
+		if len(tables) != 0 {
+			t.Fatalf("tables %v left after reverting every migration", tables)
+		}
+	}
+}
+
+// TestMigrateBaseline checks that a database created by initSchema, before
+// migrations existed, only gets the migrations that came after it.
+func TestMigrateBaseline(t *testing.T) {
+	if os.Getenv("TEST_DATABASE_URL") != "" {
+		t.Skip("only SQLite databases were created by initSchema")
+	}
+	openTestStore(t)
+
+	// The baseline schema without its schema_migrations table.
+	if _, err := migrateUp(baselineVersion); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DROP TABLE schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range applied {
+		if m.Version <= baselineVersion {
+			t.Fatalf("baseline migration %04d %s applied again", m.Version, m.Name)
+		}
+	}
+}
+
+// TestMigrateSubscriptions checks that the plans column of the organizations is
+// moved to the subscription tables and back.
+func TestMigrateSubscriptions(t *testing.T) {
+	openTestStore(t)
+
+	if _, err := migrateUp(8); err != nil {
+		t.Fatal(err)
+	}
+	plans := []Plan{{
+		ID:       "price_a",
+		Key:      "planA",
+		SiID:     "si_a",
+		SubID:    "sub_a",
+		Active:   true,
+		Quantity: 3,
+		Amount:   1000,
+		Product:  Product{ID: "prod_a", Active: true, Name: "Plan A"},
+	}}
+	b, err := json.Marshal(plans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(db.Rebind("UPDATE plans SET price_id = 'price_a' WHERE key = 'planA'")); err != nil {
+		t.Fatal(err)
+	}
+	query := "INSERT INTO organization (name, email, stripe_id, stripe_sub, sub_status, plans) VALUES (?, ?, ?, ?, ?, ?)"
+	if _, err := db.Exec(db.Rebind(query), "a", "a@example.com", "cus_a", "sub_a", "active", b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(db.Rebind(query), "b", "b@example.com", "cus_b", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := store.GetSubscription("sub_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != "active" || sub.CustomerID != "cus_a" || len(sub.Items) != 1 {
+		t.Fatalf("backfilled subscription %+v", sub)
+	}
+	org, err := store.GetOrganizationByStripeID("cus_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(org.Plans) != 1 || org.Plans[0] != plans[0] {
+		t.Fatalf("plans %+v after backfill, want %+v", org.Plans, plans)
+	}
+
+	if _, err := migrateDown(8); err != nil {
+		t.Fatal(err)
+	}
+	var restored []byte
+	if err := db.Get(&restored, "SELECT plans FROM organization WHERE stripe_id = 'cus_a'"); err != nil {
+		t.Fatal(err)
+	}
+	var got []Plan
+	if err := json.Unmarshal(restored, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != plans[0] {
+		t.Fatalf("plans %+v after revert, want %+v", got, plans)
+	}
+}
+
+// TestMigrateSubscriptionEventMarkers checks that the event_at markers move to
+// their own table and that the empty subscriptions holding them are removed.
+func TestMigrateSubscriptionEventMarkers(t *testing.T) {
+	openTestStore(t)
+
+	if _, err := migrateUp(16); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateOrganization("a", "a@example.com", "cus_a"); err != nil {
+		t.Fatal(err)
+	}
+	org, err := store.GetOrganizationByStripeID("cus_a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "INSERT INTO subscriptions (id, org_id, customer_id, status, event_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err := db.Exec(db.Rebind(query), "sub_a", org.ID, "cus_a", "active", 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(db.Rebind("INSERT INTO subscriptions (id, org_id, event_at) VALUES (?, ?, ?)"), "sub_early", org.ID, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := store.ListSubscriptions(org.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].ID != "sub_a" {
+		t.Fatalf("got subscriptions %+v, want sub_a only", subs)
+	}
+	for id, want := range map[string]int64{"sub_a": 100, "sub_early": 200} {
+		if got, err := store.GetSubEventAt(id); err != nil || got != want {
+			t.Fatalf("got event_at %d of %s (%v), want %d", got, id, err, want)
+		}
+	}
+
+	// The marker of a subscription that is not stored yet adds none.
+	if ok, err := store.AdvanceSubEventAt(org.ID, "sub_new", 300); err != nil || !ok {
+		t.Fatalf("got %v (%v) advancing the marker of sub_new", ok, err)
+	}
+	if ok, err := store.AdvanceSubEventAt(org.ID, "sub_new", 250); err != nil || ok {
+		t.Fatalf("got %v (%v) moving the marker of sub_new back", ok, err)
+	}
+	if subs, err := store.ListSubscriptions(org.ID); err != nil || len(subs) != 1 {
+		t.Fatalf("got subscriptions %+v (%v), want sub_a only", subs, err)
+	}
+
+	// The marker only moves together with the subscription written by the
+	// event.
+	sub := Subscription{ID: "sub_a", CustomerID: "cus_a", Status: "past_due", Items: []SubscriptionItem{{ID: "si_a"}, {ID: "si_a"}}}
+	if _, err := store.ApplySubEvent(org.ID, "update", sub, 300, false); err == nil {
+		t.Fatal("got no error storing the same item twice")
+	}
+	if got, err := store.GetSubEventAt("sub_a"); err != nil || got != 100 {
+		t.Fatalf("got event_at %d (%v) of sub_a after a failed write, want 100", got, err)
+	}
+	sub.Items = sub.Items[:1]
+	if ok, err := store.ApplySubEvent(org.ID, "update", sub, 50, false); err != nil || ok {
+		t.Fatalf("got %v (%v) applying an older event", ok, err)
+	}
+	if got, err := store.GetSubscription("sub_a"); err != nil || got.Status != "active" {
+		t.Fatalf("got subscription %+v (%v) after an older event, want it active", got, err)
+	}
+	if ok, err := store.ApplySubEvent(org.ID, "update", sub, 300, false); err != nil || !ok {
+		t.Fatalf("got %v (%v) applying the event after the failed write", ok, err)
+	}
+	if got, err := store.GetSubscription("sub_a"); err != nil || got.Status != "past_due" {
+		t.Fatalf("got subscription %+v (%v), want it past_due", got, err)
+	}
+
+	if _, err := migrateDown(16); err != nil {
+		t.Fatal(err)
+	}
+	var at int64
+	if err := db.Get(&at, db.Rebind("SELECT event_at FROM subscriptions WHERE id = ?"), "sub_a"); err != nil || at != 300 {
+		t.Fatalf("got event_at %d (%v) of sub_a after revert, want 300", at, err)
+	}
+}
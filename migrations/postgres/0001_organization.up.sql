@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS organization (
+	id         SERIAL PRIMARY KEY,
+	name       TEXT NOT NULL UNIQUE,
+	email      TEXT NOT NULL UNIQUE,
+	stripe_id  TEXT NOT NULL,
+	stripe_sub TEXT DEFAULT '',
+	sub_status TEXT DEFAULT '',
+	plans      BYTEA
+);
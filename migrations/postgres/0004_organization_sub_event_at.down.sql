@@ -0,0 +1 @@
+ALTER TABLE organization DROP COLUMN sub_event_at;
@@ -0,0 +1,2 @@
+-- Creation time of the last subscription event applied to the organization.
+ALTER TABLE organization ADD COLUMN sub_event_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,22 @@
+CREATE TABLE invoices (
+	id                 TEXT NOT NULL PRIMARY KEY,
+	org_id             BIGINT NOT NULL,
+	customer_id        TEXT NOT NULL,
+	subscription_id    TEXT NOT NULL DEFAULT '',
+	number             TEXT NOT NULL DEFAULT '',
+	status             TEXT NOT NULL DEFAULT '',
+	currency           TEXT NOT NULL DEFAULT '',
+	amount_due         BIGINT NOT NULL DEFAULT 0,
+	amount_paid        BIGINT NOT NULL DEFAULT 0,
+	amount_remaining   BIGINT NOT NULL DEFAULT 0,
+	hosted_invoice_url TEXT NOT NULL DEFAULT '',
+	invoice_pdf        TEXT NOT NULL DEFAULT '',
+	period_start       BIGINT NOT NULL DEFAULT 0,
+	period_end         BIGINT NOT NULL DEFAULT 0,
+	attempt_count      BIGINT NOT NULL DEFAULT 0,
+	next_attempt_at    BIGINT NOT NULL DEFAULT 0,
+	created            BIGINT NOT NULL DEFAULT 0,
+	event_at           BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX invoices_org_id_created ON invoices (org_id, created);
@@ -0,0 +1,6 @@
+CREATE TABLE plan_features (
+	plan_key    TEXT NOT NULL,
+	feature     TEXT NOT NULL,
+	limit_value BIGINT,
+	PRIMARY KEY (plan_key, feature)
+);
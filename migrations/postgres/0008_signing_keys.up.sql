@@ -0,0 +1,6 @@
+CREATE TABLE signing_keys (
+	kid        TEXT NOT NULL PRIMARY KEY,
+	seed       BYTEA NOT NULL,
+	created_at BIGINT NOT NULL,
+	retired_at BIGINT NOT NULL DEFAULT 0
+);
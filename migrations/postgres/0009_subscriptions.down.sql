@@ -0,0 +1,27 @@
+ALTER TABLE organization ADD COLUMN plans BYTEA;
+
+UPDATE organization
+SET plans = convert_to((
+	SELECT COALESCE(jsonb_agg(jsonb_build_object(
+		'id', si.price_id,
+		'key', COALESCE(p.key, ''),
+		'si_id', si.id,
+		'sub_id', si.subscription_id,
+		'active', si.price_active,
+		'quantity', si.quantity,
+		'Amount', si.unit_amount,
+		'product', jsonb_build_object(
+			'id', si.product_id,
+			'active', si.product_active,
+			'name', si.product_name,
+			'description', si.product_description
+		)
+	)), '[]'::jsonb)::text
+	FROM subscription_items si
+	LEFT JOIN plans p ON p.price_id = si.price_id
+	WHERE si.subscription_id = organization.stripe_sub
+), 'UTF8')
+WHERE COALESCE(stripe_sub, '') != '';
+
+DROP TABLE subscription_items;
+DROP TABLE subscriptions;
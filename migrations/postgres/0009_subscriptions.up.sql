@@ -0,0 +1,67 @@
+CREATE TABLE subscriptions (
+	id                   TEXT NOT NULL PRIMARY KEY,
+	org_id               BIGINT NOT NULL,
+	customer_id          TEXT NOT NULL DEFAULT '',
+	status               TEXT NOT NULL DEFAULT '',
+	currency             TEXT NOT NULL DEFAULT '',
+	current_period_start BIGINT NOT NULL DEFAULT 0,
+	current_period_end   BIGINT NOT NULL DEFAULT 0,
+	cancel_at            BIGINT NOT NULL DEFAULT 0,
+	cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+	canceled_at          BIGINT NOT NULL DEFAULT 0,
+	trial_end            BIGINT NOT NULL DEFAULT 0,
+	created              BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX subscriptions_org_id ON subscriptions (org_id);
+
+CREATE TABLE subscription_items (
+	id                  TEXT NOT NULL PRIMARY KEY,
+	subscription_id     TEXT NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+	price_id            TEXT NOT NULL,
+	price_active        BOOLEAN NOT NULL DEFAULT TRUE,
+	product_id          TEXT NOT NULL DEFAULT '',
+	product_name        TEXT NOT NULL DEFAULT '',
+	product_description TEXT NOT NULL DEFAULT '',
+	product_active      BOOLEAN NOT NULL DEFAULT TRUE,
+	quantity            BIGINT NOT NULL DEFAULT 1,
+	unit_amount         BIGINT NOT NULL DEFAULT 0,
+	currency            TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX subscription_items_subscription_id ON subscription_items (subscription_id);
+CREATE INDEX subscription_items_price_id ON subscription_items (price_id);
+
+-- The plans column only has the items of the current subscription, the
+-- periods are filled in by the next event or refresh of the subscription.
+INSERT INTO subscriptions (id, org_id, customer_id, status)
+SELECT stripe_sub, id, stripe_id, COALESCE(sub_status, '')
+FROM organization
+WHERE COALESCE(stripe_sub, '') != '';
+
+INSERT INTO subscription_items (
+	id, subscription_id, price_id, price_active,
+	product_id, product_name, product_description, product_active,
+	quantity, unit_amount, currency
+)
+SELECT
+	p->>'si_id',
+	o.stripe_sub,
+	COALESCE(p->>'id', ''),
+	COALESCE((p->>'active')::boolean, TRUE),
+	COALESCE(p->'product'->>'id', ''),
+	COALESCE(p->'product'->>'name', ''),
+	COALESCE(p->'product'->>'description', ''),
+	COALESCE((p->'product'->>'active')::boolean, TRUE),
+	COALESCE((p->>'quantity')::bigint, 1),
+	COALESCE((p->>'Amount')::bigint, 0),
+	COALESCE((SELECT currency FROM plans WHERE plans.price_id = p->>'id'), '')
+FROM organization o,
+	jsonb_array_elements(CASE
+		WHEN jsonb_typeof(convert_from(o.plans, 'UTF8')::jsonb) = 'array' THEN convert_from(o.plans, 'UTF8')::jsonb
+		ELSE '[]'::jsonb
+	END) p
+WHERE COALESCE(o.stripe_sub, '') != '' AND o.plans IS NOT NULL AND COALESCE(p->>'si_id', '') != ''
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE organization DROP COLUMN plans;
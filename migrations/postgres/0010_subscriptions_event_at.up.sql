@@ -0,0 +1,9 @@
+-- Creation time of the last event applied to the subscription. Organizations
+-- have several subscriptions, the events of each one are ordered separately.
+ALTER TABLE subscriptions ADD COLUMN event_at BIGINT NOT NULL DEFAULT 0;
+
+UPDATE subscriptions
+SET event_at = (SELECT sub_event_at FROM organization WHERE organization.id = subscriptions.org_id)
+WHERE id IN (SELECT stripe_sub FROM organization);
+
+ALTER TABLE organization DROP COLUMN sub_event_at;
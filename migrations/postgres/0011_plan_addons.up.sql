@@ -0,0 +1,11 @@
+-- A base plan is subscribed to, an add-on is attached to a subscription of a
+-- base plan that allows it.
+ALTER TABLE plans ADD COLUMN kind TEXT NOT NULL DEFAULT 'base';
+
+CREATE TABLE plan_addons (
+	plan_key     TEXT NOT NULL,
+	addon_key    TEXT NOT NULL,
+	-- 0 is no maximum.
+	max_quantity BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (plan_key, addon_key)
+);
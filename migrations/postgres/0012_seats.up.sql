@@ -0,0 +1,16 @@
+-- Seats are the quantity of the base plan item, bounded per plan. 0 is no
+-- maximum.
+ALTER TABLE plans ADD COLUMN min_seats BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE plans ADD COLUMN max_seats BIGINT NOT NULL DEFAULT 0;
+
+-- seat_sync keeps the seats equal to the number of members.
+ALTER TABLE organization ADD COLUMN seat_sync BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE organization_members (
+	id      SERIAL PRIMARY KEY,
+	org_id  BIGINT NOT NULL,
+	email   TEXT NOT NULL,
+	name    TEXT NOT NULL DEFAULT '',
+	created BIGINT NOT NULL DEFAULT 0,
+	UNIQUE (org_id, email)
+);
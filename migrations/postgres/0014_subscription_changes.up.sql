@@ -0,0 +1,11 @@
+-- A plan change scheduled at the end of the current period of a
+-- subscription, applied by the subscription schedule of Stripe.
+CREATE TABLE subscription_changes (
+	subscription_id TEXT NOT NULL PRIMARY KEY REFERENCES subscriptions (id) ON DELETE CASCADE,
+	schedule_id     TEXT NOT NULL,
+	plan_key        TEXT NOT NULL,
+	quantity        BIGINT NOT NULL DEFAULT 1,
+	effective_at    BIGINT NOT NULL,
+	created         BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX subscription_changes_schedule_id ON subscription_changes (schedule_id);
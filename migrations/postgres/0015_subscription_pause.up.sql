@@ -0,0 +1,6 @@
+-- The pause_collection of a subscription, paused_by and paused_at record who
+-- paused it from the API and when.
+ALTER TABLE subscriptions ADD COLUMN pause_behavior TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN pause_resumes_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions ADD COLUMN paused_by TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN paused_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions DROP COLUMN trial_will_end_at;
+ALTER TABLE subscriptions DROP COLUMN trial_end_behavior;
+ALTER TABLE plans DROP COLUMN trial_days;
@@ -0,0 +1,16 @@
+-- The ordering markers of the subscription events move to their own table.
+-- An event could arrive before the subscription was stored, its marker was
+-- then kept on an empty subscription row.
+CREATE TABLE subscription_event_markers (
+	subscription_id TEXT NOT NULL PRIMARY KEY,
+	org_id          BIGINT NOT NULL,
+	event_at        BIGINT NOT NULL DEFAULT 0
+);
+
+INSERT INTO subscription_event_markers (subscription_id, org_id, event_at)
+SELECT id, org_id, event_at FROM subscriptions WHERE event_at != 0;
+
+DELETE FROM subscription_items WHERE subscription_id IN (SELECT id FROM subscriptions WHERE customer_id = '');
+DELETE FROM subscriptions WHERE customer_id = '';
+
+ALTER TABLE subscriptions DROP COLUMN event_at;
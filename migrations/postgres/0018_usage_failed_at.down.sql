@@ -0,0 +1 @@
+ALTER TABLE usage_reports DROP COLUMN failed_at;
@@ -0,0 +1,3 @@
+-- failed_at is when a usage report was given up after too many attempts, 0
+-- while it is still sent.
+ALTER TABLE usage_reports ADD COLUMN failed_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+-- plan_prices maps every price a plan has been sold at to the plan, so that
+-- the subscribers of a price another one replaced keep their plan.
+CREATE TABLE plan_prices (
+	price_id TEXT NOT NULL PRIMARY KEY,
+	plan_key TEXT NOT NULL REFERENCES plans (key) ON DELETE CASCADE,
+	created  BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX plan_prices_plan_key ON plan_prices (plan_key);
+
+INSERT INTO plan_prices (price_id, plan_key) SELECT price_id, key FROM plans;
@@ -0,0 +1,11 @@
+-- The table used to only exist in the committed local.db.
+CREATE TABLE IF NOT EXISTS "organization" (
+	"name"	TEXT NOT NULL UNIQUE,
+	"email"	TEXT NOT NULL UNIQUE,
+	"stripe_id"	TEXT NOT NULL,
+	"stripe_sub"	TEXT DEFAULT '',
+	"id"	INTEGER NOT NULL,
+	"sub_status"	TEXT DEFAULT '',
+	"plans"	BLOB,
+	PRIMARY KEY("id" AUTOINCREMENT)
+);
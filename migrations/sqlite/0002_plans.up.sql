@@ -0,0 +1,23 @@
+CREATE TABLE plans (
+	key         TEXT NOT NULL PRIMARY KEY,
+	price_id    TEXT NOT NULL UNIQUE,
+	name        TEXT NOT NULL DEFAULT '',
+	interval    TEXT NOT NULL DEFAULT '',
+	currency    TEXT NOT NULL DEFAULT '',
+	sort_order  INTEGER NOT NULL DEFAULT 0,
+	visible     INTEGER NOT NULL DEFAULT 1,
+	retired     INTEGER NOT NULL DEFAULT 0,
+	-- Details imported from Stripe by the catalog sync.
+	product_id  TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	unit_amount INTEGER NOT NULL DEFAULT 0,
+	metadata    TEXT NOT NULL DEFAULT '{}',
+	active      INTEGER NOT NULL DEFAULT 1,
+	synced_at   INTEGER NOT NULL DEFAULT 0
+);
+
+-- Seed the catalog with the plans that used to be hardcoded in subPlans.
+INSERT INTO plans (key, price_id, name, interval, currency, sort_order)
+VALUES
+	('planA', 'price_1NEDyqSAVJByQTEdNkeEdf7P', 'Plan A', 'month', 'usd', 1),
+	('planB', 'price_1NEDyNSAVJByQTEdrH97Z3B6', 'Plan B - Standard', 'month', 'usd', 2);
@@ -0,0 +1 @@
+DROP TABLE stripe_events;
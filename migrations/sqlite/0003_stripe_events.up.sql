@@ -0,0 +1,16 @@
+CREATE TABLE stripe_events (
+	id           TEXT NOT NULL PRIMARY KEY,
+	type         TEXT NOT NULL,
+	payload      BLOB NOT NULL,
+	customer_id  TEXT NOT NULL DEFAULT '',
+	created      INTEGER NOT NULL DEFAULT 0,
+	received_at  INTEGER NOT NULL,
+	status       TEXT NOT NULL,
+	error        TEXT NOT NULL DEFAULT '',
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	claimed_at   INTEGER NOT NULL DEFAULT 0,
+	processed_at INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX stripe_events_type_created ON stripe_events (type, created);
+CREATE INDEX stripe_events_customer_id ON stripe_events (customer_id);
@@ -0,0 +1,2 @@
+ALTER TABLE organization DROP COLUMN dunning_deadline;
+ALTER TABLE organization DROP COLUMN dunning_stage;
@@ -0,0 +1,2 @@
+ALTER TABLE organization ADD COLUMN dunning_stage TEXT NOT NULL DEFAULT '';
+ALTER TABLE organization ADD COLUMN dunning_deadline INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+CREATE TABLE signing_keys (
+	kid        TEXT NOT NULL PRIMARY KEY,
+	seed       BLOB NOT NULL,
+	created_at INTEGER NOT NULL,
+	retired_at INTEGER NOT NULL DEFAULT 0
+);
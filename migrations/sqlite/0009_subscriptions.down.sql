@@ -0,0 +1,27 @@
+ALTER TABLE organization ADD COLUMN plans BLOB;
+
+UPDATE organization
+SET plans = (
+	SELECT json_group_array(json_object(
+		'id', si.price_id,
+		'key', COALESCE(p.key, ''),
+		'si_id', si.id,
+		'sub_id', si.subscription_id,
+		'active', json(CASE WHEN si.price_active THEN 'true' ELSE 'false' END),
+		'quantity', si.quantity,
+		'Amount', si.unit_amount,
+		'product', json_object(
+			'id', si.product_id,
+			'active', json(CASE WHEN si.product_active THEN 'true' ELSE 'false' END),
+			'name', si.product_name,
+			'description', si.product_description
+		)
+	))
+	FROM subscription_items si
+	LEFT JOIN plans p ON p.price_id = si.price_id
+	WHERE si.subscription_id = organization.stripe_sub
+)
+WHERE COALESCE(stripe_sub, '') != '';
+
+DROP TABLE subscription_items;
+DROP TABLE subscriptions;
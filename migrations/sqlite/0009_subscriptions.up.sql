@@ -0,0 +1,64 @@
+CREATE TABLE subscriptions (
+	id                   TEXT NOT NULL PRIMARY KEY,
+	org_id               INTEGER NOT NULL,
+	customer_id          TEXT NOT NULL DEFAULT '',
+	status               TEXT NOT NULL DEFAULT '',
+	currency             TEXT NOT NULL DEFAULT '',
+	current_period_start INTEGER NOT NULL DEFAULT 0,
+	current_period_end   INTEGER NOT NULL DEFAULT 0,
+	cancel_at            INTEGER NOT NULL DEFAULT 0,
+	cancel_at_period_end INTEGER NOT NULL DEFAULT 0,
+	canceled_at          INTEGER NOT NULL DEFAULT 0,
+	trial_end            INTEGER NOT NULL DEFAULT 0,
+	created              INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX subscriptions_org_id ON subscriptions (org_id);
+
+CREATE TABLE subscription_items (
+	id                  TEXT NOT NULL PRIMARY KEY,
+	subscription_id     TEXT NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+	price_id            TEXT NOT NULL,
+	price_active        INTEGER NOT NULL DEFAULT 1,
+	product_id          TEXT NOT NULL DEFAULT '',
+	product_name        TEXT NOT NULL DEFAULT '',
+	product_description TEXT NOT NULL DEFAULT '',
+	product_active      INTEGER NOT NULL DEFAULT 1,
+	quantity            INTEGER NOT NULL DEFAULT 1,
+	unit_amount         INTEGER NOT NULL DEFAULT 0,
+	currency            TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX subscription_items_subscription_id ON subscription_items (subscription_id);
+CREATE INDEX subscription_items_price_id ON subscription_items (price_id);
+
+-- The plans column only has the items of the current subscription, the
+-- periods are filled in by the next event or refresh of the subscription.
+INSERT INTO subscriptions (id, org_id, customer_id, status)
+SELECT stripe_sub, id, stripe_id, COALESCE(sub_status, '')
+FROM organization
+WHERE COALESCE(stripe_sub, '') != '';
+
+INSERT INTO subscription_items (
+	id, subscription_id, price_id, price_active,
+	product_id, product_name, product_description, product_active,
+	quantity, unit_amount, currency
+)
+SELECT
+	json_extract(p.value, '$.si_id'),
+	o.stripe_sub,
+	COALESCE(json_extract(p.value, '$.id'), ''),
+	COALESCE(json_extract(p.value, '$.active'), 1),
+	COALESCE(json_extract(p.value, '$.product.id'), ''),
+	COALESCE(json_extract(p.value, '$.product.name'), ''),
+	COALESCE(json_extract(p.value, '$.product.description'), ''),
+	COALESCE(json_extract(p.value, '$.product.active'), 1),
+	COALESCE(json_extract(p.value, '$.quantity'), 1),
+	COALESCE(json_extract(p.value, '$.Amount'), 0),
+	COALESCE((SELECT currency FROM plans WHERE plans.price_id = json_extract(p.value, '$.id')), '')
+FROM organization o,
+	json_each(COALESCE(CASE WHEN json_valid(CAST(o.plans AS TEXT)) THEN CASE WHEN json_type(CAST(o.plans AS TEXT)) = 'array' THEN CAST(o.plans AS TEXT) END END, '[]')) p
+WHERE COALESCE(o.stripe_sub, '') != '' AND COALESCE(json_extract(p.value, '$.si_id'), '') != ''
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE organization DROP COLUMN plans;
@@ -0,0 +1,6 @@
+ALTER TABLE organization ADD COLUMN sub_event_at INTEGER NOT NULL DEFAULT 0;
+
+UPDATE organization
+SET sub_event_at = COALESCE((SELECT MAX(event_at) FROM subscriptions WHERE subscriptions.org_id = organization.id), 0);
+
+ALTER TABLE subscriptions DROP COLUMN event_at;
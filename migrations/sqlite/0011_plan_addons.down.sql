@@ -0,0 +1,2 @@
+DROP TABLE plan_addons;
+ALTER TABLE plans DROP COLUMN kind;
@@ -0,0 +1,4 @@
+DROP TABLE organization_members;
+ALTER TABLE organization DROP COLUMN seat_sync;
+ALTER TABLE plans DROP COLUMN max_seats;
+ALTER TABLE plans DROP COLUMN min_seats;
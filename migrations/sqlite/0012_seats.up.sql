@@ -0,0 +1,16 @@
+-- Seats are the quantity of the base plan item, bounded per plan. 0 is no
+-- maximum.
+ALTER TABLE plans ADD COLUMN min_seats INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE plans ADD COLUMN max_seats INTEGER NOT NULL DEFAULT 0;
+
+-- seat_sync keeps the seats equal to the number of members.
+ALTER TABLE organization ADD COLUMN seat_sync INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE organization_members (
+	id      INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	org_id  INTEGER NOT NULL,
+	email   TEXT NOT NULL,
+	name    TEXT NOT NULL DEFAULT '',
+	created INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (org_id, email)
+);
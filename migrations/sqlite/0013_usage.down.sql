@@ -0,0 +1,3 @@
+DROP TABLE usage_reports;
+DROP TABLE usage_events;
+ALTER TABLE plans DROP COLUMN metric;
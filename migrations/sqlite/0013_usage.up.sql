@@ -0,0 +1,34 @@
+-- A metered plan bills the usage of its metric, e.g. api_calls.
+ALTER TABLE plans ADD COLUMN metric TEXT NOT NULL DEFAULT '';
+
+-- Usage events are aggregated into a usage report, report_id is '' until then.
+CREATE TABLE usage_events (
+	id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	org_id          INTEGER NOT NULL,
+	metric          TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	quantity        INTEGER NOT NULL,
+	occurred_at     INTEGER NOT NULL,
+	report_id       TEXT NOT NULL DEFAULT '',
+	created         INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (org_id, idempotency_key)
+);
+CREATE INDEX usage_events_report_id ON usage_events (report_id, org_id, metric);
+CREATE INDEX usage_events_org_id ON usage_events (org_id, metric, occurred_at);
+
+-- A usage report is sent to Stripe as a usage record until it succeeds,
+-- reported_at is 0 until then.
+CREATE TABLE usage_reports (
+	id                   TEXT NOT NULL PRIMARY KEY,
+	org_id               INTEGER NOT NULL,
+	metric               TEXT NOT NULL,
+	subscription_item_id TEXT NOT NULL,
+	quantity             INTEGER NOT NULL DEFAULT 0,
+	usage_at             INTEGER NOT NULL,
+	attempts             INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at      INTEGER NOT NULL DEFAULT 0,
+	last_error           TEXT NOT NULL DEFAULT '',
+	reported_at          INTEGER NOT NULL DEFAULT 0,
+	created              INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX usage_reports_reported_at ON usage_reports (reported_at, next_attempt_at);
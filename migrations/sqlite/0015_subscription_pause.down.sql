@@ -0,0 +1,4 @@
+ALTER TABLE subscriptions DROP COLUMN paused_at;
+ALTER TABLE subscriptions DROP COLUMN paused_by;
+ALTER TABLE subscriptions DROP COLUMN pause_resumes_at;
+ALTER TABLE subscriptions DROP COLUMN pause_behavior;
@@ -0,0 +1,7 @@
+-- trial_days is the free trial of new subscriptions to a plan, 0 is none.
+ALTER TABLE plans ADD COLUMN trial_days INTEGER NOT NULL DEFAULT 0;
+
+-- trial_end_behavior is what ends a trial without a payment method, cancel or
+-- pause. trial_will_end_at is when Stripe announced the end of the trial.
+ALTER TABLE subscriptions ADD COLUMN trial_end_behavior TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriptions ADD COLUMN trial_will_end_at INTEGER NOT NULL DEFAULT 0;
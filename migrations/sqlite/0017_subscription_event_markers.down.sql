@@ -0,0 +1,6 @@
+ALTER TABLE subscriptions ADD COLUMN event_at INTEGER NOT NULL DEFAULT 0;
+
+UPDATE subscriptions
+SET event_at = COALESCE((SELECT event_at FROM subscription_event_markers WHERE subscription_id = subscriptions.id), 0);
+
+DROP TABLE subscription_event_markers;
@@ -0,0 +1 @@
+DROP TABLE plan_prices;
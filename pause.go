@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// SubscriptionPause is the paused collection of a subscription. Its renewal
+// invoices are voided, kept as drafts or marked uncollectible until it
+// resumes, at ResumesAt when it is set.
+type SubscriptionPause struct {
+	SubscriptionID string `json:"subscription_id" db:"id"`
+	Behavior       string `json:"behavior"        db:"pause_behavior"`
+	ResumesAt      int64  `json:"resumes_at"      db:"pause_resumes_at"`
+	PausedBy       string `json:"paused_by"       db:"paused_by"`
+	PausedAt       int64  `json:"paused_at"       db:"paused_at"`
+}
+
+func checkPauseBehavior(v string) error {
+	switch stripe.SubscriptionPauseCollectionBehavior(v) {
+	case stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible,
+		stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft,
+		stripe.SubscriptionPauseCollectionBehaviorVoid:
+		return nil
+	}
+	return fmt.Errorf("invalid behavior %q, use mark_uncollectible, keep_as_draft or void", v)
+}
+
+// pauseOrgSubscription pauses the collection of the subscription. The
+// behavior defaults to void, the subscription resumes by itself at resumes_at
+// when it is set. paused_by records who paused it.
+func pauseOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Behavior  string `json:"behavior"`
+		ResumesAt int64  `json:"resumes_at"`
+		PausedBy  string `json:"paused_by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Behavior == "" {
+		req.Behavior = string(stripe.SubscriptionPauseCollectionBehaviorVoid)
+	}
+	req.PausedBy = strings.TrimSpace(req.PausedBy)
+	now := time.Now().Unix()
+	switch {
+	case checkPauseBehavior(req.Behavior) != nil:
+		http.Error(w, checkPauseBehavior(req.Behavior).Error(), http.StatusUnprocessableEntity)
+		return
+	case req.PausedBy == "":
+		http.Error(w, "paused_by is required", http.StatusUnprocessableEntity)
+		return
+	case req.ResumesAt != 0 && req.ResumesAt <= now:
+		http.Error(w, "resumes_at must be in the future", http.StatusUnprocessableEntity)
+		return
+	case isFinalSubStatus(sub.Status):
+		http.Error(w, "subscription "+sub.ID+" already ended", http.StatusUnprocessableEntity)
+		return
+	case sub.PauseBehavior != "" || sub.Status == string(stripe.SubscriptionStatusPaused):
+		http.Error(w, "subscription "+sub.ID+" is already paused", http.StatusUnprocessableEntity)
+		return
+	}
+
+	pause := &stripe.SubscriptionPauseCollectionParams{Behavior: stripe.String(req.Behavior)}
+	if req.ResumesAt != 0 {
+		pause.ResumesAt = stripe.Int64(req.ResumesAt)
+	}
+	s, err := stripeAPI.UpdateSubscription(sub.ID, &stripe.SubscriptionParams{PauseCollection: pause})
+	if err != nil {
+		http.Error(w, "Failed to pause subscription "+err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("sub.Update: %v", err)
+		return
+	}
+	paused := newSubscription(*s)
+	paused.PausedBy = req.PausedBy
+	paused.PausedAt = now
+	if err := store.UpdateSub(paused); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	writeStoredSubscription(w, organization, sub.ID)
+}
+
+// resumeOrgSubscription resumes the collection of a paused subscription, its
+// next renewal is billed again. A subscription Stripe paused at the end of
+// its trial starts a new period, invoiced right away.
+func resumeOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	var s *stripe.Subscription
+	var err error
+	switch {
+	case sub.Status == string(stripe.SubscriptionStatusPaused):
+		params := &stripe.SubscriptionResumeParams{
+			BillingCycleAnchor: stripe.String("now"),
+		}
+		s, err = stripeAPI.ResumeSubscription(sub.ID, params)
+	case sub.PauseBehavior != "":
+		// An empty pause_collection unsets it.
+		params := &stripe.SubscriptionParams{}
+		params.AddExtra("pause_collection", "")
+		s, err = stripeAPI.UpdateSubscription(sub.ID, params)
+	default:
+		http.Error(w, "subscription "+sub.ID+" is not paused", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to resume subscription "+err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("resume subscription %s: %v", sub.ID, err)
+		return
+	}
+	if err := updateSub(*s); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	writeStoredSubscription(w, organization, sub.ID)
+}
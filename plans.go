@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// CatalogPlan is an entry of the plans table, it maps the plan key used by
+// the API (e.g. "planA") to a Stripe price.
+// Retired plans are hidden from GET /plans and can not be subscribed anymore,
+// but they are still resolved by price ID for existing subscribers.
+// Inactive plans are handled like retired ones, the difference being that
+// Active follows the price state in Stripe while Retired is set by an admin.
+// Kind tells base plans, which are subscribed to, from add-ons, which are
+// attached to the subscription of a base plan, and from metered plans, which
+// bill the usage of their Metric along with the base plans they are allowed
+// with.
+type CatalogPlan struct {
+	Key         string `json:"key"         db:"key"`
+	Kind        string `json:"kind"        db:"kind"`
+	PriceID     string `json:"price_id"    db:"price_id"`
+	Name        string `json:"name"        db:"name"`
+	Interval    string `json:"interval"    db:"interval"`
+	Currency    string `json:"currency"    db:"currency"`
+	SortOrder   int    `json:"sort_order"  db:"sort_order"`
+	Visible     bool   `json:"visible"     db:"visible"`
+	Retired     bool   `json:"retired"     db:"retired"`
+	ProductID   string `json:"product_id"  db:"product_id"`
+	Description string `json:"description" db:"description"`
+	UnitAmount  int64  `json:"unit_amount" db:"unit_amount"`
+	Metadata    string `json:"metadata"    db:"metadata"`
+	Active      bool   `json:"active"      db:"active"`
+	SyncedAt    int64  `json:"synced_at"   db:"synced_at"`
+	// MinSeats and MaxSeats bound the quantity of the plan item, a MaxSeats
+	// of 0 is no maximum.
+	MinSeats int64  `json:"min_seats" db:"min_seats"`
+	MaxSeats int64  `json:"max_seats" db:"max_seats"`
+	Metric   string `json:"metric"    db:"metric"`
+	// TrialDays is the free trial of new subscriptions to the plan, 0 is no
+	// trial.
+	TrialDays int64 `json:"trial_days" db:"trial_days"`
+}
+
+// Price renders the catalog plan the way GET /plans used to return it when
+// it was fetched from Stripe on every request.
+func (cp CatalogPlan) Price() *stripe.Price {
+	var metadata map[string]string
+	_ = json.Unmarshal([]byte(cp.Metadata), &metadata)
+	usageType := stripe.PriceRecurringUsageTypeLicensed
+	if cp.Kind == catalogKindMetered {
+		usageType = stripe.PriceRecurringUsageTypeMetered
+	}
+	return &stripe.Price{
+		ID:         cp.PriceID,
+		Active:     cp.Active,
+		Nickname:   cp.Key,
+		Currency:   stripe.Currency(cp.Currency),
+		UnitAmount: cp.UnitAmount,
+		Metadata:   metadata,
+		Recurring: &stripe.PriceRecurring{
+			Interval:        stripe.PriceRecurringInterval(cp.Interval),
+			IntervalCount:   1,
+			UsageType:       usageType,
+			TrialPeriodDays: cp.TrialDays,
+		},
+		Product: &stripe.Product{
+			ID:          cp.ProductID,
+			Active:      cp.Active,
+			Name:        cp.Name,
+			Description: cp.Description,
+		},
+	}
+}
+
+const (
+	catalogKindBase    = "base"
+	catalogKindAddOn   = "addon"
+	catalogKindMetered = "metered"
+)
+
+func validCatalogKind(kind string) bool {
+	return kind == catalogKindBase || kind == catalogKindAddOn || kind == catalogKindMetered
+}
+
+// checkCatalogMetric checks that metered plans, and only them, have a metric.
+func checkCatalogMetric(cp CatalogPlan) error {
+	switch {
+	case cp.Kind == catalogKindMetered && cp.Metric == "":
+		return fmt.Errorf("metric is required for a metered plan")
+	case cp.Kind != catalogKindMetered && cp.Metric != "":
+		return fmt.Errorf("metric is only allowed on a metered plan")
+	}
+	return nil
+}
+
+func getPlans(w http.ResponseWriter, r *http.Request) {
+	catalog, err := listCatalogPlans(false)
+	if err != nil {
+		http.Error(w, "Failed to get plans "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Add-ons are listed by GET /plans/:key/addons.
+	var plansPrice []*stripe.Price
+	for _, cp := range catalog {
+		if cp.Kind != catalogKindBase {
+			continue
+		}
+		plansPrice = append(plansPrice, cp.Price())
+	}
+
+	writeJSON(w, plansPrice)
+}
+
+func adminListPlans(w http.ResponseWriter, r *http.Request) {
+	catalog, err := listCatalogPlans(true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, catalog)
+}
+
+func adminCreatePlan(w http.ResponseWriter, r *http.Request) {
+	cp := CatalogPlan{Kind: catalogKindBase, Visible: true, Active: true, Metadata: "{}", MinSeats: 1}
+	if err := json.NewDecoder(r.Body).Decode(&cp); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	cp.Key = strings.TrimSpace(cp.Key)
+	cp.PriceID = strings.TrimSpace(cp.PriceID)
+	if cp.Key == "" || cp.PriceID == "" {
+		http.Error(w, "key and price_id are required", http.StatusUnprocessableEntity)
+		return
+	}
+	if !validCatalogKind(cp.Kind) {
+		http.Error(w, "kind must be base, addon or metered", http.StatusUnprocessableEntity)
+		return
+	}
+	cp.Metric = strings.TrimSpace(cp.Metric)
+	if err := checkCatalogMetric(cp); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkSeatBounds(cp); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkTrialDays(cp.TrialDays); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	cp.Retired = false
+
+	if _, err := getCatalogPlan(cp.Key); err != sql.ErrNoRows {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "plan already exists", http.StatusConflict)
+		return
+	}
+
+	if err := createCatalogPlan(cp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Pull name, amount and product from Stripe right away instead of
+	// waiting for the next catalog sync.
+	if err := refreshCatalogPlan(&cp); err != nil {
+		log.Printf("refreshCatalogPlan: %v", err)
+	}
+	writeJSON(w, cp)
+}
+
+func adminUpdatePlan(w http.ResponseWriter, r *http.Request) {
+	cp, err := getCatalogPlan(bone.GetValue(r, "key"))
+	if err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var req struct {
+		PriceID   *string `json:"price_id"`
+		Name      *string `json:"name"`
+		Interval  *string `json:"interval"`
+		Currency  *string `json:"currency"`
+		SortOrder *int    `json:"sort_order"`
+		Visible   *bool   `json:"visible"`
+		Kind      *string `json:"kind"`
+		MinSeats  *int64  `json:"min_seats"`
+		MaxSeats  *int64  `json:"max_seats"`
+		Metric    *string `json:"metric"`
+		TrialDays *int64  `json:"trial_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.PriceID != nil {
+		if strings.TrimSpace(*req.PriceID) == "" {
+			http.Error(w, "price_id can not be empty", http.StatusUnprocessableEntity)
+			return
+		}
+		cp.PriceID = strings.TrimSpace(*req.PriceID)
+	}
+	if req.Name != nil {
+		cp.Name = *req.Name
+	}
+	if req.Interval != nil {
+		cp.Interval = *req.Interval
+	}
+	if req.Currency != nil {
+		cp.Currency = *req.Currency
+	}
+	if req.SortOrder != nil {
+		cp.SortOrder = *req.SortOrder
+	}
+	if req.Visible != nil {
+		cp.Visible = *req.Visible
+	}
+	if req.Kind != nil {
+		if !validCatalogKind(*req.Kind) {
+			http.Error(w, "kind must be base, addon or metered", http.StatusUnprocessableEntity)
+			return
+		}
+		cp.Kind = *req.Kind
+	}
+	if req.MinSeats != nil {
+		cp.MinSeats = *req.MinSeats
+	}
+	if req.MaxSeats != nil {
+		cp.MaxSeats = *req.MaxSeats
+	}
+	if req.Metric != nil {
+		cp.Metric = strings.TrimSpace(*req.Metric)
+	}
+	if req.TrialDays != nil {
+		cp.TrialDays = *req.TrialDays
+	}
+	if err := checkCatalogMetric(cp); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkSeatBounds(cp); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkTrialDays(cp.TrialDays); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := updateCatalogPlan(cp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, cp)
+}
+
+func adminRetirePlan(w http.ResponseWriter, r *http.Request) {
+	key := bone.GetValue(r, "key")
+	if _, err := getCatalogPlan(key); err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := retireCatalogPlan(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, "")
+}
+
+// getSubscribablePlan returns the catalog base plan for key if new
+// subscriptions are allowed on it.
+func getSubscribablePlan(key string) (CatalogPlan, bool) {
+	cp, ok := getAvailablePlan(key)
+	return cp, ok && cp.Kind == catalogKindBase
+}
+
+// getAvailablePlan returns the catalog plan for key, base plan or add-on, if
+// it can still be added to a subscription.
+func getAvailablePlan(key string) (CatalogPlan, bool) {
+	cp, err := getCatalogPlan(key)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("getCatalogPlan: %v", err)
+		}
+		return cp, false
+	}
+	return cp, cp.Active && !cp.Retired
+}
+
+func listCatalogPlans(includeHidden bool) ([]CatalogPlan, error) {
+	query := "SELECT * FROM plans WHERE visible = TRUE AND retired = FALSE AND active = TRUE ORDER BY sort_order, key"
+	if includeHidden {
+		query = "SELECT * FROM plans ORDER BY sort_order, key"
+	}
+	var catalog []CatalogPlan
+	err := db.Select(&catalog, db.Rebind(query))
+	return catalog, err
+}
+
+func getCatalogPlan(key string) (CatalogPlan, error) {
+	var cp CatalogPlan
+	err := db.Get(&cp, db.Rebind("SELECT * FROM plans WHERE key = ?"), key)
+	return cp, err
+}
+
+// getCatalogPlanByPrice returns the plan sold at the price, or at some point
+// before another price replaced it.
+func getCatalogPlanByPrice(priceID string) (CatalogPlan, error) {
+	var cp CatalogPlan
+	err := db.Get(&cp, db.Rebind("SELECT p.* FROM plans p JOIN plan_prices pp ON pp.plan_key = p.key WHERE pp.price_id = ?"), priceID)
+	return cp, err
+}
+
+// savePlanPrice records that the plan is sold at the price. The price keeps
+// resolving to the plan once another one replaces it.
+func savePlanPrice(key, priceID string) error {
+	query := `
+	INSERT INTO plan_prices (price_id, plan_key, created) VALUES (?, ?, ?)
+	ON CONFLICT (price_id) DO UPDATE SET
+		plan_key = excluded.plan_key ;
+	`
+	_, err := db.ExecContext(context.Background(), db.Rebind(query), priceID, key, time.Now().Unix())
+	return err
+}
+
+func createCatalogPlan(cp CatalogPlan) error {
+	query := `
+	INSERT INTO plans (key, kind, price_id, name, interval, currency, sort_order, visible, retired, min_seats, max_seats, metric, trial_days)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	if cp.MinSeats == 0 {
+		cp.MinSeats = 1
+	}
+	if _, err := db.ExecContext(context.Background(), db.Rebind(query), cp.Key, cp.Kind, cp.PriceID, cp.Name, cp.Interval, cp.Currency, cp.SortOrder, cp.Visible, cp.Retired, cp.MinSeats, cp.MaxSeats, cp.Metric, cp.TrialDays); err != nil {
+		return err
+	}
+	return savePlanPrice(cp.Key, cp.PriceID)
+}
+
+func updateCatalogPlan(cp CatalogPlan) error {
+	query := `
+	UPDATE plans
+	SET
+		price_id = ?,
+		name = ?,
+		interval = ?,
+		currency = ?,
+		sort_order = ?,
+		visible = ?,
+		kind = ?,
+		min_seats = ?,
+		max_seats = ?,
+		metric = ?,
+		trial_days = ?
+	WHERE
+		key = ? ;
+	`
+	if _, err := db.ExecContext(context.Background(), db.Rebind(query), cp.PriceID, cp.Name, cp.Interval, cp.Currency, cp.SortOrder, cp.Visible, cp.Kind, cp.MinSeats, cp.MaxSeats, cp.Metric, cp.TrialDays, cp.Key); err != nil {
+		return err
+	}
+	return savePlanPrice(cp.Key, cp.PriceID)
+}
+
+func retireCatalogPlan(key string) error {
+	_, err := db.ExecContext(context.Background(), db.Rebind("UPDATE plans SET retired = TRUE WHERE key = ?"), key)
+	return err
+}
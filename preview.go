@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// PlanChangePreview is what a plan change would cost, from the upcoming
+// invoice of the subscription with the change applied.
+//
+// The prorations of a change are billed with the next renewal, or right away
+// with always_invoice. A reset of the billing cycle, or a change of the
+// billing interval, makes Stripe invoice the change right away too. A change
+// at the period end is only billed by the next renewal.
+type PlanChangePreview struct {
+	SubscriptionID    string        `json:"subscription_id"`
+	Plan              string        `json:"plan"`
+	Direction         string        `json:"direction"`
+	ProrationBehavior string        `json:"proration_behavior"`
+	ResetBillingCycle bool          `json:"reset_billing_cycle"`
+	AtPeriodEnd       bool          `json:"at_period_end"`
+	Currency          string        `json:"currency"`
+	ProrationDate     int64         `json:"proration_date"`
+	Lines             []PreviewLine `json:"lines"`
+	ProrationAmount   int64         `json:"proration_amount"`
+	AmountDueNow      int64         `json:"amount_due_now"`
+	NextRenewalAmount int64         `json:"next_renewal_amount"`
+	NextRenewalAt     int64         `json:"next_renewal_at"`
+}
+
+// PreviewLine is a line of the upcoming invoice, a proration line credits the
+// unused time of the current plan or charges the remaining time of the new
+// one.
+type PreviewLine struct {
+	Description string `json:"description"`
+	PriceID     string `json:"price_id"`
+	Quantity    int64  `json:"quantity"`
+	Amount      int64  `json:"amount"`
+	Proration   bool   `json:"proration"`
+	PeriodStart int64  `json:"period_start"`
+	PeriodEnd   int64  `json:"period_end"`
+}
+
+// previewSubscriptionPlan previews the change of the subscription to the plan
+// query parameter, without changing it. The proration_behavior,
+// reset_billing_cycle and at_period_end parameters are the ones of the plan
+// change.
+func previewSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	req := planChangeRequest{
+		Plan:              strings.TrimSpace(query.Get("plan")),
+		ProrationBehavior: query.Get("proration_behavior"),
+	}
+	if req.Plan == "" {
+		http.Error(w, "plan is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if v := query.Get("reset_billing_cycle"); v != "" {
+		reset, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid reset_billing_cycle "+v, http.StatusUnprocessableEntity)
+			return
+		}
+		req.ResetBillingCycle = &reset
+	}
+	if v := query.Get("at_period_end"); v != "" {
+		atPeriodEnd, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid at_period_end "+v, http.StatusUnprocessableEntity)
+			return
+		}
+		req.AtPeriodEnd = &atPeriodEnd
+	}
+
+	s, err := stripeAPI.GetSubscription(sub.ID, nil)
+	if err != nil {
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updateItem, status, err := planChangeItem(organization, s, req.Plan)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	opts, err := resolvePlanChange(s, updateItem, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	prorationDate := time.Now().Unix()
+	params := &stripe.InvoiceUpcomingParams{
+		Customer:                      stripe.String(organization.StripeID),
+		Subscription:                  stripe.String(s.ID),
+		SubscriptionItems:             []*stripe.SubscriptionItemsParams{updateItem},
+		SubscriptionProrationBehavior: stripe.String(opts.ProrationBehavior),
+		SubscriptionProrationDate:     stripe.Int64(prorationDate),
+	}
+	if opts.ResetBillingCycle {
+		params.SubscriptionBillingCycleAnchorNow = stripe.Bool(true)
+	}
+	in, err := stripeAPI.UpcomingInvoice(params)
+	if err != nil {
+		http.Error(w, "unable to preview the plan change "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	cp, _ := getSubscribablePlan(req.Plan)
+	writeJSON(w, newPlanChangePreview(s, cp, opts, in, prorationDate))
+}
+
+func newPlanChangePreview(s *stripe.Subscription, cp CatalogPlan, opts planChangeOptions, in *stripe.Invoice, prorationDate int64) PlanChangePreview {
+	p := PlanChangePreview{
+		SubscriptionID:    s.ID,
+		Plan:              cp.Key,
+		Direction:         opts.Direction,
+		ProrationBehavior: opts.ProrationBehavior,
+		ResetBillingCycle: opts.ResetBillingCycle,
+		AtPeriodEnd:       opts.AtPeriodEnd,
+		Currency:          string(in.Currency),
+		ProrationDate:     prorationDate,
+		Lines:             []PreviewLine{},
+		NextRenewalAt:     s.CurrentPeriodEnd,
+	}
+	// The whole upcoming invoice is due now when a new period starts now.
+	immediate := !opts.AtPeriodEnd && (opts.ResetBillingCycle || changesInterval(s, cp))
+	var renewal int64
+	if in.Lines != nil {
+		for _, line := range in.Lines.Data {
+			l := PreviewLine{
+				Description: line.Description,
+				Quantity:    line.Quantity,
+				Amount:      line.Amount,
+				Proration:   line.Proration,
+			}
+			if line.Price != nil {
+				l.PriceID = line.Price.ID
+			}
+			if line.Period != nil {
+				l.PeriodStart = line.Period.Start
+				l.PeriodEnd = line.Period.End
+			}
+			if l.Proration {
+				p.ProrationAmount += l.Amount
+			} else {
+				renewal += l.Amount
+				if immediate && l.PeriodEnd > p.NextRenewalAt {
+					p.NextRenewalAt = l.PeriodEnd
+				}
+			}
+			p.Lines = append(p.Lines, l)
+		}
+	}
+
+	switch {
+	case immediate:
+		p.AmountDueNow = in.AmountDue
+		p.NextRenewalAmount = renewal
+	case opts.ProrationBehavior == prorationAlwaysInvoice:
+		if p.ProrationAmount > 0 {
+			p.AmountDueNow = p.ProrationAmount
+		}
+		p.NextRenewalAmount = renewal
+	default:
+		p.NextRenewalAmount = in.AmountDue
+	}
+	return p
+}
+
+// changesInterval tells if the base plan of the subscription is billed at
+// another interval than the catalog plan.
+func changesInterval(s *stripe.Subscription, cp CatalogPlan) bool {
+	baseItem, _, ok := subscriptionBaseItem(s)
+	if !ok {
+		baseItem = s.Items.Data[0]
+	}
+	if cp.Interval == "" || baseItem.Price == nil || baseItem.Price.Recurring == nil {
+		return false
+	}
+	return string(baseItem.Price.Recurring.Interval) != cp.Interval
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Proration behaviors of a subscription change. Prorations are billed with
+// the next renewal, not at all, or invoiced right away.
+const (
+	prorationCreate        = "create_prorations"
+	prorationNone          = "none"
+	prorationAlwaysInvoice = "always_invoice"
+)
+
+func checkProrationBehavior(v string) error {
+	switch v {
+	case prorationCreate, prorationNone, prorationAlwaysInvoice:
+		return nil
+	}
+	return fmt.Errorf("invalid proration_behavior %q, use create_prorations, none or always_invoice", v)
+}
+
+// Directions of a plan change, from the yearly amount of the base plan item
+// before and after the change.
+const (
+	planChangeUpgrade    = "upgrade"
+	planChangeDowngrade  = "downgrade"
+	planChangeCrossgrade = "crossgrade"
+)
+
+// planChangeRule is the default proration of a plan change direction. A
+// change at the period end is scheduled instead of applied right away.
+type planChangeRule struct {
+	ProrationBehavior string
+	ResetBillingCycle bool
+	AtPeriodEnd       bool
+}
+
+// defaultPlanChangeRules charge upgrades right away and apply downgrades at
+// the end of the period.
+var defaultPlanChangeRules = map[string]planChangeRule{
+	planChangeUpgrade:    {ProrationBehavior: prorationAlwaysInvoice},
+	planChangeDowngrade:  {ProrationBehavior: prorationNone, AtPeriodEnd: true},
+	planChangeCrossgrade: {ProrationBehavior: prorationCreate},
+}
+
+// loadPlanChangeRules returns the default rules overridden by
+// PLAN_CHANGE_<DIRECTION>_PRORATION,
+// PLAN_CHANGE_<DIRECTION>_RESET_BILLING_CYCLE and
+// PLAN_CHANGE_<DIRECTION>_AT_PERIOD_END, e.g.
+// PLAN_CHANGE_DOWNGRADE_AT_PERIOD_END=false.
+func loadPlanChangeRules() map[string]planChangeRule {
+	rules := map[string]planChangeRule{}
+	for direction, rule := range defaultPlanChangeRules {
+		prefix := "PLAN_CHANGE_" + strings.ToUpper(direction)
+		if v := os.Getenv(prefix + "_PRORATION"); v != "" {
+			if err := checkProrationBehavior(v); err != nil {
+				log.Printf("invalid %s_PRORATION, using %s : %v", prefix, rule.ProrationBehavior, err)
+			} else {
+				rule.ProrationBehavior = v
+			}
+		}
+		if v := os.Getenv(prefix + "_RESET_BILLING_CYCLE"); v != "" {
+			if reset, err := strconv.ParseBool(v); err != nil {
+				log.Printf("invalid %s_RESET_BILLING_CYCLE, using %t : %v", prefix, rule.ResetBillingCycle, err)
+			} else {
+				rule.ResetBillingCycle = reset
+			}
+		}
+		if v := os.Getenv(prefix + "_AT_PERIOD_END"); v != "" {
+			if atPeriodEnd, err := strconv.ParseBool(v); err != nil {
+				log.Printf("invalid %s_AT_PERIOD_END, using %t : %v", prefix, rule.AtPeriodEnd, err)
+			} else {
+				rule.AtPeriodEnd = atPeriodEnd
+			}
+		}
+		rules[direction] = rule
+	}
+	return rules
+}
+
+// planChangeRequest is the body of a plan change. The proration, the reset
+// of the billing cycle and the scheduling at the period end default to the
+// rule of the direction of the change.
+type planChangeRequest struct {
+	Plan              string `json:"plan"`
+	ProrationBehavior string `json:"proration_behavior"`
+	ResetBillingCycle *bool  `json:"reset_billing_cycle"`
+	AtPeriodEnd       *bool  `json:"at_period_end"`
+	// PromotionCode is the code of a Stripe promotion code to redeem with
+	// the change.
+	PromotionCode string `json:"promotion_code"`
+}
+
+// planChangeOptions are the resolved options of a plan change.
+type planChangeOptions struct {
+	Direction         string
+	ProrationBehavior string
+	ResetBillingCycle bool
+	AtPeriodEnd       bool
+}
+
+// resolvePlanChange returns the options of the change of s to updateItem, the
+// ones of the request or else the ones of the rule of its direction. A change
+// at the period end starts a new period without prorations.
+func resolvePlanChange(s *stripe.Subscription, updateItem *stripe.SubscriptionItemsParams, req planChangeRequest) (planChangeOptions, error) {
+	if req.ProrationBehavior != "" {
+		if err := checkProrationBehavior(req.ProrationBehavior); err != nil {
+			return planChangeOptions{}, err
+		}
+	}
+	if req.AtPeriodEnd != nil && *req.AtPeriodEnd && (req.ProrationBehavior != "" || req.ResetBillingCycle != nil) {
+		return planChangeOptions{}, fmt.Errorf("proration_behavior and reset_billing_cycle do not apply to a change at the period end")
+	}
+	direction, err := planChangeDirection(s, updateItem)
+	if err != nil {
+		return planChangeOptions{}, err
+	}
+
+	rule := loadPlanChangeRules()[direction]
+	opts := planChangeOptions{
+		Direction:         direction,
+		ProrationBehavior: rule.ProrationBehavior,
+		ResetBillingCycle: rule.ResetBillingCycle,
+		AtPeriodEnd:       rule.AtPeriodEnd,
+	}
+	if req.ProrationBehavior != "" {
+		opts.ProrationBehavior = req.ProrationBehavior
+	}
+	if req.ResetBillingCycle != nil {
+		opts.ResetBillingCycle = *req.ResetBillingCycle
+	}
+	// A request for a proration or a reset is applied right away.
+	if req.ProrationBehavior != "" || req.ResetBillingCycle != nil {
+		opts.AtPeriodEnd = false
+	}
+	if req.AtPeriodEnd != nil {
+		opts.AtPeriodEnd = *req.AtPeriodEnd
+	}
+	if opts.AtPeriodEnd {
+		opts.ProrationBehavior = prorationNone
+		opts.ResetBillingCycle = false
+	}
+	return opts, nil
+}
+
+// planChangeDirection compares the yearly amount of the item before and after
+// the change, so that a change of interval is compared at the same scale.
+func planChangeDirection(s *stripe.Subscription, updateItem *stripe.SubscriptionItemsParams) (string, error) {
+	var current *stripe.SubscriptionItem
+	for _, item := range s.Items.Data {
+		if item.ID == stringValue(updateItem.ID) {
+			current = item
+		}
+	}
+	if current == nil || current.Price == nil {
+		return "", fmt.Errorf("subscription item %s not found", stringValue(updateItem.ID))
+	}
+	pr, err := stripeAPI.GetPrice(stringValue(updateItem.Price), nil)
+	if err != nil {
+		return "", err
+	}
+
+	before := yearlyAmount(current.Price, current.Quantity)
+	after := yearlyAmount(pr, stripe.Int64Value(updateItem.Quantity))
+	switch {
+	case after > before:
+		return planChangeUpgrade, nil
+	case after < before:
+		return planChangeDowngrade, nil
+	}
+	return planChangeCrossgrade, nil
+}
+
+func yearlyAmount(pr *stripe.Price, quantity int64) int64 {
+	amount := pr.UnitAmount * quantity
+	if pr.Recurring == nil {
+		return amount
+	}
+	count := pr.Recurring.IntervalCount
+	if count < 1 {
+		count = 1
+	}
+	switch pr.Recurring.Interval {
+	case stripe.PriceRecurringIntervalDay:
+		return amount * 365 / count
+	case stripe.PriceRecurringIntervalWeek:
+		return amount * 52 / count
+	case stripe.PriceRecurringIntervalYear:
+		return amount / count
+	}
+	return amount * 12 / count
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+const (
+	replaySourceStore  = "store"
+	replaySourceStripe = "stripe"
+)
+
+// replayFilter selects the events to replay. Empty fields match everything.
+type replayFilter struct {
+	// Source is "store" to replay events from stripe_events, or "stripe" to
+	// pull the events missing from stripe_events, or not processed yet, from
+	// the Stripe events list API, which keeps 30 days.
+	Source string `json:"source"`
+	// IDs take precedence over the other filters when pulling from Stripe.
+	IDs         []string `json:"ids"`
+	Types       []string `json:"types"`
+	Since       int64    `json:"since"`
+	Until       int64    `json:"until"`
+	OrgID       int      `json:"org_id"`
+	DryRun      bool     `json:"dry_run"`
+	IgnoreOrder bool     `json:"ignore_order"`
+}
+
+type replayResult struct {
+	EventID string   `json:"event_id"`
+	Type    string   `json:"type"`
+	Created int64    `json:"created"`
+	Outcome string   `json:"outcome"`
+	Changes []string `json:"changes"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func adminReplayEvents(w http.ResponseWriter, r *http.Request) {
+	var f replayFilter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	results, err := replayEvents(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// runReplayCommand implements the replay subcommand.
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	var f replayFilter
+	var ids, types, since, until string
+	fs.StringVar(&f.Source, "source", replaySourceStore, `where events are read from, "store" or "stripe"`)
+	fs.StringVar(&ids, "id", "", "comma separated event IDs")
+	fs.StringVar(&types, "type", "", "comma separated event types")
+	fs.StringVar(&since, "since", "", "only events created at or after, RFC3339 or unix seconds")
+	fs.StringVar(&until, "until", "", "only events created at or before, RFC3339 or unix seconds")
+	fs.IntVar(&f.OrgID, "org", 0, "only events of this organization ID")
+	fs.BoolVar(&f.DryRun, "dry-run", false, "report what would change without applying it")
+	fs.BoolVar(&f.IgnoreOrder, "ignore-order", false, "apply subscription events even if a newer one was applied")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	f.IDs = splitList(ids)
+	f.Types = splitList(types)
+	var err error
+	if f.Since, err = parseTimeFlag(since); err != nil {
+		return fmt.Errorf("invalid -since : %w", err)
+	}
+	if f.Until, err = parseTimeFlag(until); err != nil {
+		return fmt.Errorf("invalid -until : %w", err)
+	}
+
+	results, err := replayEvents(f)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		fmt.Printf("%s\t%s\t%s\t%s\n", res.EventID, res.Type, time.Unix(res.Created, 0).UTC().Format(time.RFC3339), res.Outcome)
+		for _, c := range res.Changes {
+			fmt.Printf("\t%s\n", c)
+		}
+		if res.Error != "" {
+			fmt.Printf("\terror : %s\n", res.Error)
+		}
+	}
+	return nil
+}
+
+// replayEvents feeds the selected events, oldest first, through processEvent.
+// Events pulled from Stripe are stored in stripe_events like webhook
+// deliveries, unless in dry-run mode. Each event is claimed like a delivery,
+// the ones another delivery is processing are skipped.
+func replayEvents(f replayFilter) ([]replayResult, error) {
+	var events []stripe.Event
+	var err error
+	switch f.Source {
+	case "", replaySourceStore:
+		events, err = listStoredEventsForReplay(f)
+	case replaySourceStripe:
+		events, err = listStripeEventsForReplay(f)
+	default:
+		return nil, fmt.Errorf("unknown source %q", f.Source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Created < events[j].Created })
+
+	opts := eventOptions{DryRun: f.DryRun, IgnoreOrder: f.IgnoreOrder}
+	results := make([]replayResult, 0, len(events))
+	for _, ev := range events {
+		res := replayResult{EventID: ev.ID, Type: ev.Type, Created: ev.Created}
+		if f.Source == replaySourceStripe {
+			// Only events missed by the webhook endpoint are fed through,
+			// the others are replayed from the store.
+			se, err := getStoredEvent(ev.ID)
+			if err == nil && se.Status == eventStatusProcessed {
+				res.Outcome = "skipped"
+				res.Changes = []string{"already processed"}
+				results = append(results, res)
+				continue
+			}
+		}
+		if !f.DryRun && f.Source == replaySourceStripe {
+			payload, err := json.Marshal(ev)
+			if err != nil {
+				return results, err
+			}
+			if err := recordEvent(ev, payload); err != nil {
+				return results, err
+			}
+		}
+		if !f.DryRun {
+			// A webhook delivery of the event may be processing it.
+			claimed, err := claimEventForReplay(ev.ID)
+			if err != nil {
+				return results, err
+			}
+			if !claimed {
+				res.Outcome = "skipped"
+				res.Changes = []string{"being processed by another delivery"}
+				results = append(results, res)
+				continue
+			}
+		}
+
+		changes, err := processEvent(ev, opts)
+		res.Changes = changes
+		switch {
+		case err != nil:
+			res.Outcome = "failed"
+			res.Error = err.Error()
+		case f.DryRun:
+			res.Outcome = "dry-run"
+		default:
+			res.Outcome = "processed"
+		}
+
+		if !f.DryRun {
+			if err != nil {
+				err = markEventFailed(ev.ID, err)
+			} else {
+				err = markEventProcessed(ev.ID)
+			}
+			if err != nil {
+				return results, err
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func listStoredEventsForReplay(f replayFilter) ([]stripe.Event, error) {
+	query := "SELECT * FROM stripe_events WHERE 1 = 1"
+	var args []interface{}
+	if len(f.IDs) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(f.IDs)-1) + ")"
+		for _, id := range f.IDs {
+			args = append(args, id)
+		}
+	}
+	if len(f.Types) > 0 {
+		query += " AND type IN (?" + strings.Repeat(", ?", len(f.Types)-1) + ")"
+		for _, t := range f.Types {
+			args = append(args, t)
+		}
+	}
+	if f.Since > 0 {
+		query += " AND created >= ?"
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		query += " AND created <= ?"
+		args = append(args, f.Until)
+	}
+	if f.OrgID != 0 {
+		org, err := store.GetOrganization(strconv.Itoa(f.OrgID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get organization %d : %w", f.OrgID, err)
+		}
+		query += " AND customer_id = ?"
+		args = append(args, org.StripeID)
+	}
+	query += " ORDER BY created, received_at"
+
+	var stored []StripeEvent
+	if err := db.Select(&stored, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	events := make([]stripe.Event, 0, len(stored))
+	for _, se := range stored {
+		var ev stripe.Event
+		if err := json.Unmarshal(se.Payload, &ev); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal stored event %s : %w", se.ID, err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+func listStripeEventsForReplay(f replayFilter) ([]stripe.Event, error) {
+	var customerID string
+	if f.OrgID != 0 {
+		org, err := store.GetOrganization(strconv.Itoa(f.OrgID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get organization %d : %w", f.OrgID, err)
+		}
+		customerID = org.StripeID
+	}
+
+	var events []stripe.Event
+	if len(f.IDs) > 0 {
+		for _, id := range f.IDs {
+			ev, err := stripeAPI.GetEvent(id, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get event %s : %w", id, err)
+			}
+			events = append(events, *ev)
+		}
+	} else {
+		params := &stripe.EventListParams{}
+		if f.Since > 0 || f.Until > 0 {
+			params.CreatedRange = &stripe.RangeQueryParams{GreaterThanOrEqual: f.Since, LesserThanOrEqual: f.Until}
+		}
+		for _, t := range f.Types {
+			params.Types = append(params.Types, stripe.String(t))
+		}
+		list, err := stripeAPI.ListEvents(params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list events : %w", err)
+		}
+		for _, ev := range list {
+			events = append(events, *ev)
+		}
+	}
+
+	if customerID == "" {
+		return events, nil
+	}
+	var filtered []stripe.Event
+	for _, ev := range events {
+		if eventCustomerID(ev) == customerID {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func parseTimeFlag(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// PendingChange is a plan change scheduled at the end of the current period
+// of a subscription. The subscription schedule of Stripe applies it, the
+// subscription keeps its items until then.
+type PendingChange struct {
+	SubscriptionID string `json:"subscription_id" db:"subscription_id"`
+	ScheduleID     string `json:"schedule_id"     db:"schedule_id"`
+	Plan           string `json:"plan"            db:"plan_key"`
+	Quantity       int64  `json:"quantity"        db:"quantity"`
+	EffectiveAt    int64  `json:"effective_at"    db:"effective_at"`
+	Created        int64  `json:"created"         db:"created"`
+}
+
+// schedulePlanChange schedules the change of the subscription to updateItem
+// at the end of its current period. The schedule has the current items until
+// then and the changed ones for the next period, after which it releases the
+// subscription.
+func schedulePlanChange(s *stripe.Subscription, plan string, updateItem *stripe.SubscriptionItemsParams) (PendingChange, error) {
+	var sched *stripe.SubscriptionSchedule
+	var err error
+	created := false
+	if s.Schedule != nil && s.Schedule.ID != "" {
+		sched, err = stripeAPI.GetSubscriptionSchedule(s.Schedule.ID, nil)
+	} else {
+		sched, err = stripeAPI.NewSubscriptionSchedule(&stripe.SubscriptionScheduleParams{FromSubscription: stripe.String(s.ID)})
+		created = true
+	}
+	if err != nil {
+		return PendingChange{}, err
+	}
+
+	start := s.CurrentPeriodStart
+	if sched.CurrentPhase != nil {
+		start = sched.CurrentPhase.StartDate
+	}
+	params := &stripe.SubscriptionScheduleParams{
+		EndBehavior: stripe.String(string(stripe.SubscriptionScheduleEndBehaviorRelease)),
+		Phases: []*stripe.SubscriptionSchedulePhaseParams{
+			{
+				Items:             phaseItems(s, nil),
+				StartDate:         stripe.Int64(start),
+				EndDate:           stripe.Int64(s.CurrentPeriodEnd),
+				ProrationBehavior: stripe.String(prorationNone),
+			},
+			{
+				Items:             phaseItems(s, updateItem),
+				Iterations:        stripe.Int64(1),
+				ProrationBehavior: stripe.String(prorationNone),
+			},
+		},
+	}
+	if _, err := stripeAPI.UpdateSubscriptionSchedule(sched.ID, params); err != nil {
+		if created {
+			if _, rerr := stripeAPI.ReleaseSubscriptionSchedule(sched.ID, nil); rerr != nil {
+				log.Printf("subscriptionschedule.Release %s: %v", sched.ID, rerr)
+			}
+		}
+		return PendingChange{}, err
+	}
+
+	pc := PendingChange{
+		SubscriptionID: s.ID,
+		ScheduleID:     sched.ID,
+		Plan:           plan,
+		Quantity:       stripe.Int64Value(updateItem.Quantity),
+		EffectiveAt:    s.CurrentPeriodEnd,
+		Created:        time.Now().Unix(),
+	}
+	return pc, store.SetPendingChange(pc)
+}
+
+// phaseItems are the items of the subscription as schedule phase items, with
+// the item of change replaced. Metered items have no quantity.
+func phaseItems(s *stripe.Subscription, change *stripe.SubscriptionItemsParams) []*stripe.SubscriptionSchedulePhaseItemParams {
+	var items []*stripe.SubscriptionSchedulePhaseItemParams
+	for _, item := range s.Items.Data {
+		if item.Price == nil {
+			continue
+		}
+		pi := &stripe.SubscriptionSchedulePhaseItemParams{
+			Price:    stripe.String(item.Price.ID),
+			Quantity: stripe.Int64(item.Quantity),
+		}
+		if change != nil && item.ID == stringValue(change.ID) {
+			pi.Price = change.Price
+			pi.Quantity = change.Quantity
+		}
+		if item.Price.Recurring != nil && item.Price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+			pi.Quantity = nil
+		}
+		items = append(items, pi)
+	}
+	return items
+}
+
+// releaseSchedule detaches the subscription from its schedule, which drops
+// its pending plan change. A schedule Stripe no longer has is only removed
+// locally.
+func releaseSchedule(subID, scheduleID string) error {
+	if scheduleID != "" {
+		_, err := stripeAPI.ReleaseSubscriptionSchedule(scheduleID, nil)
+		if err != nil && !strings.Contains(err.Error(), "resource_missing") {
+			return err
+		}
+	}
+	return store.DeletePendingChange(subID)
+}
+
+// refreshPendingChange reschedules the pending plan change of the subscription
+// after a change of its items, so that the next period keeps them. A change
+// the new items no longer allow is dropped.
+func refreshPendingChange(organization Organization, s *stripe.Subscription) error {
+	pc, err := store.GetPendingChange(s.ID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	updateItem, _, err := planChangeItem(organization, s, pc.Plan)
+	if err != nil {
+		log.Printf("dropping the change of subscription %s to plan %s : %v", s.ID, pc.Plan, err)
+		return releaseSchedule(s.ID, pc.ScheduleID)
+	}
+	_, err = schedulePlanChange(s, pc.Plan, updateItem)
+	return err
+}
+
+// cancelPendingPlanChange releases the schedule of the plan change pending on
+// the subscription, which keeps its current plan.
+func cancelPendingPlanChange(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	if sub.PendingChange == nil {
+		http.Error(w, "no pending plan change on subscription "+sub.ID, http.StatusNotFound)
+		return
+	}
+	if err := releaseSchedule(sub.ID, sub.PendingChange.ScheduleID); err != nil {
+		http.Error(w, "failed to cancel the pending plan change : "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeStoredSubscription(w, organization, sub.ID)
+}
+
+// handleScheduleEvent drops the pending plan change of a schedule that no
+// longer applies it, e.g. released from the Stripe dashboard.
+func handleScheduleEvent(event stripe.Event, opts eventOptions) ([]string, error) {
+	var sched stripe.SubscriptionSchedule
+	if err := json.Unmarshal(event.Data.Raw, &sched); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal subscription schedule : %w", err)
+	}
+	if opts.DryRun {
+		return []string{"would clear the pending plan change of subscription schedule " + sched.ID}, nil
+	}
+	if err := store.DeletePendingChangeBySchedule(sched.ID); err != nil {
+		return nil, err
+	}
+	return []string{"clear the pending plan change of subscription schedule " + sched.ID}, nil
+}
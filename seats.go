@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Member is a member of an organization, every member takes a seat of the
+// primary subscription.
+type Member struct {
+	ID      int    `json:"id"      db:"id"`
+	OrgID   int    `json:"org_id"  db:"org_id"`
+	Email   string `json:"email"   db:"email"`
+	Name    string `json:"name"    db:"name"`
+	Created int64  `json:"created" db:"created"`
+}
+
+// Seats are the seats of the primary subscription of an organization, the
+// quantity of its base plan item.
+type Seats struct {
+	SubscriptionID string `json:"subscription_id"`
+	Plan           string `json:"plan"`
+	Seats          int64  `json:"seats"`
+	MinSeats       int64  `json:"min_seats"`
+	MaxSeats       int64  `json:"max_seats"`
+	Members        int64  `json:"members"`
+	SeatSync       bool   `json:"seat_sync"`
+}
+
+// seatProrationBehavior returns the proration behavior of a seat change, the
+// default is SEAT_PRORATION_BEHAVIOR or else create_prorations.
+func seatProrationBehavior(v string) (string, error) {
+	if v == "" {
+		v = os.Getenv("SEAT_PRORATION_BEHAVIOR")
+	}
+	if v == "" {
+		return prorationCreate, nil
+	}
+	return v, checkProrationBehavior(v)
+}
+
+func getOrgSeats(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	seats, _, _, err := loadSeats(organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, seats)
+}
+
+// updateOrgSeats sets the seat count of the primary subscription, or turns
+// the sync of the seats with the members on or off.
+func updateOrgSeats(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	var req struct {
+		Seats             *int64 `json:"seats"`
+		SeatSync          *bool  `json:"seat_sync"`
+		ProrationBehavior string `json:"proration_behavior"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	proration, err := seatProrationBehavior(req.ProrationBehavior)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.SeatSync != nil {
+		organization.SeatSync = *req.SeatSync
+	}
+
+	seats, item, cp, err := loadSeats(organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	target := seats.Seats
+	if seats.SubscriptionID != "" && organization.SeatSync {
+		target = syncedSeats(cp, seats.Members)
+	}
+	if req.Seats != nil {
+		switch {
+		case seats.SubscriptionID == "":
+			http.Error(w, "not subscribed to any plan , create plan", http.StatusUnprocessableEntity)
+			return
+		case organization.SeatSync && *req.Seats != target:
+			http.Error(w, "seats follow the members while seat_sync is on", http.StatusUnprocessableEntity)
+			return
+		}
+		target = *req.Seats
+	}
+
+	if seats.SubscriptionID != "" {
+		if err := checkSeats(cp, target, seats.Members); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if target != seats.Seats {
+			if err := updateSeats(organization, item, target, proration); err != nil {
+				http.Error(w, "failed to update the seats : "+err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+	}
+	if req.SeatSync != nil {
+		if err := store.SetSeatSync(organization.ID, organization.SeatSync); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	seats, _, _, err = loadSeats(organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, seats)
+}
+
+func getOrgMembers(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	members, err := listMembers(organization.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, members)
+}
+
+// addOrgMember adds a member, which needs a free seat. With seat sync on a
+// seat is added instead, up to the maximum of the plan.
+func addOrgMember(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" {
+		http.Error(w, "email is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := getMemberByEmail(organization.ID, req.Email); err != sql.ErrNoRows {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "member already exists", http.StatusConflict)
+		return
+	}
+
+	m, err := createMember(organization.ID, req.Email, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The member is removed again when it can not get a seat.
+	seats, item, cp, err := loadSeats(organization)
+	if err == nil && seats.SubscriptionID != "" {
+		switch {
+		case organization.SeatSync:
+			target := syncedSeats(cp, seats.Members)
+			if err = checkSeats(cp, target, seats.Members); err == nil && target != seats.Seats {
+				proration, _ := seatProrationBehavior("")
+				err = updateSeats(organization, item, target, proration)
+			}
+		case seats.Members > seats.Seats:
+			err = fmt.Errorf("no seat left, %d seats are taken", seats.Seats)
+		}
+	}
+	if err != nil {
+		if err := deleteMember(m.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, m)
+}
+
+// removeOrgMember removes a member, with seat sync on its seat is removed too.
+func removeOrgMember(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := strconv.Atoi(bone.GetValue(r, "memberId"))
+	if err != nil {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	m, err := getMember(id)
+	if err != nil || m.OrgID != organization.ID {
+		switch {
+		case err == nil || err == sql.ErrNoRows:
+			http.Error(w, "", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := deleteMember(m.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if organization.SeatSync {
+		seats, item, cp, err := loadSeats(organization)
+		if err == nil && seats.SubscriptionID != "" {
+			if target := syncedSeats(cp, seats.Members); target != seats.Seats {
+				proration, _ := seatProrationBehavior("")
+				err = updateSeats(organization, item, target, proration)
+			}
+		}
+		if err != nil {
+			http.Error(w, "member removed but failed to update the seats : "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, "")
+}
+
+// loadSeats returns the seats of the organization with the base plan item of
+// its primary subscription and its catalog plan. The subscription is empty
+// when the organization has no primary subscription of a catalog plan.
+func loadSeats(org Organization) (Seats, SubscriptionItem, CatalogPlan, error) {
+	seats := Seats{SeatSync: org.SeatSync}
+	members, err := countMembers(org.ID)
+	if err != nil {
+		return seats, SubscriptionItem{}, CatalogPlan{}, err
+	}
+	seats.Members = members
+	if org.StripeSubID == "" {
+		return seats, SubscriptionItem{}, CatalogPlan{}, nil
+	}
+	sub, err := store.GetSubscription(org.StripeSubID)
+	if err != nil {
+		return seats, SubscriptionItem{}, CatalogPlan{}, err
+	}
+	for _, item := range sub.Items {
+		cp, err := getCatalogPlanByPrice(item.PriceID)
+		if err != nil || cp.Kind != catalogKindBase {
+			continue
+		}
+		seats.SubscriptionID = sub.ID
+		seats.Plan = cp.Key
+		seats.Seats = item.Quantity
+		seats.MinSeats = cp.MinSeats
+		seats.MaxSeats = cp.MaxSeats
+		return seats, item, cp, nil
+	}
+	return seats, SubscriptionItem{}, CatalogPlan{}, nil
+}
+
+// updateSeats sets the quantity of the base plan item, and the one of the
+// pending plan change.
+func updateSeats(org Organization, item SubscriptionItem, seats int64, proration string) error {
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{{
+			ID:       stripe.String(item.ID),
+			Quantity: stripe.Int64(seats),
+		}},
+		ProrationBehavior: stripe.String(proration),
+	}
+	s, err := stripeAPI.UpdateSubscription(item.SubscriptionID, params)
+	if err != nil {
+		return err
+	}
+	if err := updateSub(*s); err != nil {
+		return err
+	}
+	touchSubEventAt(org.ID, s.ID)
+	return refreshPendingChange(org, s)
+}
+
+// syncedSeats is the seat count of the plan for members.
+func syncedSeats(cp CatalogPlan, members int64) int64 {
+	if members < cp.MinSeats {
+		return cp.MinSeats
+	}
+	return members
+}
+
+// checkSeats checks that the plan allows the seat count and that every member
+// has a seat.
+func checkSeats(cp CatalogPlan, seats, members int64) error {
+	switch {
+	case seats < cp.MinSeats:
+		return fmt.Errorf("plan %s needs at least %d seats", cp.Key, cp.MinSeats)
+	case cp.MaxSeats > 0 && seats > cp.MaxSeats:
+		return fmt.Errorf("plan %s allows at most %d seats", cp.Key, cp.MaxSeats)
+	case seats < members:
+		return fmt.Errorf("%d members need at least %d seats", members, members)
+	}
+	return nil
+}
+
+func checkSeatBounds(cp CatalogPlan) error {
+	switch {
+	case cp.MinSeats < 1:
+		return fmt.Errorf("min_seats must be at least 1")
+	case cp.MaxSeats < 0:
+		return fmt.Errorf("max_seats can not be negative, use 0 for no maximum")
+	case cp.MaxSeats > 0 && cp.MaxSeats < cp.MinSeats:
+		return fmt.Errorf("max_seats can not be less than min_seats")
+	}
+	return nil
+}
+
+func listMembers(orgID int) ([]Member, error) {
+	members := []Member{}
+	err := db.Select(&members, db.Rebind("SELECT * FROM organization_members WHERE org_id = ? ORDER BY id"), orgID)
+	return members, err
+}
+
+func countMembers(orgID int) (int64, error) {
+	var n int64
+	err := db.Get(&n, db.Rebind("SELECT COUNT(*) FROM organization_members WHERE org_id = ?"), orgID)
+	return n, err
+}
+
+func getMember(id int) (Member, error) {
+	var m Member
+	err := db.Get(&m, db.Rebind("SELECT * FROM organization_members WHERE id = ?"), id)
+	return m, err
+}
+
+func getMemberByEmail(orgID int, email string) (Member, error) {
+	var m Member
+	err := db.Get(&m, db.Rebind("SELECT * FROM organization_members WHERE org_id = ? AND email = ?"), orgID, email)
+	return m, err
+}
+
+func createMember(orgID int, email, name string) (Member, error) {
+	query := "INSERT INTO organization_members (org_id, email, name, created) VALUES (?, ?, ?, ?)"
+	if _, err := db.ExecContext(context.Background(), db.Rebind(query), orgID, email, name, time.Now().Unix()); err != nil {
+		return Member{}, err
+	}
+	return getMemberByEmail(orgID, email)
+}
+
+func deleteMember(id int) error {
+	_, err := db.ExecContext(context.Background(), db.Rebind("DELETE FROM organization_members WHERE id = ?"), id)
+	return err
+}
@@ -3,38 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-zoo/bone"
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 	"github.com/stripe/stripe-go/v74"
-	"github.com/stripe/stripe-go/v74/customer"
-	"github.com/stripe/stripe-go/v74/invoice"
-	"github.com/stripe/stripe-go/v74/paymentmethod"
-	"github.com/stripe/stripe-go/v74/price"
-	"github.com/stripe/stripe-go/v74/product"
-	sub "github.com/stripe/stripe-go/v74/subscription"
-	"github.com/stripe/stripe-go/v74/webhook"
-	_ "modernc.org/sqlite"
 )
 
 const ctxOrgKey = "Organization"
 
-var subPlans = map[string]string{
-	"planA": "price_1NEDyqSAVJByQTEdNkeEdf7P",
-	"planB": "price_1NEDyNSAVJByQTEdrH97Z3B6",
-}
-
+// db is the database of the store, the tables the Store does not hold are
+// queried through it.
 var db *sqlx.DB
 
 type Product struct {
@@ -45,6 +36,7 @@ type Product struct {
 }
 type Plan struct {
 	ID       string  `json:"id"`
+	Key      string  `json:"key"`
 	SiID     string  `json:"si_id"`
 	SubID    string  `json:"sub_id"`
 	Active   bool    `json:"active"`
@@ -61,7 +53,20 @@ type Organization struct {
 	StripeSubID string `json:"stripe_sub"  db:"stripe_sub"`
 	SubStatus   string `json:"sub_status"  db:"sub_status"`
 	Plans       []Plan `json:"plans"  db:"-"`
-	PlansByte   []byte `json:"-"  db:"plans"`
+
+	DunningStage    string `json:"dunning_stage"    db:"dunning_stage"`
+	DunningDeadline int64  `json:"dunning_deadline" db:"dunning_deadline"`
+
+	// SeatSync keeps the seats of the primary subscription equal to the
+	// number of members.
+	SeatSync bool `json:"seat_sync" db:"seat_sync"`
+
+	// PendingChange is the plan change scheduled at the end of the period of
+	// the primary subscription.
+	PendingChange *PendingChange `json:"pending_change,omitempty" db:"-"`
+	// Pause is set while the collection of the primary subscription is
+	// paused.
+	Pause *SubscriptionPause `json:"pause,omitempty" db:"-"`
 }
 
 func main() {
@@ -71,31 +76,66 @@ func main() {
 
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 	var err error
-	db, err = sqlx.Open("sqlite", "local.db")
+	// DATABASE_URL selects PostgreSQL with a postgres:// URL, the default is
+	// the local.db SQLite file.
+	store, err = openStore(os.Getenv("DATABASE_URL"))
 
 	if err != nil {
 		log.Fatal(err)
 	}
+	db = store.DB()
 
 	defer db.Close()
 
+	// The migrate command runs before the automatic migration so that it can
+	// revert migrations.
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := checkMigrations(); err != nil {
+		log.Fatal(err)
+	}
+
+	// STRIPE_FAKE runs the server against the in-memory fake instead of
+	// Stripe, seeded with the prices of the plan catalog.
+	if os.Getenv("STRIPE_FAKE") != "" {
+		fake := newFakeStripeClient()
+		if err := seedFakeStripe(fake); err != nil {
+			log.Fatal(err)
+		}
+		stripeAPI = fake
+		log.Print("using the in-memory Stripe fake")
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			if err := runReplayCommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	if interval := catalogSyncInterval(); interval > 0 {
+		go runCatalogSync(interval)
+	}
+	if every := durationEnv("ENTITLEMENT_KEY_ROTATION", 30*24*time.Hour); every > 0 {
+		go runKeyRotation(every)
+	}
+	go runDunningScheduler(durationEnv("DUNNING_SCHEDULER_INTERVAL", time.Minute), loadDunningConfig())
+	go runUsageFlusher(durationEnv("USAGE_FLUSH_INTERVAL", time.Minute))
+
+	mux := newRouter()
+
 	// cors.Default() setup the middleware with default options being
 	// all origins accepted with simple methods (GET, POST). See
 	// documentation below for more options.
-	mux := bone.New()
-
-	mux.Get("/config", http.HandlerFunc(getConfig))
-	mux.Post("/organization/create", http.HandlerFunc(handleCreateOrg))
-	mux.Get("/organization", http.HandlerFunc(getAllOrg))
-	mux.Get("/plans", http.HandlerFunc(getPlans))
-	mux.Get("/organization/:id", middlewareGetID(http.HandlerFunc(getOrgById)))
-	mux.Get("/organization/:id/sub", middlewareGetID(http.HandlerFunc(getSubscriptionInfo)))
-	mux.Post("/organization/:id/sub", middlewareGetID(http.HandlerFunc(createSubscription)))
-	mux.Put("/organization/:id/sub", middlewareGetID(http.HandlerFunc(updateSubscription)))
-	mux.Delete("/organization/:id/sub", middlewareGetID(http.HandlerFunc(cancelSubscription)))
-	mux.Get("/organization/:id/payment-method", middlewareGetID(http.HandlerFunc(retrievePaymentMethod)))
-	mux.Post("/stripe/webhook", http.HandlerFunc(handleWebhook))
-
 	c := cors.New(cors.Options{
 		AllowedMethods: []string{"HEAD", "GET", "POST", "PATCH", "DELETE", "PUT", "OPTIONS"},
 		AllowedOrigins: []string{"http://localhost:3000"},
@@ -112,10 +152,82 @@ func main() {
 	if port == "" {
 		port = "3000"
 	}
+	if fake, ok := stripeAPI.(*fakeStripeClient); ok {
+		fake.DeliverWebhooks("http://localhost:"+port+"/stripe/webhook", os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	}
 	log.Fatalln(http.ListenAndServe(host+":"+port, handler))
 
 }
 
+// newRouter registers every route of the API.
+func newRouter() *bone.Mux {
+	mux := bone.New()
+
+	mux.Get("/config", http.HandlerFunc(getConfig))
+	mux.Post("/organization/create", http.HandlerFunc(handleCreateOrg))
+	mux.Get("/organization", http.HandlerFunc(getAllOrg))
+	mux.Get("/plans", http.HandlerFunc(getPlans))
+	mux.Get("/plans/:key/addons", http.HandlerFunc(getPlanAddOns))
+	mux.Get("/organization/:id", middlewareGetID(http.HandlerFunc(getOrgById)))
+	mux.Get("/organization/:id/sub", middlewareGetID(http.HandlerFunc(getSubscriptionInfo)))
+	mux.Post("/organization/:id/sub", middlewareGetID(http.HandlerFunc(createSubscription)))
+	mux.Put("/organization/:id/sub", middlewareGetID(http.HandlerFunc(updateSubscription)))
+	mux.Delete("/organization/:id/sub", middlewareGetID(http.HandlerFunc(cancelOrgSubscription)))
+	mux.Post("/organization/:id/sub/reactivate", middlewareGetID(http.HandlerFunc(reactivateOrgSubscription)))
+	mux.Post("/organization/:id/sub/pause", middlewareGetID(http.HandlerFunc(pauseOrgSubscription)))
+	mux.Post("/organization/:id/sub/resume", middlewareGetID(http.HandlerFunc(resumeOrgSubscription)))
+	mux.Get("/organization/:id/sub/preview", middlewareGetID(http.HandlerFunc(previewSubscriptionPlan)))
+	mux.Delete("/organization/:id/sub/pending", middlewareGetID(http.HandlerFunc(cancelPendingPlanChange)))
+	mux.Get("/organization/:id/subscriptions", middlewareGetID(http.HandlerFunc(listOrgSubscriptions)))
+	mux.Post("/organization/:id/subscriptions", middlewareGetID(http.HandlerFunc(addOrgSubscription)))
+	mux.Get("/organization/:id/subscriptions/:subId", middlewareGetID(http.HandlerFunc(getOrgSubscription)))
+	mux.Put("/organization/:id/subscriptions/:subId", middlewareGetID(http.HandlerFunc(updateOrgSubscription)))
+	mux.Delete("/organization/:id/subscriptions/:subId", middlewareGetID(http.HandlerFunc(cancelOrgSubscription)))
+	mux.Post("/organization/:id/subscriptions/:subId/reactivate", middlewareGetID(http.HandlerFunc(reactivateOrgSubscription)))
+	mux.Post("/organization/:id/subscriptions/:subId/pause", middlewareGetID(http.HandlerFunc(pauseOrgSubscription)))
+	mux.Post("/organization/:id/subscriptions/:subId/resume", middlewareGetID(http.HandlerFunc(resumeOrgSubscription)))
+	mux.Get("/organization/:id/subscriptions/:subId/preview", middlewareGetID(http.HandlerFunc(previewSubscriptionPlan)))
+	mux.Delete("/organization/:id/subscriptions/:subId/pending", middlewareGetID(http.HandlerFunc(cancelPendingPlanChange)))
+	mux.Post("/organization/:id/sub/addons", middlewareGetID(http.HandlerFunc(addSubscriptionAddOn)))
+	mux.Put("/organization/:id/sub/addons/:addon", middlewareGetID(http.HandlerFunc(updateSubscriptionAddOn)))
+	mux.Delete("/organization/:id/sub/addons/:addon", middlewareGetID(http.HandlerFunc(removeSubscriptionAddOn)))
+	mux.Post("/organization/:id/subscriptions/:subId/addons", middlewareGetID(http.HandlerFunc(addSubscriptionAddOn)))
+	mux.Put("/organization/:id/subscriptions/:subId/addons/:addon", middlewareGetID(http.HandlerFunc(updateSubscriptionAddOn)))
+	mux.Delete("/organization/:id/subscriptions/:subId/addons/:addon", middlewareGetID(http.HandlerFunc(removeSubscriptionAddOn)))
+	mux.Get("/organization/:id/payment-method", middlewareGetID(http.HandlerFunc(retrievePaymentMethod)))
+	mux.Get("/organization/:id/invoices", middlewareGetID(http.HandlerFunc(getOrgInvoices)))
+	mux.Get("/organization/:id/seats", middlewareGetID(http.HandlerFunc(getOrgSeats)))
+	mux.Put("/organization/:id/seats", middlewareGetID(http.HandlerFunc(updateOrgSeats)))
+	mux.Get("/organization/:id/members", middlewareGetID(http.HandlerFunc(getOrgMembers)))
+	mux.Post("/organization/:id/members", middlewareGetID(http.HandlerFunc(addOrgMember)))
+	mux.Delete("/organization/:id/members/:memberId", middlewareGetID(http.HandlerFunc(removeOrgMember)))
+	mux.Post("/organization/:id/usage", middlewareGetID(http.HandlerFunc(postOrgUsage)))
+	mux.Get("/organization/:id/usage", middlewareGetID(http.HandlerFunc(getOrgUsage)))
+	mux.Get("/organization/:id/entitlements", middlewareGetID(http.HandlerFunc(getOrgEntitlements)))
+	mux.Post("/organization/:id/entitlements/token", middlewareGetID(http.HandlerFunc(issueEntitlementToken)))
+	mux.Get("/.well-known/jwks.json", http.HandlerFunc(getJWKS))
+	mux.Post("/stripe/webhook", http.HandlerFunc(handleWebhook))
+
+	mux.Get("/admin/plans", middlewareAdmin(http.HandlerFunc(adminListPlans)))
+	mux.Post("/admin/plans", middlewareAdmin(http.HandlerFunc(adminCreatePlan)))
+	mux.Post("/admin/plans/sync", middlewareAdmin(http.HandlerFunc(adminSyncPlans)))
+	mux.Put("/admin/plans/:key", middlewareAdmin(http.HandlerFunc(adminUpdatePlan)))
+	mux.Delete("/admin/plans/:key", middlewareAdmin(http.HandlerFunc(adminRetirePlan)))
+	mux.Get("/admin/plans/:key/features", middlewareAdmin(http.HandlerFunc(adminGetPlanFeatures)))
+	mux.Put("/admin/plans/:key/features", middlewareAdmin(http.HandlerFunc(adminSetPlanFeatures)))
+	mux.Get("/admin/plans/:key/addons", middlewareAdmin(http.HandlerFunc(adminGetPlanAddOns)))
+	mux.Put("/admin/plans/:key/addons", middlewareAdmin(http.HandlerFunc(adminSetPlanAddOns)))
+	mux.Put("/admin/organization/:id/coupon", middlewareAdmin(middlewareGetID(http.HandlerFunc(adminSetOrgCoupon))))
+	mux.Delete("/admin/organization/:id/coupon", middlewareAdmin(middlewareGetID(http.HandlerFunc(adminDeleteOrgCoupon))))
+	mux.Post("/admin/events/replay", middlewareAdmin(http.HandlerFunc(adminReplayEvents)))
+	mux.Post("/admin/keys/rotate", middlewareAdmin(http.HandlerFunc(adminRotateSigningKey)))
+
+	if fake, ok := stripeAPI.(*fakeStripeClient); ok {
+		fake.fakeRoutes(mux)
+	}
+	return mux
+}
+
 func middlewareGetID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id := bone.GetValue(r, "id")
@@ -123,7 +235,7 @@ func middlewareGetID(next http.Handler) http.Handler {
 			http.Error(w, "id is missing path", http.StatusBadRequest)
 			return
 		}
-		org, err := getOrganization(id)
+		org, err := store.GetOrganization(id)
 		if err != nil {
 			switch {
 			case err == sql.ErrNoRows:
@@ -139,6 +251,24 @@ func middlewareGetID(next http.Handler) http.Handler {
 	})
 }
 
+// middlewareAdmin only lets through requests carrying the ADMIN_TOKEN as a
+// bearer token. Admin routes are disabled when ADMIN_TOKEN is not set.
+func middlewareAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			http.Error(w, "admin api is disabled", http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func middlelwareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -147,21 +277,6 @@ func middlelwareCors(next http.Handler) http.Handler {
 	})
 }
 
-func getPlans(w http.ResponseWriter, r *http.Request) {
-	var plansPrice []*stripe.Price
-	for planKeyName, planPriceID := range subPlans {
-		pr, err := getPrice(planPriceID)
-		if err != nil {
-			http.Error(w, "Failed to get plan "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		pr.Nickname = planKeyName
-		plansPrice = append(plansPrice, pr)
-	}
-
-	writeJSON(w, plansPrice)
-}
-
 func getConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -175,22 +290,7 @@ func getConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func getAllOrg(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Queryx("SELECT * FROM  organization")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var orgs []Organization
-	for rows.Next() {
-		var o Organization
-		err := rows.StructScan(&o)
-		if err != nil {
-			log.Fatal(err)
-		}
-		orgs = append(orgs, o)
-	}
+	orgs, err := store.ListOrganizations()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -213,7 +313,7 @@ func handleCreateOrg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := checkOrganization(req.Name, req.Email)
+	_, err := store.CheckOrganization(req.Name, req.Email)
 	if err != sql.ErrNoRows {
 		if err != nil {
 			http.Error(w, "Organization already exists or any other error : "+err.Error(), http.StatusForbidden)
@@ -222,22 +322,33 @@ func handleCreateOrg(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Organization already exists", http.StatusForbidden)
 		return
 	}
+	// Another organization may already use the name or the email, checked
+	// before the customer is created in Stripe.
+	other, err := store.GetOrganizationByNameOrEmail(req.Name, req.Email)
+	if err != sql.ErrNoRows {
+		if err != nil {
+			http.Error(w, "failed to check organization "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, fmt.Sprintf("name or email already used by organization %d", other.ID), http.StatusConflict)
+		return
+	}
 
 	params := &stripe.CustomerParams{
 		Email: stripe.String(req.Email),
 		Name:  stripe.String(req.Name),
 	}
 
-	c, err := customer.New(params)
+	c, err := stripeAPI.NewCustomer(params)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Printf("customer.New: %v", err)
 		return
 	}
 
-	query := "INSERT INTO `organization` (`name`, `email`, `stripe_id`) VALUES (?, ?, ?)"
-	if _, err := db.ExecContext(context.Background(), query, req.Name, req.Email, c.ID); err != nil {
+	if err := store.CreateOrganization(req.Name, req.Email, c.ID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	writeJSON(w, "")
 }
@@ -253,20 +364,16 @@ func retrievePaymentMethod(w http.ResponseWriter, r *http.Request) {
 	params := &stripe.PaymentMethodListParams{
 		Customer: stripe.String(organization.StripeID),
 	}
-	i := paymentmethod.List(params)
-	if i.Err() != nil {
-		http.Error(w, i.Err().Error(), http.StatusInternalServerError)
+	pms, err := stripeAPI.ListPaymentMethods(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !i.Next() {
+	if len(pms) == 0 {
 		http.Error(w, "", http.StatusNotFound)
 		return
 	}
-	for i.Next() {
-		pm := i.PaymentMethod()
-		fmt.Println(pm)
-		writeJSON(w, pm)
-	}
+	writeJSON(w, pms)
 }
 
 func handleCreatePaymentMethod(w http.ResponseWriter, r *http.Request) {
@@ -287,9 +394,10 @@ func getSubscriptionInfo(w http.ResponseWriter, r *http.Request) {
 	case (subId != ""):
 		subscriptionParams := &stripe.SubscriptionParams{}
 		subscriptionParams.AddExpand("latest_invoice.payment_intent")
-		s, err := sub.Get(subId, subscriptionParams)
+		subscriptionParams.AddExpand("discount.promotion_code")
+		s, err := stripeAPI.GetSubscription(subId, subscriptionParams)
 		switch {
-		case strings.Contains(err.Error(), "resource_missing"):
+		case err != nil && strings.Contains(err.Error(), "resource_missing"):
 			http.Error(w, "subscription already canceled, still if your are seeing this subscription , please cancel it again", http.StatusUnprocessableEntity)
 			return
 		case err != nil:
@@ -303,27 +411,22 @@ func getSubscriptionInfo(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "failed to updated subscriptions in platform : "+err.Error(), http.StatusUnprocessableEntity)
 				return
 			}
+			touchSubEventAt(organization.ID, s.ID)
 		}
-		var cs string = ""
-		if (s.LatestInvoice.PaymentIntent != nil) && (s.LatestInvoice.PaymentIntent.ClientSecret != "") {
-			cs = s.LatestInvoice.PaymentIntent.ClientSecret
+		res := newSubscriptionResult(s)
+		if res.TrialWillEndAt, err = pendingTrialEnd(*s); err != nil {
+			http.Error(w, "failed to get the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		writeJSON(w, struct {
-			SubscriptionID     string `json:"subscriptionId"`
-			SubscriptionStatus string `json:"subscriptionStatus"`
-			ClientSecret       string `json:"clientSecret"`
-		}{
-			SubscriptionID:     s.ID,
-			SubscriptionStatus: string(s.Status),
-			ClientSecret:       cs,
-		})
+		writeJSON(w, res)
 
 	default:
 		custParams := &stripe.CustomerParams{}
 		custParams.AddExpand("subscriptions.data")
 		custParams.AddExpand("subscriptions.data.items.data")
 		custParams.AddExpand("subscriptions.data.latest_invoice.payment_intent")
-		ch, err := customer.Get(organization.StripeID, custParams)
+		custParams.AddExpand("subscriptions.data.discount.promotion_code")
+		ch, err := stripeAPI.GetCustomer(organization.StripeID, custParams)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
@@ -331,33 +434,21 @@ func getSubscriptionInfo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		switch len(ch.Subscriptions.Data) {
-		case 0:
+		if len(ch.Subscriptions.Data) == 0 {
 			http.Error(w, "no subscriptions found", http.StatusNotFound)
 			return
-		case 1:
-			s := ch.Subscriptions.Data[0]
+		}
+		// The oldest subscription becomes the primary one.
+		subs := ch.Subscriptions.Data
+		sort.Slice(subs, func(i, j int) bool { return subs[i].Created < subs[j].Created })
+		for _, s := range subs {
 			if err := createSub(*s); err != nil {
 				http.Error(w, "failed to updated subscriptions in platform : "+err.Error(), http.StatusUnprocessableEntity)
 				return
 			}
-			var cs string = ""
-			if (s.LatestInvoice.PaymentIntent != nil) && (s.LatestInvoice.PaymentIntent.ClientSecret != "") {
-				cs = s.LatestInvoice.PaymentIntent.ClientSecret
-			}
-			writeJSON(w, struct {
-				SubscriptionID     string `json:"subscriptionId"`
-				SubscriptionStatus string `json:"subscriptionStatus"`
-				ClientSecret       string `json:"clientSecret"`
-			}{
-				SubscriptionID:     s.ID,
-				SubscriptionStatus: string(s.Status),
-				ClientSecret:       cs,
-			})
-		default:
-			http.Error(w, "organization have more than one subscription , Please contact Platform support", http.StatusUnprocessableEntity)
-			return
+			touchSubEventAt(organization.ID, s.ID)
 		}
+		writeJSON(w, newSubscriptionResult(subs[0]))
 	}
 
 }
@@ -374,131 +465,14 @@ func createSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Plan string `json:"plan"`
-	}
+	var req subscribeRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
-	items := getSubItemsPrice(req.Plan)
-
-	if items == nil {
-		http.Error(w, "Invalid plan :"+req.Plan, http.StatusUnprocessableEntity)
-		return
-	}
-
-	// Automatically save the payment method to the subscription
-	// when the first payment is successful.
-	paymentSettings := &stripe.SubscriptionPaymentSettingsParams{
-		SaveDefaultPaymentMethod: stripe.String("on_subscription"),
-	}
-
-	subscriptionParams := &stripe.SubscriptionParams{
-		Customer:        stripe.String(organization.StripeID),
-		Items:           items,
-		PaymentSettings: paymentSettings,
-		PaymentBehavior: stripe.String("default_incomplete"),
-	}
-	subscriptionParams.AddExpand("latest_invoice.payment_intent")
-
-	s, err := sub.New(subscriptionParams)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-		log.Printf("sub.New: %v", err)
-		return
-	}
-
-	if err := createSubForOrg(*s, organization.ID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	var clientSecret string
-	if (s.LatestInvoice.PaymentIntent != nil) && (s.LatestInvoice.PaymentIntent.ClientSecret != "") {
-		clientSecret = s.LatestInvoice.PaymentIntent.ClientSecret
-	}
-	writeJSON(w, struct {
-		SubscriptionID     string `json:"subscriptionId"`
-		SubscriptionStatus string `json:"subscriptionStatus"`
-		ClientSecret       string `json:"clientSecret"`
-	}{
-		SubscriptionID:     s.ID,
-		SubscriptionStatus: string(s.Status),
-		ClientSecret:       clientSecret,
-	})
-}
-
-func cancelSubscription(w http.ResponseWriter, r *http.Request) {
-	org := r.Context().Value(ctxOrgKey)
-	organization, ok := org.(Organization)
-	if !ok {
-		http.Error(w, "invalid organization context", http.StatusInternalServerError)
-		return
-	}
-
-	s, err := sub.Cancel(organization.StripeSubID, nil)
-
-	if err != nil {
-		if strings.Contains(err.Error(), "resource_missing") {
-			deleteSubByOrgId(organization.ID)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if err := deleteSub(*s); err != nil {
-		http.Error(w, "Unsubscribe but failed to remove recode "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	writeJSON(w, "")
-}
-
-func handleRetrieveUpcomingInvoice(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		SubscriptionID string `json:"subscriptionId,omitempty"`
-		CustomerID     string `json:"customerId,omitempty"`
-		NewPriceID     string `json:"newPriceId"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("json.NewDecoder.Decode: %v", err)
-		return
-	}
-
-	s, err := sub.Get(req.SubscriptionID, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("sub.Get: %v", err)
-		return
-	}
-
-	params := &stripe.InvoiceUpcomingParams{
-		Customer:     stripe.String(req.CustomerID),
-		Subscription: stripe.String(req.SubscriptionID),
-		SubscriptionItems: []*stripe.SubscriptionItemsParams{{
-			ID:         stripe.String(s.Items.Data[0].ID),
-			Deleted:    stripe.Bool(true),
-			ClearUsage: stripe.Bool(true),
-		}, {
-			Price:   stripe.String(os.Getenv(req.NewPriceID)),
-			Deleted: stripe.Bool(false),
-		}},
-	}
-	in, err := invoice.Upcoming(params)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("invoice.GetNext: %v", err)
-		return
-	}
-
-	writeJSON(w, in)
+	subscribePlan(w, organization, req)
 }
 
 func updateSubscription(w http.ResponseWriter, r *http.Request) {
@@ -513,75 +487,13 @@ func updateSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Plan string `json:"plan"`
-	}
+	var req planChangeRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
-	s, err := sub.Get(strings.TrimSpace(organization.StripeSubID), nil)
-	if err != nil {
-		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
-		log.Printf("sub.Get: %v", err)
-		return
-	}
-
-	if (s.Items.Data == nil) || (len(s.Items.Data) < 1) {
-		http.Error(w, "no subscription items "+err.Error(), http.StatusInternalServerError)
-		log.Printf("sub.Get: %v", err)
-		return
-	}
-
-	updateItem := updateSubItemPrice(req.Plan, s.Items.Data[0].ID)
-	paymentSettings := &stripe.SubscriptionPaymentSettingsParams{
-		SaveDefaultPaymentMethod: stripe.String("on_subscription"),
-	}
-
-	if updateItem == nil {
-		http.Error(w, "Invalid plan :"+req.Plan, http.StatusUnprocessableEntity)
-		return
-	}
-
-	subscriptionParams := &stripe.SubscriptionParams{
-		CancelAtPeriodEnd: stripe.Bool(false),
-		Items:             []*stripe.SubscriptionItemsParams{updateItem},
-		PaymentSettings:   paymentSettings,
-		PaymentBehavior:   stripe.String("default_incomplete"),
-	}
-
-	// subscriptionParams.AddExpand("latest_invoice.payment_intent")
-
-	// params := &stripe.SubscriptionParams{
-	// 	CancelAtPeriodEnd: stripe.Bool(false),
-	// 	Items: []*stripe.SubscriptionItemsParams{{
-	// 		ID:    stripe.String(s.Items.Data[0].ID),
-	// 		Price: stripe.String(os.Getenv(req.NewPriceID)),
-	// 	}},
-	// }
-
-	updatedSubscription, err := sub.Update(s.ID, subscriptionParams)
-
-	if err != nil {
-		http.Error(w, "Failed to update subscription"+err.Error(), http.StatusInternalServerError)
-		log.Printf("sub.Update: %v", err)
-		return
-	}
-
-	var cs string = ""
-	if updatedSubscription.LatestInvoice.PaymentIntent != nil && updatedSubscription.LatestInvoice.PaymentIntent.ClientSecret != "" {
-		cs = updatedSubscription.LatestInvoice.PaymentIntent.ClientSecret
-	}
-	writeJSON(w, struct {
-		SubscriptionID     string `json:"subscriptionId"`
-		SubscriptionStatus string `json:"subscriptionStatus"`
-		ClientSecret       string `json:"clientSecret"`
-	}{
-		SubscriptionID:     updatedSubscription.ID,
-		SubscriptionStatus: string(updatedSubscription.Status),
-		ClientSecret:       cs,
-	})
+	changeSubscriptionPlan(w, organization, strings.TrimSpace(organization.StripeSubID), req)
 }
 
 func handleRetryInvoice(w http.ResponseWriter, r *http.Request) {
@@ -606,7 +518,7 @@ func handleRetryInvoice(w http.ResponseWriter, r *http.Request) {
 	params := &stripe.PaymentMethodAttachParams{
 		Customer: stripe.String(req.CustomerID),
 	}
-	pm, err := paymentmethod.Attach(
+	pm, err := stripeAPI.AttachPaymentMethod(
 		req.PaymentMethodID,
 		params,
 	)
@@ -623,7 +535,7 @@ func handleRetryInvoice(w http.ResponseWriter, r *http.Request) {
 			DefaultPaymentMethod: stripe.String(pm.ID),
 		},
 	}
-	c, err := customer.Update(
+	c, err := stripeAPI.UpdateCustomer(
 		req.CustomerID,
 		customerParams,
 	)
@@ -637,7 +549,7 @@ func handleRetryInvoice(w http.ResponseWriter, r *http.Request) {
 	// Retrieve Invoice
 	invoiceParams := &stripe.InvoiceParams{}
 	invoiceParams.AddExpand("payment_intent")
-	in, err := invoice.Get(
+	in, err := stripeAPI.GetInvoice(
 		req.InvoiceID,
 		invoiceParams,
 	)
@@ -651,100 +563,6 @@ func handleRetryInvoice(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, in)
 }
 
-func handleWebhook(w http.ResponseWriter, r *http.Request) {
-	b, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Printf("ioutil.ReadAll: %v", err)
-		return
-	}
-
-	event, err := webhook.ConstructEvent(b, r.Header.Get("Stripe-Signature"), os.Getenv("STRIPE_WEBHOOK_SECRET"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Printf("webhook.ConstructEvent: %v", err)
-		return
-	}
-
-	switch event.Type {
-	case "checkout.session.completed":
-		cust, err := customer.Get(event.GetObjectValue("customer"), nil)
-		if err != nil {
-			log.Printf("customer.Get: %v", err)
-			return
-		}
-
-		if event.GetObjectValue("display_items", "0", "custom") != "" &&
-			event.GetObjectValue("display_items", "0", "custom", "name") == "Pasha e-book" {
-			fmt.Printf("🔔 Customer is subscribed and bought an e-book! Send the e-book to %s\n\n", cust.Email)
-		} else {
-			fmt.Printf("🔔 Customer is subscribed but did not buy an e-book.\n\n")
-		}
-	case "customer.subscription.updated",
-		"customer.subscription.created",
-		"customer.subscription.deleted",
-		"customer.subscription.paused",
-		"customer.subscription.pending_update_applied",
-		"customer.subscription.pending_update_expired",
-		"customer.subscription.resumed",
-		"customer.subscription.trial_will_end":
-
-		subBytes, err := json.Marshal(event.Data.Object)
-		if err != nil {
-			errS := fmt.Sprintf(`{ "message" : "Failed to marshal event.Data.Object",  "error" : "%s", "inputdata" :"%+v" }`, err.Error(), event.Data.Object)
-			fmt.Println(errS)
-			// http.Error(w, errS, http.StatusInternalServerError)
-			return
-		}
-		var sub stripe.Subscription
-
-		if err := json.Unmarshal(subBytes, &sub); err != nil {
-			errS := fmt.Sprintf(`{ "message" : "Failed to unmarshal subBytes",  "error" : "%s", "inputdata" : "%v" `, err.Error(), subBytes)
-			fmt.Println(errS)
-			// http.Error(w, errS, http.StatusInternalServerError)
-			return
-		}
-		fmt.Println(event.Type)
-		fmt.Println(sub)
-		switch event.Type {
-		case
-			"customer.subscription.created":
-			if err := createSub(sub); err != nil {
-				fmt.Println(err.Error())
-				return
-			}
-		case
-			"customer.subscription.updated",
-			"customer.subscription.paused",
-			"customer.subscription.pending_update_applied",
-			"customer.subscription.pending_update_expired",
-			"customer.subscription.resumed",
-			"customer.subscription.trial_will_end":
-			switch sub.Status {
-			// case "incomplete_expired":
-			// 	if err := deleteSub(sub); err != nil {
-			// 		fmt.Println(err.Error())
-			// 		return
-			// 	}
-			default:
-				if err := updateSub(sub); err != nil {
-					fmt.Println(err.Error())
-					return
-				}
-			}
-		case "customer.subscription.deleted":
-			if err := deleteSub(sub); err != nil {
-				fmt.Println(err.Error())
-				return
-			}
-		}
-	default:
-		// fmt.Printf("Got Unhandled event event type : %s , \n request body %+v\n\n========\n\n", event.Type, event)
-	}
-
-}
-
 func writeJSON(w http.ResponseWriter, v interface{}) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(v); err != nil {
@@ -759,219 +577,35 @@ func writeJSON(w http.ResponseWriter, v interface{}) {
 	}
 }
 
-func getOrganization(id string) (Organization, error) {
-	var org Organization
-	err := db.Get(&org, fmt.Sprintf("SELECT * FROM  organization WHERE id=$1"), id)
-	_ = json.Unmarshal(org.PlansByte, &org.Plans)
-	return org, err
-}
-
-func checkOrganization(name, email string) (Organization, error) {
-	var org Organization
-	err := db.Get(&org, "SELECT * FROM  organization WHERE name=$1 and email=$2 LIMIT 1 ", name, email)
-	return org, err
+// touchSubEventAt is used after writing a subscription state fetched from
+// Stripe by the API itself, so that events created before are seen as stale.
+func touchSubEventAt(orgID int, subID string) {
+	if _, err := store.AdvanceSubEventAt(orgID, subID, time.Now().Unix()); err != nil {
+		log.Printf("AdvanceSubEventAt: %v", err)
+	}
 }
 
 func updateSubItemPrice(planName string, subItemID string) *stripe.SubscriptionItemsParams {
-	if priceId, ok := subPlans[planName]; ok {
-		return &stripe.SubscriptionItemsParams{ID: &subItemID, Price: stripe.String(priceId)}
+	if cp, ok := getSubscribablePlan(planName); ok {
+		return &stripe.SubscriptionItemsParams{ID: &subItemID, Price: stripe.String(cp.PriceID)}
 	}
 	return nil
 }
 
 func getSubItemsPrice(planName string) []*stripe.SubscriptionItemsParams {
-	if priceId, ok := subPlans[planName]; ok {
+	if cp, ok := getSubscribablePlan(planName); ok {
 		var sip []*stripe.SubscriptionItemsParams
-		sip = append(sip, &stripe.SubscriptionItemsParams{Price: stripe.String(priceId)})
+		sip = append(sip, &stripe.SubscriptionItemsParams{Price: stripe.String(cp.PriceID)})
 		return sip
 	}
 	return nil
 }
 
-func createSub(sub stripe.Subscription) error {
-	query := `
-	UPDATE organization
-	SET
-		stripe_sub = ?,
-		sub_status = ?,
-		plans = ?
-	WHERE
-		stripe_id = ? ;
-	`
-	var plans []Plan
-	for _, item := range sub.Items.Data {
-		prod := Product{
-			ID: item.Plan.Product.ID,
-		}
-		params := &stripe.ProductParams{}
-		result, err := product.Get(item.Plan.Product.ID, params)
-		if err == nil {
-			prod.Name = result.Name
-			prod.Active = result.Active
-			prod.Description = result.Description
-		}
-
-		plan := Plan{
-			ID:       item.Plan.ID,
-			SiID:     item.ID,
-			SubID:    item.Subscription,
-			Active:   item.Plan.Active,
-			Quantity: item.Quantity,
-			Product:  prod,
-		}
-
-		plans = append(plans, plan)
-	}
-	plansByte, err := json.Marshal(plans)
-	if err != nil {
-		errS := fmt.Errorf(`{ "message" : "Failed to marshal plans",  "error" : "%s", "inputdata" : "%v" `, err.Error(), plans)
-		fmt.Println(errS)
-		return errS
-	}
-
-	if _, err := db.ExecContext(context.Background(), query, sub.ID, sub.Status, plansByte, sub.Customer.ID); err != nil {
-		return err
-	}
-	return nil
-}
-
-func updateSub(sub stripe.Subscription) error {
-	query := `
-	UPDATE organization
-	SET
-		stripe_sub = ?,
-		sub_status = ?,
-		plans = ?
-	WHERE
-		stripe_id = ? AND stripe_sub = ?;
-	`
-	var plans []Plan
-	for _, item := range sub.Items.Data {
-		prod := Product{
-			ID: item.Plan.Product.ID,
-		}
-		params := &stripe.ProductParams{}
-		result, err := product.Get(item.Plan.Product.ID, params)
-		if err == nil {
-			prod.Name = result.Name
-			prod.Active = result.Active
-			prod.Description = result.Description
-		}
-
-		plan := Plan{
-			ID:       item.Plan.ID,
-			SiID:     item.ID,
-			SubID:    item.Subscription,
-			Active:   item.Plan.Active,
-			Quantity: item.Quantity,
-			Product:  prod,
-		}
-
-		plans = append(plans, plan)
-	}
-	plansByte, err := json.Marshal(plans)
-	if err != nil {
-		errS := fmt.Errorf(`{ "message" : "Failed to marshal plans",  "error" : "%s", "inputdata" : "%v" `, err.Error(), plans)
-		fmt.Println(errS)
-		return errS
-	}
-
-	if _, err := db.ExecContext(context.Background(), query, sub.ID, sub.Status, plansByte, sub.Customer.ID, sub.ID); err != nil {
-		return err
-	}
-	return nil
-}
-
-func createSubForOrg(sub stripe.Subscription, orgID int) error {
-	query := `
-	UPDATE organization
-	SET
-		stripe_sub = ?,
-		sub_status = ?,
-		plans = ?
-	WHERE
-		id = ? ;
-	`
-
-	plans := getSubPlans(sub)
-	plansByte, err := json.Marshal(plans)
-	if err != nil {
-		errS := fmt.Errorf(`{ "message" : "Failed to marshal plans",  "error" : "%s", "inputdata" : "%v" `, err.Error(), plans)
-		fmt.Println(errS)
-		return errS
-	}
-	if _, err := db.ExecContext(context.Background(), query, sub.ID, sub.Status, plansByte, orgID); err != nil {
-		return err
-	}
-	return nil
-}
-
-func deleteSub(sub stripe.Subscription) error {
-	query := `
-	UPDATE organization
-	SET
-		stripe_sub = '',
-		sub_status = '',
-		plans = NULL
-	WHERE
-		stripe_sub = ? ;
-	`
-	if _, err := db.ExecContext(context.Background(), query, sub.ID); err != nil {
-		return err
-	}
-	return nil
-}
-
-func deleteSubByOrgId(orgId int) error {
-	query := `
-	UPDATE organization
-	SET
-		stripe_sub = '',
-		sub_status = '',
-		plans = NULL
-	WHERE
-		id = ? ;
-	`
-	if _, err := db.ExecContext(context.Background(), query, orgId); err != nil {
-		return err
-	}
-	return nil
-}
-
-func getSubPlans(sub stripe.Subscription) []Plan {
-	var plans []Plan
-	for _, item := range sub.Items.Data {
-		prod := Product{
-			ID: item.Plan.Product.ID,
-		}
-		params := &stripe.ProductParams{}
-		result, err := product.Get(item.Plan.Product.ID, params)
-		if err == nil {
-			prod.Name = result.Name
-			prod.Active = result.Active
-			prod.Description = result.Description
-		}
-
-		plan := Plan{
-			ID:       item.Plan.ID,
-			SiID:     item.ID,
-			SubID:    item.Subscription,
-			Active:   item.Plan.Active,
-			Quantity: item.Quantity,
-			Amount:   item.Plan.Amount,
-			Product:  prod,
-		}
-
-		plans = append(plans, plan)
-	}
-	return plans
-}
-
 func getPrice(id string) (*stripe.Price, error) {
-	pr, err := price.Get(id, nil)
+	pr, err := stripeAPI.GetPrice(id, nil)
 	if err != nil {
 		return pr, err
 	}
-	pr.Product, err = product.Get(pr.Product.ID, nil)
+	pr.Product, err = stripeAPI.GetProduct(pr.Product.ID, nil)
 	return pr, err
 }
@@ -0,0 +1,2245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"autha-stripe/entitlements"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+// The tests run the router against a throwaway SQLite database and the
+// in-memory fake of Stripe, which keeps the state of customers, subscriptions
+// and invoices. stripe-mock answers with fixtures that do not depend on the
+// request, the tests selecting it only check that Stripe accepts the shape of
+// the requests. They are skipped unless it is reachable, started with:
+//
+//	docker run --rm -p 12111:12111 stripe/stripe-mock
+//
+// STRIPE_MOCK_URL overrides its address.
+
+const (
+	testWebhookSecret = "whsec_test_secret"
+	testAdminToken    = "admin_test_token"
+)
+
+var testEventSeq int64
+
+// testBackend is the Stripe a test server talks to.
+type testBackend int
+
+const (
+	fakeStripe testBackend = iota
+	stripeMock
+)
+
+type testServer struct {
+	*httptest.Server
+	t *testing.T
+	// fake is nil when running against stripe-mock.
+	fake *fakeStripeClient
+}
+
+func newTestServer(t *testing.T, backend testBackend) *testServer {
+	t.Helper()
+
+	url, ok := "", false
+	if backend == stripeMock {
+		if url, ok = stripeMockURL(); !ok {
+			t.Skip("stripe-mock is not reachable")
+		}
+	}
+	prevAPI := stripeAPI
+	openTestStore(t)
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testServer{t: t}
+	if backend == stripeMock {
+		stripe.Key = "sk_test_123"
+		stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+			URL:           stripe.String(url),
+			LeveledLogger: &stripe.LeveledLogger{Level: stripe.LevelError},
+		}))
+		stripeAPI = liveStripeClient{}
+	} else {
+		ts.fake = newFakeStripeClient()
+		if err := seedFakeStripe(ts.fake); err != nil {
+			t.Fatal(err)
+		}
+		stripeAPI = ts.fake
+	}
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+
+	ts.Server = httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		stripeAPI = prevAPI
+	})
+	return ts
+}
+
+// openTestStore makes a throwaway SQLite database the store. With
+// TEST_DATABASE_URL the tests run against that PostgreSQL database instead,
+// every migration is reverted after each test.
+func openTestStore(t *testing.T) {
+	t.Helper()
+
+	prevStore, prevDB := store, db
+	var err error
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn != "" {
+		store, err = newPostgresStore(dsn)
+	} else {
+		store, err = newSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = store.DB()
+	t.Cleanup(func() {
+		if dsn != "" {
+			if _, err := migrateDown(0); err != nil {
+				t.Error(err)
+			}
+			if _, err := db.Exec("DROP TABLE schema_migrations"); err != nil {
+				t.Error(err)
+			}
+		}
+		db.Close()
+		store, db = prevStore, prevDB
+	})
+}
+
+// stripeMockURL returns the address of stripe-mock if it is reachable.
+func stripeMockURL() (string, bool) {
+	url := os.Getenv("STRIPE_MOCK_URL")
+	if url == "" {
+		url = "http://localhost:12111"
+	}
+	client := http.Client{Timeout: 500 * time.Millisecond}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", false
+	}
+	resp.Body.Close()
+	return url, true
+}
+
+func (ts *testServer) do(method, path string, body interface{}) (int, []byte) {
+	ts.t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp.StatusCode, b
+}
+
+// expect does the request, checks its status and decodes the response into
+// v when it is not nil.
+func (ts *testServer) expect(status int, method, path string, body, v interface{}) {
+	ts.t.Helper()
+
+	code, b := ts.do(method, path, body)
+	if code != status {
+		ts.t.Fatalf("%s %s : got status %d, want %d : %s", method, path, code, status, b)
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			ts.t.Fatalf("%s %s : failed to decode %s : %v", method, path, b, err)
+		}
+	}
+}
+
+// expectAdmin is expect with the admin token, which it enables.
+func (ts *testServer) expectAdmin(status int, method, path string, body, v interface{}) {
+	ts.t.Helper()
+
+	ts.t.Setenv("ADMIN_TOKEN", testAdminToken)
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		ts.t.Fatalf("%s %s : got status %d, want %d : %s", method, path, resp.StatusCode, status, b)
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			ts.t.Fatalf("%s %s : failed to decode %s : %v", method, path, b, err)
+		}
+	}
+}
+
+func (ts *testServer) createOrg(name string) Organization {
+	ts.t.Helper()
+
+	ts.expect(http.StatusOK, http.MethodPost, "/organization/create", map[string]string{"name": name, "email": name + "@example.com"}, nil)
+	var orgs []Organization
+	ts.expect(http.StatusOK, http.MethodGet, "/organization", nil, &orgs)
+	for _, o := range orgs {
+		if o.Name == name {
+			return o
+		}
+	}
+	ts.t.Fatalf("organization %s not found after creation", name)
+	return Organization{}
+}
+
+func (ts *testServer) org(id int) Organization {
+	ts.t.Helper()
+
+	var org Organization
+	ts.expect(http.StatusOK, http.MethodGet, "/organization/"+strconv.Itoa(id), nil, &org)
+	return org
+}
+
+type subscriptionResponse struct {
+	SubscriptionID     string `json:"subscriptionId"`
+	SubscriptionStatus string `json:"subscriptionStatus"`
+	ClientSecret       string `json:"clientSecret"`
+}
+
+func (ts *testServer) subscribe(org Organization, plan string) subscriptionResponse {
+	ts.t.Helper()
+
+	var res subscriptionResponse
+	ts.expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/organization/%d/sub", org.ID), map[string]string{"plan": plan}, &res)
+	if res.SubscriptionID == "" {
+		ts.t.Fatal("subscribe returned no subscription id")
+	}
+	return res
+}
+
+// postEvent delivers a webhook event for obj signed with secret.
+func (ts *testServer) postEvent(eventType string, obj interface{}, created int64, secret string) (string, int) {
+	ts.t.Helper()
+
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	id := fmt.Sprintf("evt_test_%d", atomic.AddInt64(&testEventSeq, 1))
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          id,
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"created":     created,
+		"type":        eventType,
+		"data":        map[string]json.RawMessage{"object": raw},
+	})
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return id, ts.postPayload(payload, secret)
+}
+
+func (ts *testServer) postPayload(payload []byte, secret string) int {
+	ts.t.Helper()
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/stripe/webhook", bytes.NewReader(payload))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	req.Header.Set("Stripe-Signature", signed.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCreateOrganization(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+
+	org := ts.createOrg("acme")
+	if org.StripeID == "" {
+		t.Fatal("organization has no stripe customer")
+	}
+	if got := ts.org(org.ID); got.Email != "acme@example.com" || got.StripeSubID != "" {
+		t.Fatalf("unexpected organization %+v", got)
+	}
+
+	// An organization with both the name and the email is a duplicate, one
+	// using either of them conflicts with it.
+	ts.expect(http.StatusForbidden, http.MethodPost, "/organization/create", map[string]string{"name": "acme", "email": "acme@example.com"}, nil)
+	ts.expect(http.StatusConflict, http.MethodPost, "/organization/create", map[string]string{"name": "acme", "email": "other@example.com"}, nil)
+	ts.expect(http.StatusConflict, http.MethodPost, "/organization/create", map[string]string{"name": "other", "email": "acme@example.com"}, nil)
+	if n := len(ts.fake.customers); n != 1 {
+		t.Fatalf("got %d stripe customers, want 1", n)
+	}
+	ts.expect(http.StatusNotFound, http.MethodGet, "/organization/999", nil, nil)
+}
+
+// TestStripeMockRequests sends the requests of the organization lifecycle to
+// stripe-mock, which rejects the ones Stripe would not accept.
+func TestStripeMockRequests(t *testing.T) {
+	ts := newTestServer(t, stripeMock)
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d", org.ID)
+
+	if _, err := stripeAPI.AttachPaymentMethod("pm_card_visa", &stripe.PaymentMethodAttachParams{Customer: stripe.String(org.StripeID)}); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path+"/payment-method", nil, nil)
+
+	res := ts.subscribe(org, "planA")
+	if got := ts.org(org.ID); got.StripeSubID != res.SubscriptionID {
+		t.Fatalf("organization %+v does not match subscription %+v", got, res)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path+"/sub/preview?plan=planB", nil, nil)
+	ts.expect(http.StatusOK, http.MethodPut, path+"/sub", map[string]string{"plan": "planB"}, nil)
+	ts.expect(http.StatusOK, http.MethodDelete, path+"/sub", nil, nil)
+	ts.expect(http.StatusOK, http.MethodDelete, path+"/sub?mode=immediately", nil, nil)
+	if got := ts.org(org.ID); got.StripeSubID != "" {
+		t.Fatalf("organization still subscribed after cancel : %+v", got)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, fmt.Sprintf("/organization/%d/sub", org.ID), map[string]string{"plan": "nope"}, nil)
+
+	res := ts.subscribe(org, "planA")
+	got := ts.org(org.ID)
+	if got.StripeSubID != res.SubscriptionID || got.SubStatus != res.SubscriptionStatus {
+		t.Fatalf("organization %+v does not match subscription %+v", got, res)
+	}
+	if len(got.Plans) != 1 {
+		t.Fatalf("got %d plans, want 1", len(got.Plans))
+	}
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, fmt.Sprintf("/organization/%d/sub", org.ID), map[string]string{"plan": "planB"}, nil)
+
+	if got.Plans[0].Key != "planA" || res.SubscriptionStatus != "incomplete" || res.ClientSecret == "" {
+		t.Fatalf("unexpected subscription %+v with plans %+v", res, got.Plans)
+	}
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	var info subscriptionResponse
+	ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/sub", org.ID), nil, &info)
+	if info.SubscriptionStatus != "active" || ts.org(org.ID).SubStatus != "active" {
+		t.Fatalf("subscription is %s after payment, want active", info.SubscriptionStatus)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]string{"plan": "nope"}, nil)
+
+	var updated subscriptionResponse
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]string{"plan": "planB"}, &updated)
+	if updated.SubscriptionID != res.SubscriptionID {
+		t.Fatalf("upgrade returned subscription %s, want %s", updated.SubscriptionID, res.SubscriptionID)
+	}
+
+	s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planB, _ := getSubscribablePlan("planB")
+	if len(s.Items.Data) != 1 || s.Items.Data[0].Price.ID != planB.PriceID {
+		t.Fatalf("subscription items %+v, want a single %s item", s.Items.Data, planB.PriceID)
+	}
+}
+
+func TestPlanChangeProration(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	latestInvoice := func() *stripe.Invoice {
+		s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.LatestInvoice
+	}
+	first := latestInvoice()
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]string{"plan": "planB", "proration_behavior": "later"}, nil)
+
+	// Upgrades invoice their prorations right away.
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]string{"plan": "planB"}, nil)
+	upgrade := latestInvoice()
+	if upgrade.ID == first.ID || len(upgrade.Lines.Data) != 2 || !upgrade.Lines.Data[0].Proration || upgrade.AmountDue <= 0 {
+		t.Fatalf("got latest invoice %+v after the upgrade, want its prorations", upgrade)
+	}
+
+	// Downgrades are not refunded.
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]interface{}{"plan": "planA", "at_period_end": false}, nil)
+	if got := latestInvoice(); got.ID != upgrade.ID {
+		t.Fatalf("got invoice %s after the downgrade, want none", got.ID)
+	}
+
+	// A reset billing cycle bills a new period.
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]interface{}{"plan": "planB", "proration_behavior": "none", "reset_billing_cycle": true}, nil)
+	reset := latestInvoice()
+	if reset.ID == upgrade.ID || len(reset.Lines.Data) != 1 || reset.Lines.Data[0].Proration {
+		t.Fatalf("got latest invoice %+v after the reset, want a new period only", reset)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	path := fmt.Sprintf("/organization/%d/sub/preview", org.ID)
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodGet, path, nil, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodGet, path+"?plan=nope", nil, nil)
+	var preview PlanChangePreview
+	ts.expect(http.StatusOK, http.MethodGet, path+"?plan=planB", nil, &preview)
+	if preview.SubscriptionID != res.SubscriptionID {
+		t.Fatalf("previewed subscription %s, want %s", preview.SubscriptionID, res.SubscriptionID)
+	}
+
+	planA, _ := getSubscribablePlan("planA")
+	planB, _ := getSubscribablePlan("planB")
+	prices := map[string]int64{}
+	for _, line := range preview.Lines {
+		if line.Proration {
+			prices[line.PriceID] = line.Amount
+		}
+	}
+	if len(preview.Lines) != 3 || prices[planA.PriceID] >= 0 || prices[planB.PriceID] <= 0 {
+		t.Fatalf("got lines %+v, want planA credited and planB charged", preview.Lines)
+	}
+	// Upgrades are invoiced right away by default.
+	if preview.Direction != planChangeUpgrade || preview.ProrationAmount <= 0 || preview.AmountDueNow != preview.ProrationAmount {
+		t.Fatalf("got preview %+v, want the upgrade prorations due now", preview)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path+"?plan=planB&proration_behavior=create_prorations", nil, &preview)
+	if preview.AmountDueNow != 0 || preview.NextRenewalAmount <= preview.ProrationAmount {
+		t.Fatalf("got preview %+v, want the upgrade prorated on the next renewal", preview)
+	}
+	if got := ts.org(org.ID); len(got.Plans) != 1 || got.Plans[0].Key != "planA" {
+		t.Fatalf("got plans %+v after the preview, want planA", got.Plans)
+	}
+}
+
+func TestScheduledDowngrade(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planB")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	subPath := fmt.Sprintf("/organization/%d/subscriptions/%s", org.ID, res.SubscriptionID)
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+	ts.expect(http.StatusNotFound, http.MethodDelete, path+"/pending", nil, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]interface{}{"plan": "planA", "at_period_end": true, "proration_behavior": "none"}, nil)
+
+	// Downgrades wait for the end of the period.
+	var preview PlanChangePreview
+	ts.expect(http.StatusOK, http.MethodGet, path+"/preview?plan=planA", nil, &preview)
+	if !preview.AtPeriodEnd || preview.AmountDueNow != 0 || preview.ProrationAmount != 0 {
+		t.Fatalf("got preview %+v, want the downgrade at the period end", preview)
+	}
+	var scheduled struct {
+		subscriptionResponse
+		PendingChange *PendingChange `json:"pendingChange"`
+	}
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]string{"plan": "planA"}, &scheduled)
+	var sub Subscription
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, &sub)
+	if scheduled.PendingChange == nil || scheduled.PendingChange.Plan != "planA" || scheduled.PendingChange.EffectiveAt != sub.CurrentPeriodEnd {
+		t.Fatalf("got %+v, want planA pending at %d", scheduled.PendingChange, sub.CurrentPeriodEnd)
+	}
+	if got := ts.org(org.ID); got.PendingChange == nil || got.PendingChange.Plan != "planA" || got.Plans[0].Key != "planB" {
+		t.Fatalf("got organization %+v, want planB with planA pending", got)
+	}
+
+	// The pending change can be canceled until it applies.
+	var canceled Subscription
+	ts.expect(http.StatusOK, http.MethodDelete, path+"/pending", nil, &canceled)
+	if canceled.PendingChange != nil || ts.org(org.ID).PendingChange != nil {
+		t.Fatalf("got subscription %+v, want no pending change", canceled)
+	}
+	if s, _ := stripeAPI.GetSubscription(res.SubscriptionID, nil); s.Schedule != nil {
+		t.Fatalf("subscription still has schedule %s", s.Schedule.ID)
+	}
+
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]string{"plan": "planA"}, nil)
+	if err := ts.fake.RenewSubscription(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+	if got := ts.org(org.ID); got.PendingChange != nil || len(got.Plans) != 1 || got.Plans[0].Key != "planA" {
+		t.Fatalf("got organization %+v after the renewal, want planA", got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodDelete, path+"?mode=later", nil, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodDelete, path+"?refund=true", nil, nil)
+
+	// The subscription is kept until the end of its period by default.
+	var sub Subscription
+	ts.expect(http.StatusOK, http.MethodDelete, path, nil, &sub)
+	if got := ts.org(org.ID); got.StripeSubID != res.SubscriptionID {
+		t.Fatalf("organization %+v lost its subscription before the period end", got)
+	}
+	if !sub.CancelAtPeriodEnd || sub.CancelAt != sub.CurrentPeriodEnd {
+		t.Fatalf("got subscription %+v, want it canceled at the period end", sub)
+	}
+	ts.expect(http.StatusOK, http.MethodPost, path+"/reactivate", nil, &sub)
+	if sub.CancelAtPeriodEnd || sub.CancelAt != 0 {
+		t.Fatalf("got subscription %+v after the reactivation", sub)
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/reactivate", nil, nil)
+
+	ts.expect(http.StatusOK, http.MethodDelete, path+"?mode=immediately", nil, nil)
+	got := ts.org(org.ID)
+	if got.StripeSubID != "" || got.SubStatus != "" || len(got.Plans) != 0 {
+		t.Fatalf("organization still subscribed after cancel : %+v", got)
+	}
+
+	// The organization can subscribe again.
+	ts.subscribe(org, "planB")
+}
+
+func TestCancelAtPeriodEnd(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planB")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	subPath := fmt.Sprintf("/organization/%d/subscriptions/%s", org.ID, res.SubscriptionID)
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+
+	// A cancellation drops the pending downgrade, which can not be scheduled
+	// again until the subscription is reactivated.
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]string{"plan": "planA"}, nil)
+	ts.expect(http.StatusOK, http.MethodDelete, path, nil, nil)
+	if got := ts.org(org.ID); got.PendingChange != nil {
+		t.Fatalf("got pending change %+v after the cancellation", got.PendingChange)
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]string{"plan": "planA"}, nil)
+
+	if err := ts.fake.RenewSubscription(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+	if got := ts.org(org.ID); got.StripeSubID != "" || len(got.Plans) != 0 {
+		t.Fatalf("organization still subscribed after the period end : %+v", got)
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, subPath+"/reactivate", nil, nil)
+
+	// An immediate cancellation refunds the unused time of the period.
+	res = ts.subscribe(org, "planA")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var canceled struct {
+		Subscription
+		RefundedAmount int64 `json:"refunded_amount"`
+	}
+	ts.expect(http.StatusOK, http.MethodDelete, path+"?mode=immediately&refund=true", nil, &canceled)
+	paid := s.LatestInvoice
+	if canceled.Status != "canceled" || canceled.RefundedAmount <= 0 || canceled.RefundedAmount > paid.AmountPaid ||
+		ts.fake.Refunded(paid.PaymentIntent.ID) != canceled.RefundedAmount {
+		t.Fatalf("got %+v, want the unused time of invoice %s refunded", canceled, paid.ID)
+	}
+
+	// The refund is the unused part of what was paid, after the discount.
+	ts.fake.AddCoupon(&stripe.Coupon{ID: "HALF", PercentOff: 50, Duration: stripe.CouponDurationForever, Valid: true})
+	ts.fake.AddPromotionCode(&stripe.PromotionCode{ID: "promo_half", Code: "HALF", Active: true, Coupon: &stripe.Coupon{ID: "HALF"}})
+	started := time.Now().AddDate(0, 0, -15)
+	ts.fake.now = func() time.Time { return started }
+	var half subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]string{"plan": "planA", "promotion_code": "HALF"}, &half)
+	if err := ts.fake.PayLatestInvoice(half.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.fake.now = time.Now
+	if s, err = stripeAPI.GetSubscription(half.SubscriptionID, nil); err != nil {
+		t.Fatal(err)
+	}
+	paid = s.LatestInvoice
+	list := paid.Lines.Data[0].Amount
+	if paid.AmountPaid != list/2 {
+		t.Fatalf("got invoice %s paid %d, want half of %d", paid.ID, paid.AmountPaid, list)
+	}
+	unused := paid.AmountPaid * (s.CurrentPeriodEnd - time.Now().Unix()) / (s.CurrentPeriodEnd - s.CurrentPeriodStart)
+	ts.expect(http.StatusOK, http.MethodDelete, path+"?mode=immediately&refund=true", nil, &canceled)
+	if canceled.RefundedAmount < unused-2 || canceled.RefundedAmount > unused+2 || ts.fake.Refunded(paid.PaymentIntent.ID) != canceled.RefundedAmount {
+		t.Fatalf("got %d refunded, want about %d of the %d paid", canceled.RefundedAmount, unused, paid.AmountPaid)
+	}
+
+	// A failed refund does not hide the cancellation that went through.
+	res = ts.subscribe(org, "planA")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = stripeAPI.GetSubscription(res.SubscriptionID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stripeAPI.NewRefund(&stripe.RefundParams{PaymentIntent: stripe.String(s.LatestInvoice.PaymentIntent.ID)}); err != nil {
+		t.Fatal(err)
+	}
+	var failed struct {
+		Subscription
+		RefundedAmount int64  `json:"refunded_amount"`
+		RefundError    string `json:"refund_error"`
+	}
+	ts.expect(http.StatusOK, http.MethodDelete, path+"?mode=immediately&refund=true", nil, &failed)
+	if failed.Status != "canceled" || failed.RefundedAmount != 0 || failed.RefundError == "" {
+		t.Fatalf("got %+v, want the subscription canceled with the refund error", failed)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	subPath := fmt.Sprintf("/organization/%d/subscriptions/%s", org.ID, res.SubscriptionID)
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/resume", nil, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/pause", map[string]string{"paused_by": "ops", "behavior": "skip"}, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/pause", map[string]string{}, nil)
+
+	var paused Subscription
+	ts.expect(http.StatusOK, http.MethodPost, path+"/pause", map[string]string{"paused_by": "ops"}, &paused)
+	if paused.PauseBehavior != "void" || paused.PausedBy != "ops" || paused.PausedAt == 0 {
+		t.Fatalf("unexpected paused subscription %+v", paused)
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/pause", map[string]string{"paused_by": "ops"}, nil)
+
+	// Who paused it is kept by the following syncs.
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+	got := ts.org(org.ID)
+	if got.Pause == nil || got.Pause.Behavior != "void" || got.Pause.PausedBy != "ops" {
+		t.Fatalf("got pause %+v, want paused by ops", got.Pause)
+	}
+	var ent entitlements.Entitlements
+	ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/entitlements", org.ID), nil, &ent)
+	if !ent.Paused || ent.Access != entitlements.AccessRestricted {
+		t.Fatalf("got entitlements %+v, want paused and restricted", ent)
+	}
+
+	// The renewal is not collected while paused.
+	if err := ts.fake.RenewSubscription(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != stripe.SubscriptionStatusActive || s.LatestInvoice.Status != stripe.InvoiceStatusVoid {
+		t.Fatalf("got status %s and invoice %s, want active with a void invoice", s.Status, s.LatestInvoice.Status)
+	}
+
+	var resumed Subscription
+	ts.expect(http.StatusOK, http.MethodPost, path+"/resume", nil, &resumed)
+	if resumed.PauseBehavior != "" || resumed.PausedBy != "" || ts.org(org.ID).Pause != nil {
+		t.Fatalf("subscription still paused after resuming : %+v", resumed)
+	}
+
+	// A pause with a resume date ends by itself.
+	resumesAt := time.Now().Add(24 * time.Hour).Unix()
+	ts.expect(http.StatusOK, http.MethodPost, subPath+"/pause", map[string]interface{}{
+		"paused_by": "ops", "behavior": "keep_as_draft", "resumes_at": resumesAt,
+	}, nil)
+	if got := ts.org(org.ID); got.Pause == nil || got.Pause.ResumesAt != resumesAt {
+		t.Fatalf("got pause %+v, want resuming at %d", got.Pause, resumesAt)
+	}
+	if err := ts.fake.RenewSubscription(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+	if got := ts.org(org.ID); got.Pause != nil {
+		t.Fatalf("got pause %+v after its resume date", got.Pause)
+	}
+}
+
+func TestTrials(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	cp, err := getCatalogPlan("planA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.TrialDays = 14
+	if err := updateCatalogPlan(cp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trial of the plan needs no payment method, the setup intent
+	// collects one.
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	var res subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]string{"plan": "planA"}, &res)
+	if res.SubscriptionStatus != "trialing" || res.TrialEnd == 0 || !strings.HasPrefix(res.ClientSecret, "seti_") {
+		t.Fatalf("got %+v, want a trial with a setup intent", res)
+	}
+	subPath := fmt.Sprintf("/organization/%d/subscriptions/%s", org.ID, res.SubscriptionID)
+
+	s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	announcedAt := time.Now().Unix()
+	if _, code := ts.postEvent("customer.subscription.trial_will_end", s, announcedAt, testWebhookSecret); code != http.StatusOK {
+		t.Fatalf("trial_will_end answered %d", code)
+	}
+	var sub Subscription
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, &sub)
+	if sub.TrialEnd != res.TrialEnd || sub.TrialEndBehavior != "cancel" || sub.TrialWillEndAt != announcedAt {
+		t.Fatalf("unexpected trial of subscription %+v", sub)
+	}
+
+	// Without a payment method the trial ends with its end behavior.
+	if err := ts.fake.RenewSubscription(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, subPath, nil, nil)
+	if got := ts.org(org.ID); got.StripeSubID != "" {
+		t.Fatalf("organization still subscribed after its trial : %+v", got)
+	}
+
+	other := ts.createOrg("other")
+	path = fmt.Sprintf("/organization/%d/sub", other.ID)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]interface{}{"plan": "planA", "trial_days": -1}, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]interface{}{"plan": "planA", "trial_end_behavior": "skip"}, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]interface{}{"plan": "planA", "trial_days": 0, "trial_end_behavior": "pause"}, nil)
+
+	var paused subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]interface{}{"plan": "planB", "trial_days": 7, "trial_end_behavior": "pause"}, &paused)
+	if paused.SubscriptionStatus != "trialing" || paused.TrialEnd > time.Now().AddDate(0, 0, 8).Unix() {
+		t.Fatalf("got %+v, want a trial of 7 days", paused)
+	}
+	if err := ts.fake.RenewSubscription(paused.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/subscriptions/%s", other.ID, paused.SubscriptionID), nil, nil)
+	if got := ts.org(other.ID); got.SubStatus != "paused" {
+		t.Fatalf("got status %s after the trial, want paused", got.SubStatus)
+	}
+	var ent entitlements.Entitlements
+	ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/entitlements", other.ID), nil, &ent)
+	if !ent.Paused || ent.Access != entitlements.AccessRestricted {
+		t.Fatalf("got entitlements %+v, want paused and restricted", ent)
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/pause", map[string]string{"paused_by": "ops"}, nil)
+
+	// A paused trial resumes once the customer has a payment method.
+	if _, err := stripeAPI.AttachPaymentMethod("pm_card_visa", &stripe.PaymentMethodAttachParams{Customer: stripe.String(other.StripeID)}); err != nil {
+		t.Fatal(err)
+	}
+	var resumed Subscription
+	ts.expect(http.StatusOK, http.MethodPost, path+"/resume", nil, &resumed)
+	if resumed.Status != "active" || ts.org(other.ID).SubStatus != "active" {
+		t.Fatalf("got %+v after resuming, want active", resumed)
+	}
+}
+
+// TestTrialWillEnd delivers the announcement of the end of a trial from the
+// fake to the webhook endpoint.
+func TestTrialWillEnd(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	var res subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]interface{}{"plan": "planA", "trial_days": 7, "trial_end_behavior": "pause"}, &res)
+
+	var info subscriptionResult
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &info)
+	if info.TrialEnd != res.TrialEnd || info.TrialEndBehavior != "pause" || info.TrialWillEndAt != 0 {
+		t.Fatalf("got %+v before the announcement, want a pending trial", info)
+	}
+
+	ts.fake.DeliverWebhooks(ts.URL+"/stripe/webhook", testWebhookSecret)
+	if err := ts.fake.AnnounceTrialEnd(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var announced subscriptionResult
+		ts.expect(http.StatusOK, http.MethodGet, path, nil, &announced)
+		if announced.TrialWillEndAt != 0 {
+			if announced.TrialEnd != res.TrialEnd || announced.TrialEndBehavior != "pause" || announced.SubscriptionStatus != "trialing" {
+				t.Fatalf("got %+v after the announcement", announced)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("trial_will_end was not delivered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ts.fake.AnnounceTrialEnd("sub_missing"); err == nil {
+		t.Fatal("announced the trial end of a missing subscription")
+	}
+}
+
+func TestDiscounts(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	planB, err := stripeAPI.GetPrice("price_1NEDyNSAVJByQTEdrH97Z3B6", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.fake.AddCoupon(&stripe.Coupon{ID: "SPRING", Name: "Spring", PercentOff: 20, Duration: stripe.CouponDurationRepeating, DurationInMonths: 3, Valid: true})
+	ts.fake.AddCoupon(&stripe.Coupon{ID: "PLANB", PercentOff: 50, Duration: stripe.CouponDurationForever, Valid: true,
+		AppliesTo: &stripe.CouponAppliesTo{Products: []string{planB.Product.ID}}})
+	ts.fake.AddCoupon(&stripe.Coupon{ID: "STAFF", AmountOff: 500, Currency: "usd", Duration: stripe.CouponDurationForever, Valid: true})
+	ts.fake.AddPromotionCode(&stripe.PromotionCode{ID: "promo_spring", Code: "SPRING20", Active: true, MaxRedemptions: 1, Coupon: &stripe.Coupon{ID: "SPRING"}})
+	ts.fake.AddPromotionCode(&stripe.PromotionCode{ID: "promo_planb", Code: "PLANBONLY", Active: true, Coupon: &stripe.Coupon{ID: "PLANB"}})
+	ts.fake.AddPromotionCode(&stripe.PromotionCode{ID: "promo_old", Code: "EXPIRED", Active: true, ExpiresAt: time.Now().Add(-time.Hour).Unix(), Coupon: &stripe.Coupon{ID: "SPRING"}})
+
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	var res subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]string{"plan": "planA", "promotion_code": "spring20"}, &res)
+	d := res.Discount
+	if d == nil || d.Coupon != "SPRING" || d.PromotionCode != "SPRING20" || d.PercentOff != 20 || d.End <= time.Now().AddDate(0, 2, 0).Unix() {
+		t.Fatalf("got discount %+v, want 20%% off for 3 months", d)
+	}
+	s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in := s.LatestInvoice; in.Total != in.Lines.Data[0].Amount*80/100 {
+		t.Fatalf("got invoice total %d, want 20%% off %d", in.Total, in.Lines.Data[0].Amount)
+	}
+	var info subscriptionResult
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &info)
+	if info.Discount == nil || info.Discount.End != d.End {
+		t.Fatalf("got discount %+v, want %+v", info.Discount, d)
+	}
+
+	other := ts.createOrg("other")
+	path = fmt.Sprintf("/organization/%d/sub", other.ID)
+	for _, code := range []string{"SPRING20", "PLANBONLY", "EXPIRED", "NOPE"} {
+		ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]string{"plan": "planA", "promotion_code": code}, nil)
+	}
+	ts.subscribe(other, "planA")
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]interface{}{"plan": "planB", "promotion_code": "PLANBONLY", "at_period_end": true}, nil)
+	var changed subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]interface{}{"plan": "planB", "promotion_code": "PLANBONLY"}, &changed)
+	if changed.Discount == nil || changed.Discount.Coupon != "PLANB" {
+		t.Fatalf("got discount %+v, want PLANB", changed.Discount)
+	}
+
+	// Coupons are applied and removed by the admin.
+	coupon := fmt.Sprintf("/admin/organization/%d/coupon", other.ID)
+	ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPut, coupon, map[string]string{"coupon": "NOPE"}, nil)
+	var staff subscriptionResult
+	ts.expectAdmin(http.StatusOK, http.MethodPut, coupon, map[string]string{"coupon": "STAFF"}, &staff)
+	if d := staff.Discount; d == nil || d.Coupon != "STAFF" || d.AmountOff != 500 || d.PromotionCode != "" || d.End != 0 {
+		t.Fatalf("got discount %+v, want STAFF", d)
+	}
+	var removed subscriptionResult
+	ts.expectAdmin(http.StatusOK, http.MethodDelete, coupon, nil, &removed)
+	if removed.Discount != nil {
+		t.Fatalf("got discount %+v after removing it", removed.Discount)
+	}
+	ts.expectAdmin(http.StatusNotFound, http.MethodDelete, coupon, nil, nil)
+
+	t.Run("first time", func(t *testing.T) {
+		ts.fake.AddCoupon(&stripe.Coupon{ID: "WELCOME", PercentOff: 10, Duration: stripe.CouponDurationOnce, Valid: true})
+		ts.fake.AddPromotionCode(&stripe.PromotionCode{ID: "promo_first", Code: "FIRST", Active: true, Coupon: &stripe.Coupon{ID: "WELCOME"},
+			Restrictions: &stripe.PromotionCodeRestrictions{FirstTimeTransaction: true}})
+
+		// The subscription changing plan is not a prior one.
+		fresh := ts.createOrg("fresh")
+		path := fmt.Sprintf("/organization/%d/sub", fresh.ID)
+		res := ts.subscribe(fresh, "planA")
+		var changed subscriptionResult
+		ts.expect(http.StatusOK, http.MethodPut, path, map[string]interface{}{"plan": "planB", "promotion_code": "FIRST"}, &changed)
+		if changed.Discount == nil || changed.Discount.Coupon != "WELCOME" {
+			t.Fatalf("got discount %+v, want WELCOME", changed.Discount)
+		}
+
+		// Once an invoice is paid it is not a first transaction anymore.
+		in := stripe.Invoice{
+			ID:           "in_test_first",
+			Object:       "invoice",
+			Customer:     &stripe.Customer{ID: fresh.StripeID},
+			Subscription: &stripe.Subscription{ID: res.SubscriptionID},
+			Status:       stripe.InvoiceStatusPaid,
+			Currency:     stripe.CurrencyUSD,
+			AmountDue:    2000,
+			AmountPaid:   2000,
+			Created:      time.Now().Unix(),
+		}
+		if _, code := ts.postEvent("invoice.paid", in, time.Now().Unix()+60, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d posting invoice.paid", code)
+		}
+		ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]interface{}{"plan": "planA", "promotion_code": "FIRST"}, nil)
+
+		// Nor after a subscription that was active, even when it ended.
+		path = fmt.Sprintf("/organization/%d/sub", org.ID)
+		if err := ts.fake.PayLatestInvoice(s.ID); err != nil {
+			t.Fatal(err)
+		}
+		ts.expect(http.StatusOK, http.MethodGet, path, nil, nil)
+		if got := ts.org(org.ID); got.SubStatus != "active" {
+			t.Fatalf("got status %s after the payment, want active", got.SubStatus)
+		}
+		ts.expect(http.StatusOK, http.MethodDelete, path+"?mode=immediately", nil, nil)
+		ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]string{"plan": "planA", "promotion_code": "FIRST"}, nil)
+
+		newcomer := ts.createOrg("newcomer")
+		var first subscriptionResult
+		ts.expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/organization/%d/sub", newcomer.ID), map[string]string{"plan": "planA", "promotion_code": "FIRST"}, &first)
+		if first.Discount == nil || first.Discount.Coupon != "WELCOME" {
+			t.Fatalf("got discount %+v, want WELCOME", first.Discount)
+		}
+	})
+}
+
+func TestSubscriptions(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	other := ts.createOrg("other")
+	path := fmt.Sprintf("/organization/%d/subscriptions", org.ID)
+
+	primary := ts.subscribe(org, "planA")
+	var addOn subscriptionResponse
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]string{"plan": "planB"}, &addOn)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]string{"plan": "planA"}, nil)
+	if got := ts.org(org.ID); got.StripeSubID != primary.SubscriptionID {
+		t.Fatalf("primary subscription is %s, want %s", got.StripeSubID, primary.SubscriptionID)
+	}
+
+	var subs []Subscription
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &subs)
+	if len(subs) != 2 || !subs[0].Primary || subs[1].Primary || subs[1].ID != addOn.SubscriptionID {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+	var sub Subscription
+	ts.expect(http.StatusOK, http.MethodGet, path+"/"+addOn.SubscriptionID, nil, &sub)
+	if len(sub.Items) != 1 || sub.Items[0].PlanKey != "planB" || sub.CurrentPeriodEnd == 0 {
+		t.Fatalf("unexpected subscription %+v", sub)
+	}
+	ts.expect(http.StatusNotFound, http.MethodGet, fmt.Sprintf("/organization/%d/subscriptions/%s", other.ID, addOn.SubscriptionID), nil, nil)
+	ts.expect(http.StatusNotFound, http.MethodDelete, fmt.Sprintf("/organization/%d/subscriptions/%s", other.ID, addOn.SubscriptionID), nil, nil)
+
+	// Cancelling the primary subscription promotes the add-on.
+	ts.expect(http.StatusOK, http.MethodDelete, path+"/"+primary.SubscriptionID+"?mode=immediately", nil, nil)
+	got := ts.org(org.ID)
+	if got.StripeSubID != addOn.SubscriptionID || len(got.Plans) != 1 || got.Plans[0].Key != "planB" {
+		t.Fatalf("organization %+v after cancelling its primary subscription", got)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &subs)
+	if len(subs) != 1 {
+		t.Fatalf("got %d running subscriptions, want 1", len(subs))
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path+"?all=true", nil, &subs)
+	if len(subs) != 2 || subs[0].Status != "canceled" {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+}
+
+func TestAddOns(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	for _, key := range []string{"storage", "support"} {
+		addOn := CatalogPlan{Key: key, Kind: catalogKindAddOn, PriceID: "price_" + key, Name: key, Interval: "month", Currency: "usd", Visible: true}
+		if err := createCatalogPlan(addOn); err != nil {
+			t.Fatal(err)
+		}
+		addOn.Active = true
+		addOn.UnitAmount = 500
+		addOn.ProductID = "prod_" + key
+		ts.fake.AddPrice(addOn.Price())
+	}
+	if err := replacePlanAddOns("planA", []PlanAddOn{{AddOnKey: "storage", MaxQuantity: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	addOns := []addOnRequest{{AddOn: "storage", Quantity: 2}}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, map[string]interface{}{"plan": "planA", "addons": []addOnRequest{{AddOn: "support"}}}, nil)
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]interface{}{"plan": "planA", "addons": addOns}, nil)
+	if got := ts.org(org.ID); len(got.Plans) != 2 {
+		t.Fatalf("got plans %+v, want planA and storage", got.Plans)
+	}
+
+	ts.expect(http.StatusConflict, http.MethodPost, path+"/addons", addOnRequest{AddOn: "storage"}, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/addons", addOnRequest{AddOn: "support"}, nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path+"/addons/storage", addOnRequest{Quantity: 6}, nil)
+	ts.expect(http.StatusNotFound, http.MethodPut, path+"/addons/support", addOnRequest{Quantity: 1}, nil)
+
+	var sub Subscription
+	ts.expect(http.StatusOK, http.MethodPut, path+"/addons/storage", addOnRequest{Quantity: 3}, &sub)
+	quantities := map[string]int64{}
+	for _, item := range sub.Items {
+		quantities[item.PlanKey] = item.Quantity
+	}
+	if len(quantities) != 2 || quantities["storage"] != 3 || quantities["planA"] != 1 {
+		t.Fatalf("got item quantities %v, want planA 1 and storage 3", quantities)
+	}
+
+	// planB does not allow the storage add-on.
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path, map[string]string{"plan": "planB"}, nil)
+	ts.expect(http.StatusOK, http.MethodDelete, path+"/addons/storage", nil, &sub)
+	if len(sub.Items) != 1 {
+		t.Fatalf("got %d items after removing the add-on, want 1", len(sub.Items))
+	}
+	ts.expect(http.StatusOK, http.MethodPut, path, map[string]string{"plan": "planB"}, nil)
+	if got := ts.org(org.ID); len(got.Plans) != 1 || got.Plans[0].Key != "planB" {
+		t.Fatalf("got plans %+v, want planB", got.Plans)
+	}
+}
+
+func TestSeats(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	cp, err := getCatalogPlan("planA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.MaxSeats = 3
+	if err := updateCatalogPlan(cp); err != nil {
+		t.Fatal(err)
+	}
+
+	org := ts.createOrg("acme")
+	ts.subscribe(org, "planA")
+	path := fmt.Sprintf("/organization/%d", org.ID)
+	member := func(email string) map[string]string { return map[string]string{"email": email} }
+
+	ts.expect(http.StatusOK, http.MethodPost, path+"/members", member("a@example.com"), nil)
+	ts.expect(http.StatusConflict, http.MethodPost, path+"/members", member("a@example.com"), nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/members", member("b@example.com"), nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, path+"/seats", map[string]int64{"seats": 4}, nil)
+	var seats Seats
+	ts.expect(http.StatusOK, http.MethodPut, path+"/seats", map[string]int64{"seats": 2}, &seats)
+	if seats.Seats != 2 || seats.Members != 1 {
+		t.Fatalf("got seats %+v, want 2 seats for 1 member", seats)
+	}
+	ts.expect(http.StatusOK, http.MethodPost, path+"/members", member("b@example.com"), nil)
+
+	// With seat sync the seats follow the members up to the plan maximum.
+	ts.expect(http.StatusOK, http.MethodPut, path+"/seats", map[string]bool{"seat_sync": true}, nil)
+	ts.expect(http.StatusOK, http.MethodPost, path+"/members", member("c@example.com"), nil)
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path+"/members", member("d@example.com"), nil)
+	var members []Member
+	ts.expect(http.StatusOK, http.MethodGet, path+"/members", nil, &members)
+	if len(members) != 3 {
+		t.Fatalf("got %d members, want 3", len(members))
+	}
+	ts.expect(http.StatusOK, http.MethodDelete, fmt.Sprintf("%s/members/%d", path, members[0].ID), nil, nil)
+	ts.expect(http.StatusOK, http.MethodGet, path+"/seats", nil, &seats)
+	if !seats.SeatSync || seats.Seats != 2 || seats.Members != 2 || seats.MaxSeats != 3 {
+		t.Fatalf("got seats %+v, want 2 synced seats", seats)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	metered := CatalogPlan{Key: "api", Kind: catalogKindMetered, Metric: "api_calls", PriceID: "price_api", Name: "API calls", Interval: "month", Currency: "usd"}
+	if err := createCatalogPlan(metered); err != nil {
+		t.Fatal(err)
+	}
+	metered.Active = true
+	metered.UnitAmount = 1
+	metered.ProductID = "prod_api"
+	ts.fake.AddPrice(metered.Price())
+	if err := replacePlanAddOns("planA", []PlanAddOn{{AddOnKey: "api"}}); err != nil {
+		t.Fatal(err)
+	}
+	allowance := int64(100)
+	if err := replacePlanFeatures("planA", []PlanFeature{{Feature: "api_calls", Limit: &allowance}}); err != nil {
+		t.Fatal(err)
+	}
+
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	// Usage is only reported to paid for subscriptions.
+	ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/sub", org.ID), nil, nil)
+	path := fmt.Sprintf("/organization/%d/usage", org.ID)
+	events := []UsageEvent{
+		{IdempotencyKey: "a", Metric: "api_calls", Quantity: 100},
+		{IdempotencyKey: "b", Metric: "api_calls", Quantity: 50},
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, path, []UsageEvent{{IdempotencyKey: "c", Metric: "storage", Quantity: 1}}, nil)
+	var counts map[string]int64
+	ts.expect(http.StatusOK, http.MethodPost, path, events, &counts)
+	ts.expect(http.StatusOK, http.MethodPost, path, events[1:], &counts)
+	if counts["accepted"] != 0 || counts["duplicates"] != 1 {
+		t.Fatalf("got %v posting an event again, want it ignored", counts)
+	}
+
+	var usage []MeteredUsage
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &usage)
+	if len(usage) != 1 || usage[0].Usage != 150 || usage[0].Reported != 0 || usage[0].Allowance == nil || *usage[0].Allowance != 100 || usage[0].Overage != 50 {
+		t.Fatalf("got usage %+v, want 150 api calls not reported with 50 over the allowance", usage)
+	}
+
+	// A failed report is retried after a delay, once.
+	now := time.Now().Unix()
+	ts.fake.FailUsageRecords(1)
+	if err := flushUsage(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushUsage(now); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.fake.Usage(usage[0].SubscriptionItemID); got != 0 {
+		t.Fatalf("got usage %d recorded before the retry, want 0", got)
+	}
+	if err := flushUsage(now + int64(usageRetryDelay(1).Seconds())); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.fake.Usage(usage[0].SubscriptionItemID); got != 150 {
+		t.Fatalf("got usage %d recorded, want 150", got)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &usage)
+	if len(usage) != 1 || usage[0].Reported != 150 {
+		t.Fatalf("got usage %+v, want 150 api calls reported", usage)
+	}
+
+	// Late events of the previous period are billed at the start of the
+	// current one, Stripe rejects the usage of a period already invoiced.
+	start := usage[0].PeriodStart
+	late := []UsageEvent{
+		{IdempotencyKey: "d", Metric: "api_calls", Quantity: 10, OccurredAt: start - 7200},
+		{IdempotencyKey: "e", Metric: "api_calls", Quantity: 5, OccurredAt: start - 3600},
+	}
+	ts.expect(http.StatusOK, http.MethodPost, path, late, nil)
+	if err := flushUsage(now); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.fake.Usage(usage[0].SubscriptionItemID); got != 165 {
+		t.Fatalf("got usage %d recorded, want the 15 late api calls with the 150 others", got)
+	}
+	records := ts.fake.UsageRecords(usage[0].SubscriptionItemID)
+	lateRecorded := false
+	for _, ur := range records {
+		lateRecorded = lateRecorded || ur.Quantity == 15 && ur.Timestamp == start
+	}
+	if len(records) != 2 || !lateRecorded {
+		t.Fatalf("got usage records %+v, want 15 api calls at %d", records, start)
+	}
+
+	// A report whose item was replaced after a failed attempt goes to the new
+	// one, with another idempotency key than the attempt Stripe saw.
+	ts.expect(http.StatusOK, http.MethodPost, path, []UsageEvent{{IdempotencyKey: "f", Metric: "api_calls", Quantity: 7}}, nil)
+	s, err := stripeAPI.UpdateSubscription(res.SubscriptionID, &stripe.SubscriptionParams{Items: []*stripe.SubscriptionItemsParams{
+		{ID: stripe.String(usage[0].SubscriptionItemID), Deleted: stripe.Bool(true)},
+		{Price: stripe.String("price_api")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flushUsage(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateSub(*s); err != nil {
+		t.Fatal(err)
+	}
+	item, ok, err := getMeteredItem(org.ID, "api_calls")
+	if err != nil || !ok || item.ID == usage[0].SubscriptionItemID {
+		t.Fatalf("got metered item %+v, %v, %v, want a new item", item, ok, err)
+	}
+	if err := flushUsage(now + int64(usageRetryDelay(1).Seconds())); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.fake.Usage(item.ID); got != 7 {
+		t.Fatalf("got usage %d recorded on the new item, want 7", got)
+	}
+
+	// A report created before the subscription renews is sent within the new
+	// period rather than lost.
+	ts.fake.FailUsageRecords(1)
+	ts.expect(http.StatusOK, http.MethodPost, path, []UsageEvent{{IdempotencyKey: "g", Metric: "api_calls", Quantity: 2}}, nil)
+	if err := flushUsage(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.fake.RenewSubscription(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = stripeAPI.GetSubscription(res.SubscriptionID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateSub(*s); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushUsage(now + int64(usageRetryDelay(1).Seconds())); err != nil {
+		t.Fatal(err)
+	}
+	records = ts.fake.UsageRecords(item.ID)
+	if len(records) != 2 || records[1].Quantity != 2 || records[1].Timestamp != s.CurrentPeriodStart {
+		t.Fatalf("got usage records %+v, want 2 api calls at %d", records, s.CurrentPeriodStart)
+	}
+
+	// A report is given up after usageMaxAttempts and no longer sent.
+	ts.fake.FailUsageRecords(usageMaxAttempts)
+	ts.expect(http.StatusOK, http.MethodPost, path, []UsageEvent{{IdempotencyKey: "h", Metric: "api_calls", Quantity: 3}}, nil)
+	at := now
+	for i := 0; i <= usageMaxAttempts; i++ {
+		if err := flushUsage(at); err != nil {
+			t.Fatal(err)
+		}
+		at += int64(time.Hour.Seconds())
+	}
+	if got := ts.fake.Usage(item.ID); got != 9 {
+		t.Fatalf("got usage %d recorded, want the report given up", got)
+	}
+	var failed []UsageReport
+	if err := db.Select(&failed, db.Rebind("SELECT * FROM usage_reports WHERE failed_at <> 0")); err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Quantity != 3 || failed[0].Attempts != usageMaxAttempts || failed[0].LastError == "" {
+		t.Fatalf("got failed reports %+v, want the report of 3 api calls after %d attempts", failed, usageMaxAttempts)
+	}
+}
+
+func TestPaymentMethod(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d/payment-method", org.ID)
+
+	ts.expect(http.StatusNotFound, http.MethodGet, path, nil, nil)
+
+	if _, err := stripeAPI.AttachPaymentMethod("pm_card_visa", &stripe.PaymentMethodAttachParams{Customer: stripe.String(org.StripeID)}); err != nil {
+		t.Fatal(err)
+	}
+	var pms []stripe.PaymentMethod
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, &pms)
+	if len(pms) == 0 || pms[0].ID == "" {
+		t.Fatalf("got payment methods %+v, want the attached card", pms)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	s, err := stripeAPI.GetSubscription(res.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handlers mark the organization with the current time, deliveries
+	// are dated after it so that they are not taken for stale events.
+	now := time.Now().Unix() + 60
+
+	t.Run("invalid signature", func(t *testing.T) {
+		if _, code := ts.postEvent("customer.subscription.updated", s, now, "whsec_wrong"); code != http.StatusBadRequest {
+			t.Fatalf("got status %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("payment failed", func(t *testing.T) {
+		s.Status = stripe.SubscriptionStatusPastDue
+		id, code := ts.postEvent("customer.subscription.updated", s, now, testWebhookSecret)
+		if code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		got := ts.org(org.ID)
+		if got.SubStatus != "past_due" || got.DunningStage != dunningStageGrace {
+			t.Fatalf("got status %q and dunning stage %q, want past_due and %s", got.SubStatus, got.DunningStage, dunningStageGrace)
+		}
+
+		se, err := getStoredEvent(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if se.Status != eventStatusProcessed || se.Attempts != 1 {
+			t.Fatalf("stored event is %s after %d attempts", se.Status, se.Attempts)
+		}
+	})
+
+	t.Run("stale event", func(t *testing.T) {
+		s.Status = stripe.SubscriptionStatusActive
+		if _, code := ts.postEvent("customer.subscription.updated", s, now-3600, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if got := ts.org(org.ID); got.SubStatus != "past_due" {
+			t.Fatalf("stale event changed the status to %q", got.SubStatus)
+		}
+	})
+
+	t.Run("invoice paid", func(t *testing.T) {
+		in := stripe.Invoice{
+			ID:           "in_test_paid",
+			Object:       "invoice",
+			Customer:     &stripe.Customer{ID: org.StripeID},
+			Subscription: &stripe.Subscription{ID: s.ID},
+			Status:       stripe.InvoiceStatusPaid,
+			Currency:     stripe.CurrencyUSD,
+			AmountDue:    2000,
+			AmountPaid:   2000,
+			Created:      now,
+		}
+		if _, code := ts.postEvent("invoice.paid", in, now+1, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		var invoices []Invoice
+		ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/invoices", org.ID), nil, &invoices)
+		if len(invoices) != 1 || invoices[0].ID != in.ID || invoices[0].Status != "paid" {
+			t.Fatalf("got invoices %+v, want %s paid", invoices, in.ID)
+		}
+		if got := ts.org(org.ID); got.DunningStage != "" {
+			t.Fatalf("dunning stage is %q after payment, want none", got.DunningStage)
+		}
+	})
+
+	t.Run("redelivery", func(t *testing.T) {
+		s.Status = stripe.SubscriptionStatusActive
+		id, _ := ts.postEvent("customer.subscription.updated", s, now+2, testWebhookSecret)
+		se, err := getStoredEvent(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := ts.postPayload(se.Payload, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if se, err = getStoredEvent(id); err != nil {
+			t.Fatal(err)
+		}
+		if se.Attempts != 1 {
+			t.Fatalf("event processed %d times, want once", se.Attempts)
+		}
+	})
+
+	t.Run("failed event", func(t *testing.T) {
+		// The checkout session of a customer Stripe does not know yet fails
+		// until the customer exists.
+		cs := map[string]interface{}{"id": "cs_test_failed", "object": "checkout.session", "customer": "cus_test_later"}
+		id, code := ts.postEvent("checkout.session.completed", cs, now+2, testWebhookSecret)
+		if code != http.StatusInternalServerError {
+			t.Fatalf("got status %d, want %d", code, http.StatusInternalServerError)
+		}
+		se, err := getStoredEvent(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if se.Status != eventStatusFailed || se.Error == "" || se.Attempts != 1 {
+			t.Fatalf("stored event is %s after %d attempts with error %q, want it failed", se.Status, se.Attempts, se.Error)
+		}
+
+		ts.fake.mu.Lock()
+		ts.fake.customers["cus_test_later"] = &stripe.Customer{ID: "cus_test_later", Object: "customer"}
+		ts.fake.mu.Unlock()
+		if code := ts.postPayload(se.Payload, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d retrying, want %d", code, http.StatusOK)
+		}
+		if se, err = getStoredEvent(id); err != nil {
+			t.Fatal(err)
+		}
+		if se.Status != eventStatusProcessed || se.Error != "" || se.Attempts != 2 {
+			t.Fatalf("stored event is %s after %d attempts with error %q, want it processed on the retry", se.Status, se.Attempts, se.Error)
+		}
+	})
+
+	t.Run("processing event", func(t *testing.T) {
+		s.Status = stripe.SubscriptionStatusPastDue
+		id, _ := ts.postEvent("customer.subscription.updated", s, now+2, testWebhookSecret)
+		se, err := getStoredEvent(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Another delivery holds the event, this one is retried later.
+		query := "UPDATE stripe_events SET status = ?, claimed_at = ? WHERE id = ?"
+		if _, err := db.Exec(db.Rebind(query), eventStatusProcessing, time.Now().Unix(), id); err != nil {
+			t.Fatal(err)
+		}
+		if code := ts.postPayload(se.Payload, testWebhookSecret); code != http.StatusConflict {
+			t.Fatalf("got status %d, want %d", code, http.StatusConflict)
+		}
+
+		// Once its lease expired, the event is processed again.
+		expired := time.Now().Add(-eventProcessingLease - time.Minute).Unix()
+		if _, err := db.Exec(db.Rebind(query), eventStatusProcessing, expired, id); err != nil {
+			t.Fatal(err)
+		}
+		if code := ts.postPayload(se.Payload, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d after the lease expired, want %d", code, http.StatusOK)
+		}
+		if se, err = getStoredEvent(id); err != nil || se.Status != eventStatusProcessed || se.Attempts != 2 {
+			t.Fatalf("got stored event %+v (%v), want it processed on the second attempt", se, err)
+		}
+		s.Status = stripe.SubscriptionStatusActive
+	})
+
+	t.Run("subscription deleted", func(t *testing.T) {
+		s.Status = stripe.SubscriptionStatusCanceled
+		if _, code := ts.postEvent("customer.subscription.deleted", s, now+3, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if got := ts.org(org.ID); got.StripeSubID != "" || got.SubStatus != "" {
+			t.Fatalf("organization still subscribed after deletion : %+v", got)
+		}
+	})
+}
+
+func TestInvoiceEvents(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	res := ts.subscribe(org, "planA")
+	now := time.Now().Unix() + 60
+
+	in := stripe.Invoice{
+		ID:               "in_test_renewal",
+		Object:           "invoice",
+		Customer:         &stripe.Customer{ID: org.StripeID},
+		Subscription:     &stripe.Subscription{ID: res.SubscriptionID},
+		Number:           "ACME-0002",
+		Status:           stripe.InvoiceStatusOpen,
+		Currency:         stripe.CurrencyUSD,
+		AmountDue:        2000,
+		AmountRemaining:  2000,
+		HostedInvoiceURL: "https://invoice.stripe.com/i/in_test_renewal",
+		InvoicePDF:       "https://pay.stripe.com/invoice/in_test_renewal/pdf",
+		PeriodStart:      now - 30*24*3600,
+		PeriodEnd:        now,
+		Lines: &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{
+			{ID: "il_test", Period: &stripe.Period{Start: now, End: now + 30*24*3600}},
+		}},
+		Created: now,
+	}
+	invoice := func() Invoice {
+		t.Helper()
+		var invoices []Invoice
+		ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/invoices", org.ID), nil, &invoices)
+		for _, inv := range invoices {
+			if inv.ID == in.ID {
+				return inv
+			}
+		}
+		t.Fatalf("got invoices %+v, want %s", invoices, in.ID)
+		return Invoice{}
+	}
+	post := func(eventType string, created int64) {
+		t.Helper()
+		if _, code := ts.postEvent(eventType, in, created, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d posting %s, want %d", code, eventType, http.StatusOK)
+		}
+	}
+
+	t.Run("finalized", func(t *testing.T) {
+		post("invoice.finalized", now)
+		got := invoice()
+		want := Invoice{
+			ID:               in.ID,
+			OrgID:            org.ID,
+			CustomerID:       org.StripeID,
+			SubscriptionID:   res.SubscriptionID,
+			Number:           in.Number,
+			Status:           "open",
+			Currency:         "usd",
+			AmountDue:        2000,
+			AmountRemaining:  2000,
+			HostedInvoiceURL: in.HostedInvoiceURL,
+			InvoicePDF:       in.InvoicePDF,
+			PeriodStart:      now,
+			PeriodEnd:        now + 30*24*3600,
+			Created:          now,
+		}
+		if got != want {
+			t.Fatalf("got invoice %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("payment failed", func(t *testing.T) {
+		in.AttemptCount = 1
+		in.NextPaymentAttempt = now + 3*24*3600
+		post("invoice.payment_failed", now+1)
+		if got := invoice(); got.Status != "open" || got.AttemptCount != 1 || got.NextAttemptAt != in.NextPaymentAttempt {
+			t.Fatalf("got invoice %+v after the failed payment", got)
+		}
+		if got := ts.org(org.ID); got.DunningStage != dunningStageGrace {
+			t.Fatalf("got dunning stage %q, want %s", got.DunningStage, dunningStageGrace)
+		}
+	})
+
+	t.Run("secondary subscription", func(t *testing.T) {
+		// Paying the invoice of another subscription of the organization
+		// does not end the dunning of the primary one.
+		other := stripe.Invoice{
+			ID:           "in_test_secondary",
+			Object:       "invoice",
+			Customer:     &stripe.Customer{ID: org.StripeID},
+			Subscription: &stripe.Subscription{ID: "sub_test_secondary"},
+			Status:       stripe.InvoiceStatusPaid,
+			AmountDue:    500,
+			AmountPaid:   500,
+		}
+		if _, code := ts.postEvent("invoice.paid", other, now+1, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if got := ts.org(org.ID); got.DunningStage != dunningStageGrace {
+			t.Fatalf("got dunning stage %q after paying another subscription, want %s", got.DunningStage, dunningStageGrace)
+		}
+	})
+
+	t.Run("paid", func(t *testing.T) {
+		in.Status = stripe.InvoiceStatusPaid
+		in.AttemptCount = 2
+		in.NextPaymentAttempt = 0
+		in.AmountPaid, in.AmountRemaining = 2000, 0
+		post("invoice.paid", now+2)
+		if got := invoice(); got.Status != "paid" || got.AmountPaid != 2000 || got.AmountRemaining != 0 || got.NextAttemptAt != 0 {
+			t.Fatalf("got invoice %+v after the payment", got)
+		}
+		if got := ts.org(org.ID); got.DunningStage != dunningStageNone {
+			t.Fatalf("got dunning stage %q after the payment, want none", got.DunningStage)
+		}
+	})
+
+	t.Run("stale event", func(t *testing.T) {
+		// The failure delivered after the payment is older than it.
+		in.Status = stripe.InvoiceStatusOpen
+		in.AmountPaid, in.AmountRemaining = 0, 2000
+		post("invoice.payment_failed", now+1)
+		if got := invoice(); got.Status != "paid" || got.AmountPaid != 2000 {
+			t.Fatalf("stale event changed invoice %+v", got)
+		}
+		if got := ts.org(org.ID); got.DunningStage != dunningStageNone {
+			t.Fatalf("stale event moved the dunning stage to %q", got.DunningStage)
+		}
+	})
+
+	t.Run("one-off invoice", func(t *testing.T) {
+		// Invoices without subscription do not drive the dunning.
+		oneOff := stripe.Invoice{ID: "in_test_one_off", Object: "invoice", Customer: &stripe.Customer{ID: org.StripeID}, Status: stripe.InvoiceStatusOpen, AmountDue: 500}
+		if _, code := ts.postEvent("invoice.payment_failed", oneOff, now+3, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		if got := ts.org(org.ID); got.DunningStage != dunningStageNone {
+			t.Fatalf("got dunning stage %q after a one-off invoice failed, want none", got.DunningStage)
+		}
+	})
+
+	t.Run("unknown customer", func(t *testing.T) {
+		other := stripe.Invoice{ID: "in_test_other", Object: "invoice", Customer: &stripe.Customer{ID: "cus_test_unknown"}, Status: stripe.InvoiceStatusPaid}
+		if _, code := ts.postEvent("invoice.paid", other, now+3, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", code, http.StatusOK)
+		}
+		var n int
+		if err := db.Get(&n, db.Rebind("SELECT COUNT(*) FROM invoices WHERE id = ?"), other.ID); err != nil || n != 0 {
+			t.Fatalf("got %d invoices %s (%v), want none stored", n, other.ID, err)
+		}
+	})
+}
+
+func TestReplay(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	acme := ts.createOrg("acme")
+	beta := ts.createOrg("beta")
+	acmeSub := ts.subscribe(acme, "planA")
+	betaSub := ts.subscribe(beta, "planA")
+	s, err := stripeAPI.GetSubscription(acmeSub.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix() + 60
+
+	s.Status = stripe.SubscriptionStatusPastDue
+	pastDue, _ := ts.postEvent("customer.subscription.updated", s, now, testWebhookSecret)
+	s.Status = stripe.SubscriptionStatusActive
+	active, _ := ts.postEvent("customer.subscription.updated", s, now+1, testWebhookSecret)
+	in := stripe.Invoice{
+		ID:           "in_test_paid",
+		Object:       "invoice",
+		Customer:     &stripe.Customer{ID: acme.StripeID},
+		Subscription: &stripe.Subscription{ID: s.ID},
+		Status:       stripe.InvoiceStatusPaid,
+		Currency:     stripe.CurrencyUSD,
+		AmountPaid:   2000,
+		Created:      now,
+	}
+	paid, _ := ts.postEvent("invoice.paid", in, now+2, testWebhookSecret)
+	bs, err := stripeAPI.GetSubscription(betaSub.SubscriptionID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	betaUpdated, _ := ts.postEvent("customer.subscription.updated", bs, now, testWebhookSecret)
+
+	replay := func(f map[string]interface{}) map[string]replayResult {
+		t.Helper()
+		var results []replayResult
+		ts.expectAdmin(http.StatusOK, http.MethodPost, "/admin/events/replay", f, &results)
+		byID := map[string]replayResult{}
+		for _, res := range results {
+			byID[res.EventID] = res
+		}
+		return byID
+	}
+	outcomes := func(results map[string]replayResult) map[string]string {
+		got := map[string]string{}
+		for id, res := range results {
+			got[id] = res.Outcome
+		}
+		return got
+	}
+
+	t.Run("filters", func(t *testing.T) {
+		got := outcomes(replay(map[string]interface{}{"ids": []string{pastDue, paid}, "dry_run": true}))
+		if len(got) != 2 || got[pastDue] != "dry-run" || got[paid] != "dry-run" {
+			t.Fatalf("got %v replaying by id", got)
+		}
+		got = outcomes(replay(map[string]interface{}{"types": []string{"invoice.paid"}, "dry_run": true}))
+		if len(got) != 1 || got[paid] != "dry-run" {
+			t.Fatalf("got %v replaying by type", got)
+		}
+		got = outcomes(replay(map[string]interface{}{"org_id": beta.ID, "dry_run": true}))
+		if len(got) != 1 || got[betaUpdated] != "dry-run" {
+			t.Fatalf("got %v replaying by organization", got)
+		}
+		got = outcomes(replay(map[string]interface{}{"org_id": acme.ID, "since": now + 1, "dry_run": true}))
+		if len(got) != 2 || got[active] != "dry-run" || got[paid] != "dry-run" {
+			t.Fatalf("got %v replaying since %d", got, now+1)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		res := replay(map[string]interface{}{"ids": []string{pastDue}, "ignore_order": true, "dry_run": true})[pastDue]
+		if res.Outcome != "dry-run" || len(res.Changes) == 0 {
+			t.Fatalf("got %+v, want the changes of the dry run", res)
+		}
+		if got := ts.org(acme.ID); got.SubStatus != "active" || got.DunningStage != "" {
+			t.Fatalf("dry run changed organization %+v", got)
+		}
+		if se, err := getStoredEvent(pastDue); err != nil || se.Attempts != 1 {
+			t.Fatalf("got stored event %+v (%v) after the dry run, want it untouched", se, err)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		res := replay(map[string]interface{}{"ids": []string{pastDue}, "ignore_order": true})[pastDue]
+		if res.Outcome != "processed" {
+			t.Fatalf("got %+v, want the event processed", res)
+		}
+		if got := ts.org(acme.ID); got.SubStatus != "past_due" {
+			t.Fatalf("got status %q after the replay, want past_due", got.SubStatus)
+		}
+		if se, err := getStoredEvent(pastDue); err != nil || se.Status != eventStatusProcessed || se.Attempts != 2 {
+			t.Fatalf("got stored event %+v (%v) after the replay", se, err)
+		}
+	})
+
+	t.Run("leased", func(t *testing.T) {
+		query := "UPDATE stripe_events SET status = ?, claimed_at = ? WHERE id = ?"
+		if _, err := db.Exec(db.Rebind(query), eventStatusProcessing, time.Now().Unix(), active); err != nil {
+			t.Fatal(err)
+		}
+		res := replay(map[string]interface{}{"ids": []string{active}, "ignore_order": true})[active]
+		if res.Outcome != "skipped" {
+			t.Fatalf("got %+v, want the event another delivery processes skipped", res)
+		}
+		if got := ts.org(acme.ID); got.SubStatus != "past_due" {
+			t.Fatalf("got status %q, want the leased event not applied", got.SubStatus)
+		}
+		// The dry run does not claim the event.
+		if res := replay(map[string]interface{}{"ids": []string{active}, "dry_run": true})[active]; res.Outcome != "dry-run" {
+			t.Fatalf("got %+v, want a dry run", res)
+		}
+	})
+
+	t.Run("stripe source", func(t *testing.T) {
+		list, err := stripeAPI.ListEvents(&stripe.EventListParams{Types: []*string{stripe.String("customer.subscription.created")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := map[string]string{}
+		for _, ev := range list {
+			created[eventCustomerID(*ev)] = ev.ID
+		}
+		acmeCreated, betaCreated := created[acme.StripeID], created[beta.StripeID]
+		if acmeCreated == "" || betaCreated == "" {
+			t.Fatalf("got events %v, want the creation of both subscriptions", created)
+		}
+		// The webhook endpoint already got the creation of the acme
+		// subscription.
+		ev, err := stripeAPI.GetEvent(acmeCreated, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := ts.postPayload(payload, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d delivering %s", code, acmeCreated)
+		}
+
+		results := replay(map[string]interface{}{"source": "stripe", "types": []string{"customer.subscription.created"}, "dry_run": true})
+		if got := outcomes(results); len(got) != 2 || got[acmeCreated] != "skipped" || got[betaCreated] != "dry-run" {
+			t.Fatalf("got %v in dry run, want %s skipped", got, acmeCreated)
+		}
+		if _, err := getStoredEvent(betaCreated); err == nil {
+			t.Fatalf("dry run stored event %s", betaCreated)
+		}
+
+		results = replay(map[string]interface{}{"source": "stripe", "types": []string{"customer.subscription.created"}})
+		if got := outcomes(results); got[acmeCreated] != "skipped" || got[betaCreated] != "processed" {
+			t.Fatalf("got %v, want %s skipped and %s processed", got, acmeCreated, betaCreated)
+		}
+		se, err := getStoredEvent(betaCreated)
+		if err != nil || se.Status != eventStatusProcessed || se.Attempts != 1 {
+			t.Fatalf("got stored event %+v (%v), want %s processed once", se, err, betaCreated)
+		}
+		if se, err := getStoredEvent(acmeCreated); err != nil || se.Attempts != 1 {
+			t.Fatalf("got stored event %+v (%v), want %s processed once", se, err, acmeCreated)
+		}
+	})
+}
+
+func TestEntitlements(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	storage := CatalogPlan{Key: "storage", Kind: catalogKindAddOn, PriceID: "price_storage", Name: "storage", Interval: "month", Currency: "usd", Visible: true}
+	if err := createCatalogPlan(storage); err != nil {
+		t.Fatal(err)
+	}
+	storage.Active = true
+	storage.UnitAmount = 500
+	storage.ProductID = "prod_storage"
+	ts.fake.AddPrice(storage.Price())
+	if err := replacePlanAddOns("planA", []PlanAddOn{{AddOnKey: "storage", MaxQuantity: 5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The features of the plans are set by the admin.
+	ts.expectAdmin(http.StatusNotFound, http.MethodPut, "/admin/plans/nope/features", []PlanFeature{{Feature: "sso"}}, nil)
+	ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPut, "/admin/plans/planA/features", []PlanFeature{{Feature: " "}}, nil)
+	negative := int64(-1)
+	ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPut, "/admin/plans/planA/features", []PlanFeature{{Feature: "seats", Limit: &negative}}, nil)
+	seats, gb := int64(10), int64(100)
+	ts.expectAdmin(http.StatusOK, http.MethodPut, "/admin/plans/planA/features", []PlanFeature{{Feature: "sso"}, {Feature: " seats ", Limit: &seats}}, nil)
+	ts.expectAdmin(http.StatusOK, http.MethodPut, "/admin/plans/storage/features", []PlanFeature{{Feature: "gb", Limit: &gb}, {Feature: "seats", Limit: &seats}}, nil)
+	var features []PlanFeature
+	ts.expectAdmin(http.StatusOK, http.MethodGet, "/admin/plans/planA/features", nil, &features)
+	if len(features) != 2 || features[0].Feature != "seats" || features[0].Limit == nil || *features[0].Limit != 10 ||
+		features[1].Feature != "sso" || features[1].Limit != nil {
+		t.Fatalf("got features %+v, want 10 seats and unlimited sso", features)
+	}
+
+	org := ts.createOrg("acme")
+	path := fmt.Sprintf("/organization/%d/sub", org.ID)
+	var res subscriptionResult
+	ts.expect(http.StatusOK, http.MethodPost, path, map[string]interface{}{"plan": "planA", "addons": []addOnRequest{{AddOn: "storage", Quantity: 2}}}, &res)
+	entPath := fmt.Sprintf("/organization/%d/entitlements", org.ID)
+	var ent entitlements.Entitlements
+	ts.expect(http.StatusOK, http.MethodGet, entPath, nil, &ent)
+	if ent.Access != entitlements.AccessNone || len(ent.Features) != 0 {
+		t.Fatalf("got entitlements %+v before the first payment, want none", ent)
+	}
+	if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	ts.expect(http.StatusOK, http.MethodGet, path, nil, nil)
+
+	// Every unit of an add-on grants its limits again, on top of the plan.
+	ent = entitlements.Entitlements{}
+	ts.expect(http.StatusOK, http.MethodGet, entPath, nil, &ent)
+	if l, ok := ent.Limit("seats"); !ok || l != 30 {
+		t.Fatalf("got %d seats (%v), want 10 of planA and 2 × 10 of storage", l, ok)
+	}
+	if l, ok := ent.Limit("gb"); !ok || l != 200 {
+		t.Fatalf("got %d gb (%v), want 2 × 100 of storage", l, ok)
+	}
+	if l, ok := ent.Limit("sso"); !ok || l != -1 {
+		t.Fatalf("got sso limit %d (%v), want unlimited", l, ok)
+	}
+	if len(ent.Plans) != 2 || ent.Plans[0] != "planA" || ent.Plans[1] != "storage" {
+		t.Fatalf("got plans %v, want planA and storage", ent.Plans)
+	}
+
+	// An unlimited feature of any plan wins over the limits of the others.
+	ts.expectAdmin(http.StatusOK, http.MethodPut, "/admin/plans/storage/features", []PlanFeature{{Feature: "gb", Limit: &gb}, {Feature: "seats"}}, nil)
+	ent = entitlements.Entitlements{}
+	ts.expect(http.StatusOK, http.MethodGet, entPath, nil, &ent)
+	if l, ok := ent.Limit("seats"); !ok || l != -1 {
+		t.Fatalf("got %d seats (%v), want unlimited", l, ok)
+	}
+}
+
+func TestEntitlementTokenRotation(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	org := ts.createOrg("acme")
+	ts.subscribe(org, "planA")
+	keys := entitlements.NewRemoteKeySet(ts.URL + "/.well-known/jwks.json")
+	keys.MinRefresh = 0
+
+	issue := func() string {
+		t.Helper()
+		var res struct {
+			Token string `json:"token"`
+		}
+		ts.expect(http.StatusOK, http.MethodPost, fmt.Sprintf("/organization/%d/entitlements/token", org.ID), nil, &res)
+		return res.Token
+	}
+	before := issue()
+	claims, err := entitlements.Verify(before, entitlementTokenIssuer(), keys, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != strconv.Itoa(org.ID) || claims.OrgID != org.ID {
+		t.Fatalf("got claims %+v for organization %d", claims, org.ID)
+	}
+	if _, err := entitlements.Verify(before, "other", keys, time.Now()); !errors.Is(err, entitlements.ErrInvalidToken) {
+		t.Fatalf("got %v verifying with another issuer, want %v", err, entitlements.ErrInvalidToken)
+	}
+
+	// The previous key stays published while the tokens it signed are valid.
+	var rotated entitlements.JWK
+	ts.expectAdmin(http.StatusOK, http.MethodPost, "/admin/keys/rotate", nil, &rotated)
+	after := issue()
+	var jwks entitlements.JWKS
+	ts.expect(http.StatusOK, http.MethodGet, "/.well-known/jwks.json", nil, &jwks)
+	published := map[string]bool{}
+	for _, k := range jwks.Keys {
+		published[k.Kid] = true
+	}
+	if len(published) != 2 || !published[rotated.Kid] {
+		t.Fatalf("got jwks %+v after the rotation, want %s and the previous key", jwks, rotated.Kid)
+	}
+	for _, token := range []string{before, after} {
+		if _, err := entitlements.Verify(token, entitlementTokenIssuer(), keys, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// It is withdrawn once they expired.
+	remaining, err := listPublishedSigningKeys(time.Now().Add(entitlementTokenTTL() + time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].Kid != rotated.Kid {
+		t.Fatalf("got keys %+v after the token ttl, want %s only", remaining, rotated.Kid)
+	}
+}
+
+func TestDunningScheduler(t *testing.T) {
+	openTestStore(t)
+	if _, err := migrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	cfg := dunningConfig{GracePeriod: 7 * 24 * time.Hour, RestrictPeriod: 3 * 24 * time.Hour}
+	const day = 24 * 3600
+	failedAt := int64(1700000000)
+	graceEnd := failedAt + 7*day
+	restrictEnd := graceEnd + 3*day
+
+	newOrg := func(name string) Organization {
+		t.Helper()
+		if err := store.CreateOrganization(name, name+"@example.com", "cus_"+name); err != nil {
+			t.Fatal(err)
+		}
+		org, err := store.GetOrganizationByStripeID("cus_" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, ok := dunningOnPaymentFailed(org, failedAt, cfg)
+		if !ok {
+			t.Fatalf("no dunning for organization %+v", org)
+		}
+		if ok, err := applyDunningTransition(tr, org.DunningDeadline); err != nil || !ok {
+			t.Fatalf("got %v (%v) applying %s", ok, err, tr)
+		}
+		return org
+	}
+	stage := func(org Organization) (string, int64) {
+		t.Helper()
+		got, err := store.GetOrganization(strconv.Itoa(org.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.DunningStage, got.DunningDeadline
+	}
+
+	t.Run("stages", func(t *testing.T) {
+		org := newOrg("acme")
+		steps := []struct {
+			now          int64
+			wantStage    string
+			wantDeadline int64
+		}{
+			{failedAt, dunningStageGrace, graceEnd},
+			{graceEnd - 1, dunningStageGrace, graceEnd},
+			{graceEnd, dunningStageRestricted, restrictEnd},
+			{restrictEnd - 1, dunningStageRestricted, restrictEnd},
+			{restrictEnd, dunningStageSuspended, 0},
+			{restrictEnd + 30*day, dunningStageSuspended, 0},
+		}
+		for _, step := range steps {
+			if err := advanceDunningStages(step.now, cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got, deadline := stage(org); got != step.wantStage || deadline != step.wantDeadline {
+				t.Fatalf("got stage %q until %d at %d, want %q until %d", got, deadline, step.now, step.wantStage, step.wantDeadline)
+			}
+		}
+	})
+
+	t.Run("skipped stages", func(t *testing.T) {
+		// The scheduler did not run during the grace and restriction
+		// periods.
+		org := newOrg("beta")
+		if err := advanceDunningStages(restrictEnd+day, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := stage(org); got != dunningStageSuspended {
+			t.Fatalf("got stage %q, want %q", got, dunningStageSuspended)
+		}
+	})
+
+	t.Run("concurrent payment", func(t *testing.T) {
+		org := newOrg("gamma")
+		org.DunningStage, org.DunningDeadline = stage(org)
+		next, ok := nextDunningStage(org, cfg)
+		if !ok || next.To != dunningStageRestricted {
+			t.Fatalf("got %s, want the restriction next", next)
+		}
+		// The payment lands between the scheduler reading the organization
+		// and writing its next stage.
+		paid, ok := dunningOnPaymentSucceeded(org)
+		if !ok {
+			t.Fatalf("payment does not end the dunning of %+v", org)
+		}
+		if ok, err := applyDunningTransition(paid, org.DunningDeadline); err != nil || !ok {
+			t.Fatalf("got %v (%v) applying %s", ok, err, paid)
+		}
+		if ok, err := applyDunningTransition(next, org.DunningDeadline); err != nil || ok {
+			t.Fatalf("got %v (%v) applying %s after the payment, want it rejected", ok, err, next)
+		}
+		if err := advanceDunningStages(restrictEnd, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got, deadline := stage(org); got != dunningStageNone || deadline != 0 {
+			t.Fatalf("got stage %q until %d after the payment, want none", got, deadline)
+		}
+	})
+}
+
+func TestCatalogAdmin(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	ts.fake.AddPrice(&stripe.Price{
+		ID:         "price_planC",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 5000,
+		Type:       stripe.PriceTypeRecurring,
+		Product:    &stripe.Product{ID: "prod_planC", Name: "Plan C", Active: true},
+	})
+	listed := func(path string) map[string]bool {
+		t.Helper()
+		var prices []stripe.Price
+		ts.expect(http.StatusOK, http.MethodGet, path, nil, &prices)
+		keys := map[string]bool{}
+		for _, pr := range prices {
+			keys[pr.Nickname] = true
+		}
+		return keys
+	}
+
+	t.Run("create", func(t *testing.T) {
+		t.Setenv("ADMIN_TOKEN", testAdminToken)
+		ts.expect(http.StatusUnauthorized, http.MethodPost, "/admin/plans", map[string]string{"key": "planC", "price_id": "price_planC"}, nil)
+		ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPost, "/admin/plans", map[string]string{"key": "planC"}, nil)
+		ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPost, "/admin/plans", map[string]string{"key": "planC", "price_id": "price_planC", "kind": "bundle"}, nil)
+
+		var cp CatalogPlan
+		ts.expectAdmin(http.StatusOK, http.MethodPost, "/admin/plans", map[string]interface{}{"key": "planC", "price_id": "price_planC", "sort_order": 5}, &cp)
+		if cp.Kind != catalogKindBase || cp.Name != "Plan C" || cp.UnitAmount != 5000 || cp.ProductID != "prod_planC" || !cp.Visible {
+			t.Fatalf("got plan %+v, want it filled in from its price", cp)
+		}
+		ts.expectAdmin(http.StatusConflict, http.MethodPost, "/admin/plans", map[string]string{"key": "planC", "price_id": "price_planC"}, nil)
+		if !listed("/plans")["planC"] {
+			t.Fatal("planC is not listed after its creation")
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		ts.expectAdmin(http.StatusNotFound, http.MethodPut, "/admin/plans/nope", map[string]bool{"visible": false}, nil)
+		ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPut, "/admin/plans/planC", map[string]string{"price_id": " "}, nil)
+		ts.expectAdmin(http.StatusUnprocessableEntity, http.MethodPut, "/admin/plans/planC", map[string]int64{"trial_days": -1}, nil)
+
+		var cp CatalogPlan
+		ts.expectAdmin(http.StatusOK, http.MethodPut, "/admin/plans/planC", map[string]interface{}{"visible": false, "trial_days": 14}, &cp)
+		if cp.Visible || cp.TrialDays != 14 || cp.PriceID != "price_planC" || cp.SortOrder != 5 {
+			t.Fatalf("got plan %+v after the update", cp)
+		}
+		if listed("/plans")["planC"] {
+			t.Fatal("hidden planC is listed")
+		}
+		var catalog []CatalogPlan
+		ts.expectAdmin(http.StatusOK, http.MethodGet, "/admin/plans", nil, &catalog)
+		found := false
+		for _, p := range catalog {
+			found = found || (p.Key == "planC" && !p.Visible)
+		}
+		if !found {
+			t.Fatalf("got catalog %+v, want the hidden planC", catalog)
+		}
+		// Hidden plans can still be subscribed with their key.
+		if _, ok := getSubscribablePlan("planC"); !ok {
+			t.Fatal("hidden planC is not subscribable")
+		}
+		ts.expectAdmin(http.StatusOK, http.MethodPut, "/admin/plans/planC", map[string]interface{}{"visible": true, "trial_days": 0}, nil)
+	})
+
+	t.Run("retire", func(t *testing.T) {
+		subscriber := ts.createOrg("acme")
+		res := ts.subscribe(subscriber, "planC")
+
+		ts.expectAdmin(http.StatusNotFound, http.MethodDelete, "/admin/plans/nope", nil, nil)
+		ts.expectAdmin(http.StatusOK, http.MethodDelete, "/admin/plans/planC", nil, nil)
+
+		if listed("/plans")["planC"] {
+			t.Fatal("retired planC is listed")
+		}
+		if _, ok := getSubscribablePlan("planC"); ok {
+			t.Fatal("retired planC is subscribable")
+		}
+		org := ts.createOrg("beta")
+		ts.expect(http.StatusUnprocessableEntity, http.MethodPost, fmt.Sprintf("/organization/%d/sub", org.ID), map[string]string{"plan": "planC"}, nil)
+		ts.subscribe(org, "planA")
+		ts.expect(http.StatusUnprocessableEntity, http.MethodPut, fmt.Sprintf("/organization/%d/sub", org.ID), map[string]string{"plan": "planC"}, nil)
+
+		// The existing subscriber keeps its plan.
+		got := ts.org(subscriber.ID)
+		if got.StripeSubID != res.SubscriptionID || len(got.Plans) != 1 || got.Plans[0].Key != "planC" {
+			t.Fatalf("got organization %+v after the retirement, want it still on planC", got)
+		}
+		if cp, err := getCatalogPlanByPrice("price_planC"); err != nil || cp.Key != "planC" || !cp.Retired {
+			t.Fatalf("got plan %+v (%v) by price, want the retired planC", cp, err)
+		}
+		var info subscriptionResponse
+		ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/sub", subscriber.ID), nil, &info)
+		if info.SubscriptionID != res.SubscriptionID {
+			t.Fatalf("got subscription %+v, want %s", info, res.SubscriptionID)
+		}
+	})
+}
+
+func TestCatalogSync(t *testing.T) {
+	ts := newTestServer(t, fakeStripe)
+	team := &stripe.Price{
+		ID:         "price_team",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 9900,
+		Type:       stripe.PriceTypeRecurring,
+		Metadata:   map[string]string{"plan_key": "team", "sort_order": "3"},
+		Product:    &stripe.Product{ID: "prod_team", Name: "Team", Active: true},
+	}
+	ts.fake.AddPrice(team)
+	ts.fake.AddPrice(&stripe.Price{
+		ID:         "price_storage",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 500,
+		Type:       stripe.PriceTypeRecurring,
+		Metadata:   map[string]string{"plan_key": "storage", "kind": "addon"},
+		Product:    &stripe.Product{ID: "prod_storage", Name: "Storage", Active: true},
+	})
+	ts.fake.AddPrice(&stripe.Price{
+		ID:       "price_calls",
+		Active:   true,
+		Currency: stripe.CurrencyUSD,
+		Type:     stripe.PriceTypeRecurring,
+		Recurring: &stripe.PriceRecurring{
+			Interval:  stripe.PriceRecurringIntervalMonth,
+			UsageType: stripe.PriceRecurringUsageTypeMetered,
+		},
+		Metadata: map[string]string{"plan_key": "calls", "kind": "metered", "metric": "api_calls"},
+		Product:  &stripe.Product{ID: "prod_calls", Name: "API calls", Active: true},
+	})
+	planA, err := getCatalogPlan("planA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pricePlanA, err := stripeAPI.GetPrice(planA.PriceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := func(key string) CatalogPlan {
+		t.Helper()
+		cp, err := getCatalogPlan(key)
+		if err != nil {
+			t.Fatalf("plan %s : %v", key, err)
+		}
+		return cp
+	}
+
+	t.Run("sync", func(t *testing.T) {
+		var catalog []CatalogPlan
+		ts.expectAdmin(http.StatusOK, http.MethodPost, "/admin/plans/sync", nil, &catalog)
+		keys := map[string]CatalogPlan{}
+		for _, cp := range catalog {
+			keys[cp.Key] = cp
+		}
+		if cp := keys["team"]; cp.Kind != catalogKindBase || cp.PriceID != "price_team" || cp.Name != "Team" ||
+			cp.UnitAmount != 9900 || cp.SortOrder != 3 || !cp.Active || !cp.Visible {
+			t.Fatalf("got plan %+v, want the team price imported", cp)
+		}
+		if cp := keys["storage"]; cp.Kind != catalogKindAddOn || cp.ProductID != "prod_storage" {
+			t.Fatalf("got plan %+v, want the storage add-on", cp)
+		}
+		if cp := keys["calls"]; cp.Kind != catalogKindMetered || cp.Metric != "api_calls" {
+			t.Fatalf("got plan %+v, want the api_calls metered plan", cp)
+		}
+		// The untagged plans are refreshed from their price.
+		if cp := keys["planA"]; cp.UnitAmount != pricePlanA.UnitAmount || cp.ProductID != pricePlanA.Product.ID {
+			t.Fatalf("got plan %+v, want it refreshed from %s", cp, pricePlanA.ID)
+		}
+		if _, ok := getSubscribablePlan("team"); !ok {
+			t.Fatal("synced team plan is not subscribable")
+		}
+	})
+
+	now := time.Now().Unix()
+	post := func(eventType string, obj interface{}) {
+		t.Helper()
+		if _, code := ts.postEvent(eventType, obj, now, testWebhookSecret); code != http.StatusOK {
+			t.Fatalf("got status %d posting %s", code, eventType)
+		}
+	}
+
+	t.Run("price updated", func(t *testing.T) {
+		updated := *team
+		updated.UnitAmount = 12900
+		post("price.updated", updated)
+		if cp := plan("team"); cp.UnitAmount != 12900 || cp.PriceID != "price_team" {
+			t.Fatalf("got plan %+v after price.updated", cp)
+		}
+
+		untagged := *pricePlanA
+		untagged.UnitAmount = 4200
+		post("price.updated", untagged)
+		if cp := plan("planA"); cp.UnitAmount != 4200 {
+			t.Fatalf("got plan %+v after price.updated of the untagged price", cp)
+		}
+
+		seats := int64(5)
+		if err := replacePlanFeatures("team", []PlanFeature{{Feature: "seats", Limit: &seats}}); err != nil {
+			t.Fatal(err)
+		}
+		org := ts.createOrg("acme")
+		res := ts.subscribe(org, "team")
+		if err := ts.fake.PayLatestInvoice(res.SubscriptionID); err != nil {
+			t.Fatal(err)
+		}
+		ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/sub", org.ID), nil, nil)
+
+		// A new active price tagged with the key takes the plan over.
+		v2 := *team
+		v2.ID = "price_team_v2"
+		v2.UnitAmount = 14900
+		ts.fake.AddPrice(&v2)
+		post("price.created", v2)
+		if cp := plan("team"); cp.PriceID != "price_team_v2" || cp.UnitAmount != 14900 {
+			t.Fatalf("got plan %+v after price.created, want price_team_v2", cp)
+		}
+
+		// The subscribers of the previous price keep the plan, which the
+		// previous price no longer describes.
+		if got := ts.org(org.ID); len(got.Plans) != 1 || got.Plans[0].Key != "team" {
+			t.Fatalf("got plans %+v after the price rotated, want team", got.Plans)
+		}
+		var ent entitlements.Entitlements
+		ts.expect(http.StatusOK, http.MethodGet, fmt.Sprintf("/organization/%d/entitlements", org.ID), nil, &ent)
+		if l, ok := ent.Limit("seats"); !ok || l != 5 || len(ent.Plans) != 1 || ent.Plans[0] != "team" {
+			t.Fatalf("got entitlements %+v after the price rotated, want the 5 seats of team", ent)
+		}
+		old := *team
+		old.UnitAmount = 1
+		post("price.updated", old)
+		ts.expectAdmin(http.StatusOK, http.MethodPost, "/admin/plans/sync", nil, nil)
+		if cp := plan("team"); cp.PriceID != "price_team_v2" || cp.UnitAmount != 14900 {
+			t.Fatalf("got plan %+v after the previous price changed, want price_team_v2", cp)
+		}
+	})
+
+	t.Run("product updated", func(t *testing.T) {
+		post("product.updated", stripe.Product{ID: "prod_team", Name: "Team Plus", Description: "For teams", Active: true})
+		if cp := plan("team"); cp.Name != "Team Plus" || cp.Description != "For teams" || !cp.Active {
+			t.Fatalf("got plan %+v after product.updated", cp)
+		}
+
+		post("product.updated", stripe.Product{ID: "prod_storage", Name: "Storage", Active: false})
+		if cp := plan("storage"); cp.Active {
+			t.Fatalf("got plan %+v after its product was archived, want it inactive", cp)
+		}
+		if _, ok := getAvailablePlan("storage"); ok {
+			t.Fatal("add-on of an archived product is available")
+		}
+	})
+}
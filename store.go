@@ -0,0 +1,654 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Store holds the organizations and their subscriptions, whose queries differ
+// between the dialects or span several tables. The catalog, events, invoices,
+// usage, members and signing keys stay on purpose with the code using them and
+// query db, the database of the store, directly. Every query is written with ?
+// placeholders and goes through Rebind, so that it runs on both dialects.
+type Store interface {
+	DB() *sqlx.DB
+	// Dialect is the name of the SQL dialect, it selects the migrations.
+	Dialect() string
+
+	ListOrganizations() ([]Organization, error)
+	GetOrganization(id string) (Organization, error)
+	GetOrganizationByStripeID(stripeID string) (Organization, error)
+	// CheckOrganization returns the organization with both the name and the
+	// email.
+	CheckOrganization(name, email string) (Organization, error)
+	// GetOrganizationByNameOrEmail returns an organization using either the
+	// name or the email, both are unique.
+	GetOrganizationByNameOrEmail(name, email string) (Organization, error)
+	CreateOrganization(name, email, stripeID string) error
+	SetSeatSync(orgID int, sync bool) error
+
+	// GetSubscription returns the subscription with its items.
+	GetSubscription(id string) (Subscription, error)
+	// ListSubscriptions returns the subscriptions of the organization with
+	// their items, oldest first.
+	ListSubscriptions(orgID int) ([]Subscription, error)
+	// CreateSub stores the subscription of a customer. It becomes the primary
+	// subscription of the organization when the organization has none.
+	CreateSub(sub Subscription) error
+	// UpdateSub stores the subscription, the status of the organization is
+	// only updated if it is its primary subscription.
+	UpdateSub(sub Subscription) error
+	CreateSubForOrg(orgID int, sub Subscription) error
+	// DeleteSub stores the final state of the subscription. When it was the
+	// primary subscription, the oldest subscription still running replaces it.
+	DeleteSub(sub Subscription) error
+	// DeleteSubByOrgID removes the primary subscription of the organization,
+	// which is marked canceled.
+	DeleteSubByOrgID(orgID int) error
+	// GetSubEventAt returns the event_at marker of the subscription, 0 when
+	// no event was applied to it.
+	GetSubEventAt(subID string) (int64, error)
+	// AdvanceSubEventAt moves the event_at marker of the subscription forward
+	// to ts. It returns false when the marker is already past ts.
+	AdvanceSubEventAt(orgID int, subID string, ts int64) (bool, error)
+	// ApplySubEvent stores the subscription an event created, updated or
+	// deleted, following action, and moves its event_at marker forward to ts
+	// in the same transaction. Unless force is set, nothing is stored and it
+	// returns false when the marker is already past ts.
+	ApplySubEvent(orgID int, action string, sub Subscription, ts int64, force bool) (bool, error)
+	// SetTrialWillEnd records when Stripe announced the end of the trial of
+	// the subscription.
+	SetTrialWillEnd(subID string, at int64) error
+
+	// GetPendingChange returns the plan change scheduled on the subscription,
+	// sql.ErrNoRows when there is none.
+	GetPendingChange(subID string) (PendingChange, error)
+	// SetPendingChange stores the plan change, replacing the one already
+	// scheduled on the subscription.
+	SetPendingChange(pc PendingChange) error
+	DeletePendingChange(subID string) error
+	// DeletePendingChangeBySchedule removes the plan change applied by the
+	// subscription schedule.
+	DeletePendingChangeBySchedule(scheduleID string) error
+}
+
+var store Store
+
+// openStore opens the database of dsn. PostgreSQL is used for postgres:// and
+// postgresql:// URLs, anything else is the DSN of a SQLite file.
+func openStore(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return newPostgresStore(dsn)
+	}
+	if dsn == "" {
+		dsn = "local.db"
+	}
+	return newSQLiteStore(dsn)
+}
+
+type sqliteStore struct {
+	sqlStore
+}
+
+func newSQLiteStore(dsn string) (*sqliteStore, error) {
+	// Webhook deliveries write concurrently with the handlers, wait for the
+	// lock instead of failing with SQLITE_BUSY.
+	if !strings.Contains(dsn, "busy_timeout") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_pragma=busy_timeout(5000)"
+	}
+	db, err := sqlx.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteStore{sqlStore{db}}, nil
+}
+
+func (s *sqliteStore) Dialect() string { return "sqlite" }
+
+type postgresStore struct {
+	sqlStore
+}
+
+func newPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to postgres : %w", err)
+	}
+	return &postgresStore{sqlStore{db}}, nil
+}
+
+func (s *postgresStore) Dialect() string { return "postgres" }
+
+// sqlStore has the queries shared by both dialects. They are written with ?
+// placeholders and rebound to the placeholders of the driver.
+type sqlStore struct {
+	db *sqlx.DB
+}
+
+func (s *sqlStore) DB() *sqlx.DB {
+	return s.db
+}
+
+func (s *sqlStore) ListOrganizations() ([]Organization, error) {
+	var orgs []Organization
+	if err := s.db.Select(&orgs, s.db.Rebind("SELECT * FROM organization ORDER BY id")); err != nil {
+		return nil, err
+	}
+	var items []SubscriptionItem
+	query := `
+	SELECT si.*, COALESCE(pp.plan_key, '') AS plan_key
+	FROM subscription_items si
+	JOIN organization o ON o.stripe_sub = si.subscription_id
+	LEFT JOIN plan_prices pp ON pp.price_id = si.price_id
+	ORDER BY si.id ;
+	`
+	if err := s.db.Select(&items, s.db.Rebind(query)); err != nil {
+		return nil, err
+	}
+	plans := map[string][]Plan{}
+	for _, item := range items {
+		plans[item.SubscriptionID] = append(plans[item.SubscriptionID], item.Plan())
+	}
+	changes, err := s.pendingChanges("SELECT sc.* FROM subscription_changes sc JOIN organization o ON o.stripe_sub = sc.subscription_id")
+	if err != nil {
+		return nil, err
+	}
+	var pauses []SubscriptionPause
+	query = `
+	SELECT s.id, s.pause_behavior, s.pause_resumes_at, s.paused_by, s.paused_at
+	FROM subscriptions s
+	JOIN organization o ON o.stripe_sub = s.id
+	WHERE s.pause_behavior != '' ;
+	`
+	if err := s.db.Select(&pauses, s.db.Rebind(query)); err != nil {
+		return nil, err
+	}
+	paused := map[string]*SubscriptionPause{}
+	for i := range pauses {
+		paused[pauses[i].SubscriptionID] = &pauses[i]
+	}
+	for i := range orgs {
+		orgs[i].Plans = plans[orgs[i].StripeSubID]
+		orgs[i].PendingChange = changes[orgs[i].StripeSubID]
+		orgs[i].Pause = paused[orgs[i].StripeSubID]
+	}
+	return orgs, nil
+}
+
+func (s *sqlStore) GetOrganization(id string) (Organization, error) {
+	// PostgreSQL rejects a non numeric id instead of finding nothing.
+	if _, err := strconv.Atoi(id); err != nil {
+		return Organization{}, sql.ErrNoRows
+	}
+	return s.getOrganization("SELECT * FROM organization WHERE id = ?", id)
+}
+
+func (s *sqlStore) GetOrganizationByStripeID(stripeID string) (Organization, error) {
+	return s.getOrganization("SELECT * FROM organization WHERE stripe_id = ?", stripeID)
+}
+
+func (s *sqlStore) CheckOrganization(name, email string) (Organization, error) {
+	return s.getOrganization("SELECT * FROM organization WHERE name = ? AND email = ? LIMIT 1", name, email)
+}
+
+func (s *sqlStore) GetOrganizationByNameOrEmail(name, email string) (Organization, error) {
+	return s.getOrganization("SELECT * FROM organization WHERE name = ? OR email = ? LIMIT 1", name, email)
+}
+
+func (s *sqlStore) getOrganization(query string, args ...interface{}) (Organization, error) {
+	var org Organization
+	if err := s.db.Get(&org, s.db.Rebind(query), args...); err != nil {
+		return org, err
+	}
+	if org.StripeSubID == "" {
+		return org, nil
+	}
+	items, err := s.subscriptionItems(org.StripeSubID)
+	if err != nil {
+		return org, err
+	}
+	for _, item := range items {
+		org.Plans = append(org.Plans, item.Plan())
+	}
+	if org.PendingChange, err = s.pendingChange(org.StripeSubID); err != nil {
+		return org, err
+	}
+	var pause SubscriptionPause
+	query = `
+	SELECT id, pause_behavior, pause_resumes_at, paused_by, paused_at
+	FROM subscriptions
+	WHERE id = ? AND pause_behavior != '' ;
+	`
+	switch err := s.db.Get(&pause, s.db.Rebind(query), org.StripeSubID); {
+	case err == nil:
+		org.Pause = &pause
+	case err != sql.ErrNoRows:
+		return org, err
+	}
+	return org, nil
+}
+
+func (s *sqlStore) CreateOrganization(name, email, stripeID string) error {
+	query := "INSERT INTO organization (name, email, stripe_id) VALUES (?, ?, ?)"
+	_, err := s.db.ExecContext(context.Background(), s.db.Rebind(query), name, email, stripeID)
+	return err
+}
+
+func (s *sqlStore) SetSeatSync(orgID int, sync bool) error {
+	query := "UPDATE organization SET seat_sync = ? WHERE id = ?"
+	_, err := s.db.ExecContext(context.Background(), s.db.Rebind(query), sync, orgID)
+	return err
+}
+
+func (s *sqlStore) SetTrialWillEnd(subID string, at int64) error {
+	query := "UPDATE subscriptions SET trial_will_end_at = ? WHERE id = ?"
+	_, err := s.db.ExecContext(context.Background(), s.db.Rebind(query), at, subID)
+	return err
+}
+
+func (s *sqlStore) GetSubscription(id string) (Subscription, error) {
+	var sub Subscription
+	if err := s.db.Get(&sub, s.db.Rebind("SELECT * FROM subscriptions WHERE id = ?"), id); err != nil {
+		return sub, err
+	}
+	items, err := s.subscriptionItems(id)
+	if err != nil {
+		return sub, err
+	}
+	sub.Items = items
+	sub.PendingChange, err = s.pendingChange(id)
+	return sub, err
+}
+
+func (s *sqlStore) ListSubscriptions(orgID int) ([]Subscription, error) {
+	subs := []Subscription{}
+	if err := s.db.Select(&subs, s.db.Rebind("SELECT * FROM subscriptions WHERE org_id = ? ORDER BY created, id"), orgID); err != nil {
+		return nil, err
+	}
+	var items []SubscriptionItem
+	query := `
+	SELECT si.*, COALESCE(pp.plan_key, '') AS plan_key
+	FROM subscription_items si
+	JOIN subscriptions s ON s.id = si.subscription_id
+	LEFT JOIN plan_prices pp ON pp.price_id = si.price_id
+	WHERE s.org_id = ?
+	ORDER BY si.id ;
+	`
+	if err := s.db.Select(&items, s.db.Rebind(query), orgID); err != nil {
+		return nil, err
+	}
+	bySub := map[string][]SubscriptionItem{}
+	for _, item := range items {
+		bySub[item.SubscriptionID] = append(bySub[item.SubscriptionID], item)
+	}
+	changes, err := s.pendingChanges("SELECT sc.* FROM subscription_changes sc JOIN subscriptions s ON s.id = sc.subscription_id WHERE s.org_id = ?", orgID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subs {
+		subs[i].Items = bySub[subs[i].ID]
+		subs[i].PendingChange = changes[subs[i].ID]
+	}
+	return subs, nil
+}
+
+func (s *sqlStore) subscriptionItems(subID string) ([]SubscriptionItem, error) {
+	var items []SubscriptionItem
+	query := `
+	SELECT si.*, COALESCE(pp.plan_key, '') AS plan_key
+	FROM subscription_items si
+	LEFT JOIN plan_prices pp ON pp.price_id = si.price_id
+	WHERE si.subscription_id = ?
+	ORDER BY si.id ;
+	`
+	err := s.db.Select(&items, s.db.Rebind(query), subID)
+	return items, err
+}
+
+// pendingChange returns the plan change scheduled on the subscription, nil
+// when there is none.
+func (s *sqlStore) pendingChange(subID string) (*PendingChange, error) {
+	pc, err := s.GetPendingChange(subID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pc, nil
+}
+
+// pendingChanges returns the plan changes of query by subscription.
+func (s *sqlStore) pendingChanges(query string, args ...interface{}) (map[string]*PendingChange, error) {
+	var list []PendingChange
+	if err := s.db.Select(&list, s.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	changes := map[string]*PendingChange{}
+	for i := range list {
+		changes[list[i].SubscriptionID] = &list[i]
+	}
+	return changes, nil
+}
+
+// setPrimarySub makes the subscription the primary subscription of the
+// organization, unless the organization has another one still running.
+const setPrimarySub = `
+	UPDATE organization
+	SET
+		stripe_sub = ?,
+		sub_status = ?
+	WHERE
+		id = ? AND (stripe_sub = '' OR stripe_sub = ? OR sub_status IN ('canceled', 'incomplete_expired')) ;
+	`
+
+func (s *sqlStore) CreateSub(sub Subscription) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		return createSubTx(tx, sub)
+	})
+}
+
+func createSubTx(tx *sqlx.Tx, sub Subscription) error {
+	orgID, err := orgIDByCustomer(tx, sub.CustomerID)
+	if err != nil || orgID == 0 {
+		return err
+	}
+	sub.OrgID = orgID
+	if err := saveSub(tx, sub); err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind(setPrimarySub), sub.ID, sub.Status, orgID, sub.ID)
+	return err
+}
+
+func (s *sqlStore) UpdateSub(sub Subscription) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		return updateSubTx(tx, sub)
+	})
+}
+
+func updateSubTx(tx *sqlx.Tx, sub Subscription) error {
+	orgID, err := orgIDByCustomer(tx, sub.CustomerID)
+	if err != nil || orgID == 0 {
+		return err
+	}
+	sub.OrgID = orgID
+	if err := saveSub(tx, sub); err != nil {
+		return err
+	}
+	query := "UPDATE organization SET sub_status = ? WHERE id = ? AND stripe_sub = ?"
+	_, err = tx.Exec(tx.Rebind(query), sub.Status, orgID, sub.ID)
+	return err
+}
+
+func (s *sqlStore) CreateSubForOrg(orgID int, sub Subscription) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		sub.OrgID = orgID
+		if err := saveSub(tx, sub); err != nil {
+			return err
+		}
+		_, err := tx.Exec(tx.Rebind(setPrimarySub), sub.ID, sub.Status, orgID, sub.ID)
+		return err
+	})
+}
+
+func (s *sqlStore) DeleteSub(sub Subscription) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		return deleteSubTx(tx, sub)
+	})
+}
+
+func deleteSubTx(tx *sqlx.Tx, sub Subscription) error {
+	orgID, err := orgIDByCustomer(tx, sub.CustomerID)
+	if err != nil {
+		return err
+	}
+	if orgID != 0 {
+		sub.OrgID = orgID
+		if err := saveSub(tx, sub); err != nil {
+			return err
+		}
+	}
+	return replacePrimarySub(tx, "stripe_sub = ?", sub.ID)
+}
+
+func (s *sqlStore) DeleteSubByOrgID(orgID int) error {
+	return s.inTx(func(tx *sqlx.Tx) error {
+		query := `
+		UPDATE subscriptions
+		SET
+			status = 'canceled'
+		WHERE
+			id = (SELECT stripe_sub FROM organization WHERE id = ?) ;
+		`
+		if _, err := tx.Exec(tx.Rebind(query), orgID); err != nil {
+			return err
+		}
+		return replacePrimarySub(tx, "id = ?", orgID)
+	})
+}
+
+// replacePrimarySub sets the primary subscription of the organizations
+// matching where to their oldest subscription still running, or to none.
+func replacePrimarySub(tx *sqlx.Tx, where string, args ...interface{}) error {
+	next := `
+	SELECT %s FROM subscriptions s
+	WHERE s.org_id = organization.id AND s.status NOT IN ('', 'canceled', 'incomplete_expired')
+	ORDER BY s.created, s.id
+	LIMIT 1
+	`
+	query := fmt.Sprintf(`
+	UPDATE organization
+	SET
+		stripe_sub = COALESCE((%s), ''),
+		sub_status = COALESCE((%s), '')
+	WHERE
+		%s ;
+	`, fmt.Sprintf(next, "s.id"), fmt.Sprintf(next, "s.status"), where)
+	_, err := tx.Exec(tx.Rebind(query), args...)
+	return err
+}
+
+func (s *sqlStore) inTx(fn func(tx *sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// orgIDByCustomer returns the organization of the Stripe customer, 0 when
+// there is none.
+func orgIDByCustomer(tx *sqlx.Tx, customerID string) (int, error) {
+	var orgID int
+	err := tx.Get(&orgID, tx.Rebind("SELECT id FROM organization WHERE stripe_id = ?"), customerID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return orgID, err
+}
+
+// saveSub upserts the subscription and replaces its items.
+func saveSub(tx *sqlx.Tx, sub Subscription) error {
+	query := `
+	INSERT INTO subscriptions (id, org_id, customer_id, status, currency,
+		current_period_start, current_period_end, cancel_at, cancel_at_period_end,
+		canceled_at, trial_end, created, pause_behavior, pause_resumes_at,
+		paused_by, paused_at, trial_end_behavior, trial_will_end_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		org_id = excluded.org_id,
+		customer_id = excluded.customer_id,
+		status = excluded.status,
+		currency = excluded.currency,
+		current_period_start = excluded.current_period_start,
+		current_period_end = excluded.current_period_end,
+		cancel_at = excluded.cancel_at,
+		cancel_at_period_end = excluded.cancel_at_period_end,
+		canceled_at = excluded.canceled_at,
+		trial_end = excluded.trial_end,
+		created = excluded.created,
+		pause_behavior = excluded.pause_behavior,
+		pause_resumes_at = excluded.pause_resumes_at,
+		paused_by = CASE
+			WHEN excluded.pause_behavior = '' THEN ''
+			WHEN excluded.paused_by != '' THEN excluded.paused_by
+			ELSE subscriptions.paused_by END,
+		paused_at = CASE
+			WHEN excluded.pause_behavior = '' THEN 0
+			WHEN excluded.paused_at != 0 THEN excluded.paused_at
+			ELSE subscriptions.paused_at END,
+		trial_end_behavior = excluded.trial_end_behavior,
+		trial_will_end_at = CASE
+			WHEN excluded.trial_will_end_at != 0 THEN excluded.trial_will_end_at
+			WHEN excluded.trial_end != subscriptions.trial_end THEN 0
+			ELSE subscriptions.trial_will_end_at END ;
+	`
+	// Who paused the subscription is only known to the handler pausing it,
+	// the following changes keep it until the subscription resumes. The
+	// announced end of a trial is kept until the trial changes.
+	if _, err := tx.Exec(tx.Rebind(query), sub.ID, sub.OrgID, sub.CustomerID, sub.Status, sub.Currency,
+		sub.CurrentPeriodStart, sub.CurrentPeriodEnd, sub.CancelAt, sub.CancelAtPeriodEnd,
+		sub.CanceledAt, sub.TrialEnd, sub.Created, sub.PauseBehavior, sub.PauseResumesAt,
+		sub.PausedBy, sub.PausedAt, sub.TrialEndBehavior, sub.TrialWillEndAt); err != nil {
+		return fmt.Errorf("failed to store subscription %s : %w", sub.ID, err)
+	}
+
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM subscription_items WHERE subscription_id = ?"), sub.ID); err != nil {
+		return err
+	}
+	query = `
+	INSERT INTO subscription_items (id, subscription_id, price_id, price_active,
+		product_id, product_name, product_description, product_active,
+		quantity, unit_amount, currency)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ;
+	`
+	for _, item := range sub.Items {
+		if _, err := tx.Exec(tx.Rebind(query), item.ID, sub.ID, item.PriceID, item.PriceActive,
+			item.ProductID, item.ProductName, item.ProductDescription, item.ProductActive,
+			item.Quantity, item.UnitAmount, item.Currency); err != nil {
+			return fmt.Errorf("failed to store subscription item %s : %w", item.ID, err)
+		}
+	}
+
+	// The scheduled plan change is done once the period it starts has begun,
+	// or the subscription ended before.
+	query = "DELETE FROM subscription_changes WHERE subscription_id = ? AND (effective_at <= ? OR ?)"
+	_, err := tx.Exec(tx.Rebind(query), sub.ID, sub.CurrentPeriodStart, isFinalSubStatus(sub.Status))
+	return err
+}
+
+func (s *sqlStore) GetSubEventAt(subID string) (int64, error) {
+	var at int64
+	query := "SELECT event_at FROM subscription_event_markers WHERE subscription_id = ?"
+	err := s.db.Get(&at, s.db.Rebind(query), subID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return at, err
+}
+
+func (s *sqlStore) AdvanceSubEventAt(orgID int, subID string, ts int64) (bool, error) {
+	var applied bool
+	err := s.inTx(func(tx *sqlx.Tx) error {
+		var err error
+		applied, err = advanceSubEventAt(tx, orgID, subID, ts)
+		return err
+	})
+	return applied, err
+}
+
+func (s *sqlStore) ApplySubEvent(orgID int, action string, sub Subscription, ts int64, force bool) (bool, error) {
+	var applied bool
+	err := s.inTx(func(tx *sqlx.Tx) error {
+		var err error
+		// The marker row stays locked until the subscription is written, a
+		// concurrent delivery of an older event can not overwrite it.
+		if applied, err = advanceSubEventAt(tx, orgID, sub.ID, ts); err != nil || !applied && !force {
+			return err
+		}
+		applied = true
+		switch action {
+		case "create":
+			return createSubTx(tx, sub)
+		case "delete":
+			return deleteSubTx(tx, sub)
+		default:
+			return updateSubTx(tx, sub)
+		}
+	})
+	return applied, err
+}
+
+// advanceSubEventAt moves the event_at marker of the subscription forward to
+// ts, it returns false when the marker is already past ts.
+func advanceSubEventAt(tx *sqlx.Tx, orgID int, subID string, ts int64) (bool, error) {
+	// The markers have their own table, an event may come before its
+	// subscription is stored.
+	query := `
+	INSERT INTO subscription_event_markers (subscription_id, org_id, event_at) VALUES (?, ?, ?)
+	ON CONFLICT (subscription_id) DO UPDATE SET
+		event_at = excluded.event_at
+	WHERE
+		subscription_event_markers.event_at <= excluded.event_at ;
+	`
+	res, err := tx.Exec(tx.Rebind(query), subID, orgID, ts)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqlStore) GetPendingChange(subID string) (PendingChange, error) {
+	var pc PendingChange
+	err := s.db.Get(&pc, s.db.Rebind("SELECT * FROM subscription_changes WHERE subscription_id = ?"), subID)
+	return pc, err
+}
+
+func (s *sqlStore) SetPendingChange(pc PendingChange) error {
+	query := `
+	INSERT INTO subscription_changes (subscription_id, schedule_id, plan_key, quantity, effective_at, created)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (subscription_id) DO UPDATE SET
+		schedule_id = excluded.schedule_id,
+		plan_key = excluded.plan_key,
+		quantity = excluded.quantity,
+		effective_at = excluded.effective_at,
+		created = excluded.created ;
+	`
+	_, err := s.db.ExecContext(context.Background(), s.db.Rebind(query),
+		pc.SubscriptionID, pc.ScheduleID, pc.Plan, pc.Quantity, pc.EffectiveAt, pc.Created)
+	return err
+}
+
+func (s *sqlStore) DeletePendingChange(subID string) error {
+	query := "DELETE FROM subscription_changes WHERE subscription_id = ?"
+	_, err := s.db.ExecContext(context.Background(), s.db.Rebind(query), subID)
+	return err
+}
+
+func (s *sqlStore) DeletePendingChangeBySchedule(scheduleID string) error {
+	query := "DELETE FROM subscription_changes WHERE schedule_id = ?"
+	_, err := s.db.ExecContext(context.Background(), s.db.Rebind(query), scheduleID)
+	return err
+}
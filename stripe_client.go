@@ -0,0 +1,197 @@
+package main
+
+import (
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/coupon"
+	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/event"
+	"github.com/stripe/stripe-go/v74/invoice"
+	"github.com/stripe/stripe-go/v74/paymentmethod"
+	"github.com/stripe/stripe-go/v74/price"
+	"github.com/stripe/stripe-go/v74/product"
+	"github.com/stripe/stripe-go/v74/promotioncode"
+	"github.com/stripe/stripe-go/v74/refund"
+	sub "github.com/stripe/stripe-go/v74/subscription"
+	"github.com/stripe/stripe-go/v74/subscriptionschedule"
+	"github.com/stripe/stripe-go/v74/usagerecord"
+)
+
+// StripeClient is the part of the Stripe API used by the server. Handlers go
+// through stripeAPI so that it can be replaced by the in-memory fake.
+// List operations return every page at once.
+type StripeClient interface {
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+
+	NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error)
+	ResumeSubscription(id string, params *stripe.SubscriptionResumeParams) (*stripe.Subscription, error)
+	DeleteSubscriptionDiscount(id string, params *stripe.SubscriptionDeleteDiscountParams) (*stripe.Subscription, error)
+
+	NewSubscriptionSchedule(params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error)
+	GetSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error)
+	UpdateSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error)
+	ReleaseSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleReleaseParams) (*stripe.SubscriptionSchedule, error)
+
+	GetProduct(id string, params *stripe.ProductParams) (*stripe.Product, error)
+	GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error)
+	ListPrices(params *stripe.PriceListParams) ([]*stripe.Price, error)
+
+	GetCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error)
+	ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error)
+
+	ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error)
+	AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error)
+
+	NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error)
+
+	GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error)
+	ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error)
+	UpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error)
+	NewRefund(params *stripe.RefundParams) (*stripe.Refund, error)
+
+	GetEvent(id string, params *stripe.EventParams) (*stripe.Event, error)
+	ListEvents(params *stripe.EventListParams) ([]*stripe.Event, error)
+}
+
+var stripeAPI StripeClient = liveStripeClient{}
+
+// liveStripeClient calls the Stripe API through the stripe-go backends, which
+// stripe.SetBackend can point somewhere else, e.g. stripe-mock.
+type liveStripeClient struct{}
+
+func (liveStripeClient) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return customer.New(params)
+}
+
+func (liveStripeClient) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return customer.Get(id, params)
+}
+
+func (liveStripeClient) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return customer.Update(id, params)
+}
+
+func (liveStripeClient) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return sub.New(params)
+}
+
+func (liveStripeClient) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return sub.Get(id, params)
+}
+
+func (liveStripeClient) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return sub.Update(id, params)
+}
+
+func (liveStripeClient) CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	return sub.Cancel(id, params)
+}
+
+func (liveStripeClient) ResumeSubscription(id string, params *stripe.SubscriptionResumeParams) (*stripe.Subscription, error) {
+	return sub.Resume(id, params)
+}
+
+func (liveStripeClient) DeleteSubscriptionDiscount(id string, params *stripe.SubscriptionDeleteDiscountParams) (*stripe.Subscription, error) {
+	return sub.DeleteDiscount(id, params)
+}
+
+func (liveStripeClient) NewSubscriptionSchedule(params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	return subscriptionschedule.New(params)
+}
+
+func (liveStripeClient) GetSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	return subscriptionschedule.Get(id, params)
+}
+
+func (liveStripeClient) UpdateSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	return subscriptionschedule.Update(id, params)
+}
+
+func (liveStripeClient) ReleaseSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleReleaseParams) (*stripe.SubscriptionSchedule, error) {
+	return subscriptionschedule.Release(id, params)
+}
+
+func (liveStripeClient) GetProduct(id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	return product.Get(id, params)
+}
+
+func (liveStripeClient) GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	return price.Get(id, params)
+}
+
+func (liveStripeClient) ListPrices(params *stripe.PriceListParams) ([]*stripe.Price, error) {
+	var prices []*stripe.Price
+	i := price.List(params)
+	for i.Next() {
+		prices = append(prices, i.Price())
+	}
+	return prices, i.Err()
+}
+
+func (liveStripeClient) GetCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error) {
+	return coupon.Get(id, params)
+}
+
+func (liveStripeClient) ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	var codes []*stripe.PromotionCode
+	i := promotioncode.List(params)
+	for i.Next() {
+		codes = append(codes, i.PromotionCode())
+	}
+	return codes, i.Err()
+}
+
+func (liveStripeClient) ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	var pms []*stripe.PaymentMethod
+	i := paymentmethod.List(params)
+	for i.Next() {
+		pms = append(pms, i.PaymentMethod())
+	}
+	return pms, i.Err()
+}
+
+func (liveStripeClient) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	return paymentmethod.Attach(id, params)
+}
+
+func (liveStripeClient) NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	return usagerecord.New(params)
+}
+
+func (liveStripeClient) GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	return invoice.Get(id, params)
+}
+
+func (liveStripeClient) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	var invoices []*stripe.Invoice
+	i := invoice.List(params)
+	for i.Next() {
+		invoices = append(invoices, i.Invoice())
+	}
+	return invoices, i.Err()
+}
+
+func (liveStripeClient) UpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	return invoice.Upcoming(params)
+}
+
+func (liveStripeClient) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	return refund.New(params)
+}
+
+func (liveStripeClient) GetEvent(id string, params *stripe.EventParams) (*stripe.Event, error) {
+	return event.Get(id, params)
+}
+
+func (liveStripeClient) ListEvents(params *stripe.EventListParams) ([]*stripe.Event, error) {
+	var events []*stripe.Event
+	i := event.List(params)
+	for i.Next() {
+		events = append(events, i.Event())
+	}
+	return events, i.Err()
+}
@@ -0,0 +1,1675 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+// fakeStripeClient is an in-memory StripeClient. It keeps customers,
+// subscriptions, prices and payment methods, simulates the subscription
+// status transitions and records the events Stripe would send, which
+// ListEvents returns. It is used when STRIPE_FAKE is set so that the API can
+// be exercised offline.
+//
+// A subscription created for a customer without a payment method is
+// incomplete until PayLatestInvoice is called, as if the customer had paid
+// with the client secret. Attaching a payment method makes the following
+// subscriptions active right away. Periods only end when RenewSubscription
+// is called, which also moves the subscription schedules to their next
+// phase.
+//
+// Events are only delivered to a webhook once DeliverWebhooks is called.
+type fakeStripeClient struct {
+	mu  sync.Mutex
+	run string
+	seq int
+	now func() time.Time
+
+	customers      map[string]*stripe.Customer
+	subscriptions  map[string]*stripe.Subscription
+	products       map[string]*stripe.Product
+	prices         map[string]*stripe.Price
+	paymentMethods map[string]*stripe.PaymentMethod
+	invoices       map[string]*stripe.Invoice
+	schedules      map[string]*stripe.SubscriptionSchedule
+	coupons        map[string]*stripe.Coupon
+	promotionCodes map[string]*stripe.PromotionCode
+	events         []*stripe.Event
+
+	// usage totals the usage records of the metered subscription items,
+	// usageRecords keeps them by idempotency key and usageKeys the parameters
+	// each key was first sent with.
+	usage        map[string]int64
+	usageRecords map[string]*stripe.UsageRecord
+	usageKeys    map[string]string
+	usageErrors  int
+
+	// refunded totals the refunds of the payment intents.
+	refunded map[string]int64
+
+	deliveries chan *stripe.Event
+}
+
+func newFakeStripeClient() *fakeStripeClient {
+	return &fakeStripeClient{
+		// IDs must not collide with the ones of a previous run, which may
+		// still be stored.
+		run:            strconv.FormatInt(time.Now().UnixNano(), 36),
+		now:            time.Now,
+		customers:      map[string]*stripe.Customer{},
+		subscriptions:  map[string]*stripe.Subscription{},
+		products:       map[string]*stripe.Product{},
+		prices:         map[string]*stripe.Price{},
+		paymentMethods: map[string]*stripe.PaymentMethod{},
+		invoices:       map[string]*stripe.Invoice{},
+		schedules:      map[string]*stripe.SubscriptionSchedule{},
+		coupons:        map[string]*stripe.Coupon{},
+		promotionCodes: map[string]*stripe.PromotionCode{},
+		usage:          map[string]int64{},
+		usageRecords:   map[string]*stripe.UsageRecord{},
+		usageKeys:      map[string]string{},
+		refunded:       map[string]int64{},
+	}
+}
+
+// seedFakeStripe adds the prices of the plan catalog to the fake so that
+// every plan can be subscribed to.
+func seedFakeStripe(f *fakeStripeClient) error {
+	catalog, err := listCatalogPlans(true)
+	if err != nil {
+		return err
+	}
+	for _, cp := range catalog {
+		pr := cp.Price()
+		if pr.Product.ID == "" {
+			pr.Product.ID = "prod_" + strings.TrimPrefix(cp.PriceID, "price_")
+		}
+		if pr.UnitAmount == 0 {
+			pr.UnitAmount = 1000 * int64(cp.SortOrder+1)
+		}
+		pr.Active = true
+		pr.Product.Active = true
+		pr.Type = stripe.PriceTypeRecurring
+		f.AddPrice(pr)
+	}
+	return nil
+}
+
+// AddPrice adds a price, and its product, to the fake.
+func (f *fakeStripeClient) AddPrice(pr *stripe.Price) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pr = clone(pr)
+	if pr.Recurring == nil {
+		pr.Recurring = &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: 1}
+	}
+	if pr.Product != nil {
+		f.products[pr.Product.ID] = clone(pr.Product)
+	}
+	f.prices[pr.ID] = pr
+}
+
+// AddCoupon adds a coupon to the fake, it can be redeemed while it is valid.
+func (f *fakeStripeClient) AddCoupon(c *stripe.Coupon) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c = clone(c)
+	c.Object = "coupon"
+	f.coupons[c.ID] = c
+}
+
+// AddPromotionCode adds a promotion code of a coupon already added to the
+// fake.
+func (f *fakeStripeClient) AddPromotionCode(pc *stripe.PromotionCode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pc = clone(pc)
+	pc.Object = "promotion_code"
+	f.promotionCodes[pc.ID] = pc
+}
+
+// DeliverWebhooks posts every event recorded from now on to url, in order and
+// signed with secret like Stripe does.
+func (f *fakeStripeClient) DeliverWebhooks(url, secret string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deliveries = make(chan *stripe.Event, 1024)
+	go func(deliveries chan *stripe.Event) {
+		for ev := range deliveries {
+			if err := deliverFakeEvent(url, secret, ev); err != nil {
+				log.Printf("deliverFakeEvent %s %s: %v", ev.ID, ev.Type, err)
+			}
+		}
+	}(f.deliveries)
+}
+
+func deliverFakeEvent(url, secret string, ev *stripe.Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// PayLatestInvoice pays the latest invoice of the subscription, which
+// becomes active.
+func (f *fakeStripeClient) PayLatestInvoice(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[subID]
+	if !ok {
+		return fakeResourceMissing("subscription", subID)
+	}
+	if s.LatestInvoice != nil {
+		in := f.invoices[s.LatestInvoice.ID]
+		in.Status = stripe.InvoiceStatusPaid
+		in.Paid = true
+		in.AmountPaid = in.AmountDue
+		in.AmountRemaining = 0
+		in.PaymentIntent.Status = stripe.PaymentIntentStatusSucceeded
+		s.LatestInvoice = clone(in)
+		f.emit("invoice.paid", in)
+	}
+	s.Status = stripe.SubscriptionStatusActive
+	f.emit("customer.subscription.updated", s)
+	return nil
+}
+
+// FailPayment makes the renewal payment of the subscription fail.
+func (f *fakeStripeClient) FailPayment(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[subID]
+	if !ok {
+		return fakeResourceMissing("subscription", subID)
+	}
+	in := f.newInvoice(s, stripe.InvoiceStatusOpen)
+	in.AttemptCount = 1
+	s.LatestInvoice = clone(in)
+	s.Status = stripe.SubscriptionStatusPastDue
+	f.emit("invoice.payment_failed", in)
+	f.emit("customer.subscription.updated", s)
+	return nil
+}
+
+// AnnounceTrialEnd sends the customer.subscription.trial_will_end event of a
+// trialing subscription, which Stripe sends three days before the trial ends.
+func (f *fakeStripeClient) AnnounceTrialEnd(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[subID]
+	if !ok {
+		return fakeResourceMissing("subscription", subID)
+	}
+	if s.Status != stripe.SubscriptionStatusTrialing {
+		return fakeInvalidRequest("", "The subscription is not trialing.")
+	}
+	f.emit("customer.subscription.trial_will_end", s)
+	return nil
+}
+
+// RenewSubscription ends the current period of the subscription. The next
+// period bills the items of the schedule phase it starts, a schedule is
+// released at the end of its last phase and a subscription canceled at the
+// period end is canceled instead. A paused subscription is not collected
+// until its resumes_at. A trial without a payment method is canceled or
+// paused when its end behavior says so.
+func (f *fakeStripeClient) RenewSubscription(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[subID]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return fakeResourceMissing("subscription", subID)
+	}
+	if s.Status == stripe.SubscriptionStatusPaused {
+		return fakeInvalidRequest("", "A paused subscription has no period to renew, resume it first.")
+	}
+	start := s.CurrentPeriodEnd
+	if s.CancelAtPeriodEnd {
+		s.Status = stripe.SubscriptionStatusCanceled
+		s.CanceledAt = start
+		s.EndedAt = start
+		f.cancelSchedule(s)
+		f.emit("customer.subscription.deleted", s)
+		return nil
+	}
+
+	// A trial without a payment method ends with its end behavior, the
+	// default one invoices the customer anyway.
+	if s.Status == stripe.SubscriptionStatusTrialing {
+		s.PendingSetupIntent = nil
+		if !f.hasPaymentMethod(s.Customer.ID) {
+			switch s.TrialSettings.EndBehavior.MissingPaymentMethod {
+			case stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodCancel:
+				s.Status = stripe.SubscriptionStatusCanceled
+				s.CanceledAt = start
+				s.EndedAt = start
+				f.cancelSchedule(s)
+				f.emit("customer.subscription.deleted", s)
+				return nil
+			case stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodPause:
+				s.Status = stripe.SubscriptionStatusPaused
+				f.emit("customer.subscription.paused", s)
+				return nil
+			}
+		}
+		s.Status = stripe.SubscriptionStatusActive
+	}
+
+	if s.Schedule != nil {
+		sched := f.schedules[s.Schedule.ID]
+		last := sched.Phases[len(sched.Phases)-1]
+		for _, phase := range sched.Phases {
+			if phase.StartDate > start || start >= phase.EndDate {
+				continue
+			}
+			if err := f.applyPhase(s, phase); err != nil {
+				return err
+			}
+			sched.CurrentPhase = &stripe.SubscriptionScheduleCurrentPhase{StartDate: phase.StartDate, EndDate: phase.EndDate}
+		}
+		if start >= last.EndDate {
+			f.releaseSchedule(sched)
+		}
+	}
+	s.CurrentPeriodStart = start
+	s.CurrentPeriodEnd = periodEnd(time.Unix(start, 0), s.Items.Data[0].Price.Recurring).Unix()
+
+	if p := s.PauseCollection; p != nil && p.ResumesAt != 0 && p.ResumesAt <= start {
+		s.PauseCollection = nil
+	}
+	// The renewal of a paused subscription is not collected, its invoice
+	// follows the pause behavior.
+	if s.PauseCollection != nil {
+		status := stripe.InvoiceStatus(s.PauseCollection.Behavior)
+		if s.PauseCollection.Behavior == stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft {
+			status = stripe.InvoiceStatusDraft
+		}
+		in := f.newInvoice(s, status)
+		s.LatestInvoice = clone(in)
+		f.emit("customer.subscription.updated", s)
+		return nil
+	}
+
+	status := stripe.InvoiceStatusOpen
+	if f.hasPaymentMethod(s.Customer.ID) {
+		status = stripe.InvoiceStatusPaid
+	}
+	in := f.newInvoice(s, status)
+	s.LatestInvoice = clone(in)
+	if status == stripe.InvoiceStatusPaid {
+		f.emit("invoice.paid", in)
+	} else {
+		s.Status = stripe.SubscriptionStatusPastDue
+		f.emit("invoice.payment_failed", in)
+	}
+	f.emit("customer.subscription.updated", s)
+	return nil
+}
+
+func (f *fakeStripeClient) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := &stripe.Customer{
+		ID:      f.id("cus"),
+		Object:  "customer",
+		Created: f.now().Unix(),
+		Email:   stringValue(params.Email),
+		Name:    stringValue(params.Name),
+	}
+	f.customers[c.ID] = c
+	f.emit("customer.created", c)
+	return f.customer(c.ID), nil
+}
+
+func (f *fakeStripeClient) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.customers[id]; !ok {
+		return nil, fakeResourceMissing("customer", id)
+	}
+	return f.customer(id), nil
+}
+
+func (f *fakeStripeClient) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.customers[id]
+	if !ok {
+		return nil, fakeResourceMissing("customer", id)
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	if params.Name != nil {
+		c.Name = *params.Name
+	}
+	if params.InvoiceSettings != nil && params.InvoiceSettings.DefaultPaymentMethod != nil {
+		pm, ok := f.paymentMethods[*params.InvoiceSettings.DefaultPaymentMethod]
+		if !ok {
+			return nil, fakeResourceMissing("payment_method", *params.InvoiceSettings.DefaultPaymentMethod)
+		}
+		c.InvoiceSettings = &stripe.CustomerInvoiceSettings{DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm.ID}}
+	}
+	f.emit("customer.updated", c)
+	return f.customer(id), nil
+}
+
+func (f *fakeStripeClient) NewSubscription(params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	customerID := stringValue(params.Customer)
+	if _, ok := f.customers[customerID]; !ok {
+		return nil, fakeResourceMissing("customer", customerID)
+	}
+	if len(params.Items) == 0 {
+		return nil, fakeInvalidRequest("items", "Missing required param: items.")
+	}
+
+	now := f.now()
+	s := &stripe.Subscription{
+		ID:                 f.id("sub"),
+		Object:             "subscription",
+		Customer:           &stripe.Customer{ID: customerID},
+		Created:            now.Unix(),
+		StartDate:          now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		Items:              &stripe.SubscriptionItemList{},
+		Metadata:           params.Metadata,
+	}
+	for _, ip := range params.Items {
+		item, err := f.newSubscriptionItem(s.ID, ip)
+		if err != nil {
+			return nil, err
+		}
+		s.Items.Data = append(s.Items.Data, item)
+	}
+	s.Currency = s.Items.Data[0].Price.Currency
+	s.CurrentPeriodEnd = periodEnd(now, s.Items.Data[0].Price.Recurring).Unix()
+	if err := f.applyDiscount(s, params); err != nil {
+		return nil, err
+	}
+
+	// A trial is the first period, its invoice has nothing to pay and a
+	// setup intent collects the payment method of the customer.
+	if days := stripe.Int64Value(params.TrialPeriodDays); days > 0 {
+		s.Status = stripe.SubscriptionStatusTrialing
+		s.TrialStart = now.Unix()
+		s.TrialEnd = now.AddDate(0, 0, int(days)).Unix()
+		s.CurrentPeriodEnd = s.TrialEnd
+		behavior := stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodCreateInvoice
+		if params.TrialSettings != nil && params.TrialSettings.EndBehavior != nil && params.TrialSettings.EndBehavior.MissingPaymentMethod != nil {
+			behavior = stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethod(*params.TrialSettings.EndBehavior.MissingPaymentMethod)
+		}
+		s.TrialSettings = &stripe.SubscriptionTrialSettings{
+			EndBehavior: &stripe.SubscriptionTrialSettingsEndBehavior{MissingPaymentMethod: behavior},
+		}
+		if !f.hasPaymentMethod(customerID) {
+			seti := &stripe.SetupIntent{ID: f.id("seti"), Object: "setup_intent", Status: stripe.SetupIntentStatusRequiresPaymentMethod}
+			seti.ClientSecret = seti.ID + "_secret_fake"
+			s.PendingSetupIntent = seti
+		}
+		lines := f.periodLines(s)
+		for _, line := range lines {
+			line.Amount = 0
+		}
+		in := f.newInvoice(s, stripe.InvoiceStatusPaid, lines...)
+		in.PaymentIntent = nil
+		s.LatestInvoice = clone(in)
+
+		f.subscriptions[s.ID] = s
+		f.emit("customer.subscription.created", s)
+		f.emit("invoice.paid", in)
+		return clone(s), nil
+	}
+
+	status := stripe.InvoiceStatusOpen
+	s.Status = stripe.SubscriptionStatusIncomplete
+	if f.hasPaymentMethod(customerID) {
+		status = stripe.InvoiceStatusPaid
+		s.Status = stripe.SubscriptionStatusActive
+	}
+	in := f.newInvoice(s, status)
+	s.LatestInvoice = clone(in)
+
+	f.subscriptions[s.ID] = s
+	f.emit("customer.subscription.created", s)
+	if status == stripe.InvoiceStatusPaid {
+		f.emit("invoice.paid", in)
+	}
+	return clone(s), nil
+}
+
+func (f *fakeStripeClient) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription", id)
+	}
+	return clone(s), nil
+}
+
+func (f *fakeStripeClient) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription", id)
+	}
+	if s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, fakeInvalidRequest("", "A canceled subscription can only update its cancellation_details and metadata.")
+	}
+
+	// Changed items are prorated to the end of the current period, the
+	// prorations are only invoiced right away with always_invoice or when
+	// the billing cycle is reset.
+	now := f.now().Unix()
+	behavior := stringValue(params.ProrationBehavior)
+	prorate := behavior != "none"
+	var prorations []*stripe.InvoiceLineItem
+	for _, ip := range params.Items {
+		if ip.ID == nil {
+			item, err := f.newSubscriptionItem(s.ID, ip)
+			if err != nil {
+				return nil, err
+			}
+			s.Items.Data = append(s.Items.Data, item)
+			if prorate {
+				prorations = append(prorations, f.prorationLine(s, item, 1, now))
+			}
+			continue
+		}
+		idx := -1
+		for i, item := range s.Items.Data {
+			if item.ID == *ip.ID {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			return nil, fakeResourceMissing("subscription_item", *ip.ID)
+		}
+		old := clone(s.Items.Data[idx])
+		if ip.Deleted != nil && *ip.Deleted {
+			s.Items.Data = append(s.Items.Data[:idx], s.Items.Data[idx+1:]...)
+			if prorate {
+				prorations = append(prorations, f.prorationLine(s, old, -1, now))
+			}
+			continue
+		}
+		item := s.Items.Data[idx]
+		if ip.Price != nil {
+			pr, ok := f.prices[*ip.Price]
+			if !ok {
+				return nil, fakeResourceMissing("price", *ip.Price)
+			}
+			item.Price = clone(pr)
+			item.Plan = planFromPrice(pr)
+		}
+		if ip.Quantity != nil {
+			item.Quantity = *ip.Quantity
+		}
+		if prorate && (item.Price.ID != old.Price.ID || item.Quantity != old.Quantity) {
+			prorations = append(prorations, f.prorationLine(s, old, -1, now), f.prorationLine(s, item, 1, now))
+		}
+	}
+	if len(s.Items.Data) == 0 {
+		return nil, fakeInvalidRequest("items", "A subscription must have at least one active plan.")
+	}
+	if params.CancelAtPeriodEnd != nil && s.Schedule != nil {
+		return nil, fakeInvalidRequest("cancel_at_period_end", fmt.Sprintf("The subscription is managed by the subscription schedule `%s`, and updating any cancelation behavior directly is not allowed. Please update the schedule instead.", s.Schedule.ID))
+	}
+	if params.CancelAtPeriodEnd != nil {
+		s.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+		s.CancelAt = 0
+		if s.CancelAtPeriodEnd {
+			s.CancelAt = s.CurrentPeriodEnd
+		}
+	}
+	if params.Metadata != nil {
+		s.Metadata = params.Metadata
+	}
+	if err := f.applyDiscount(s, params); err != nil {
+		return nil, err
+	}
+	if params.PauseCollection != nil {
+		s.PauseCollection = &stripe.SubscriptionPauseCollection{
+			Behavior:  stripe.SubscriptionPauseCollectionBehavior(stringValue(params.PauseCollection.Behavior)),
+			ResumesAt: stripe.Int64Value(params.PauseCollection.ResumesAt),
+		}
+	} else if params.Extra != nil {
+		// An empty pause_collection unsets it.
+		if v, ok := params.Extra.Values["pause_collection"]; ok && len(v) > 0 && v[0] == "" {
+			s.PauseCollection = nil
+		}
+	}
+
+	reset := params.BillingCycleAnchorNow != nil && *params.BillingCycleAnchorNow
+	if reset {
+		s.CurrentPeriodStart = now
+		s.CurrentPeriodEnd = periodEnd(time.Unix(now, 0), s.Items.Data[0].Price.Recurring).Unix()
+		prorations = append(prorations, f.periodLines(s)...)
+	}
+	if len(prorations) > 0 && (reset || behavior == "always_invoice") {
+		status := stripe.InvoiceStatusOpen
+		if f.hasPaymentMethod(s.Customer.ID) {
+			status = stripe.InvoiceStatusPaid
+		}
+		in := f.newInvoice(s, status, prorations...)
+		s.LatestInvoice = clone(in)
+		if status == stripe.InvoiceStatusPaid {
+			f.emit("invoice.paid", in)
+		}
+	}
+
+	f.emit("customer.subscription.updated", s)
+	return clone(s), nil
+}
+
+func (f *fakeStripeClient) CancelSubscription(id string, params *stripe.SubscriptionCancelParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[id]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, fakeResourceMissing("subscription", id)
+	}
+	now := f.now().Unix()
+	s.Status = stripe.SubscriptionStatusCanceled
+	s.CanceledAt = now
+	s.EndedAt = now
+	f.cancelSchedule(s)
+	f.emit("customer.subscription.deleted", s)
+	return clone(s), nil
+}
+
+// DeleteSubscriptionDiscount removes the discount of the subscription.
+func (f *fakeStripeClient) DeleteSubscriptionDiscount(id string, params *stripe.SubscriptionDeleteDiscountParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription", id)
+	}
+	if s.Discount == nil {
+		return nil, fakeResourceMissing("discount", id)
+	}
+	s.Discount = nil
+	f.emit("customer.subscription.updated", s)
+	return clone(s), nil
+}
+
+// ResumeSubscription resumes a subscription paused at the end of its trial,
+// a new period starts and is invoiced right away.
+func (f *fakeStripeClient) ResumeSubscription(id string, params *stripe.SubscriptionResumeParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription", id)
+	}
+	if s.Status != stripe.SubscriptionStatusPaused {
+		return nil, fakeInvalidRequest("", "Only subscriptions with `status=paused` can be resumed.")
+	}
+	now := f.now()
+	s.CurrentPeriodStart = now.Unix()
+	s.CurrentPeriodEnd = periodEnd(now, s.Items.Data[0].Price.Recurring).Unix()
+
+	status := stripe.InvoiceStatusOpen
+	if f.hasPaymentMethod(s.Customer.ID) {
+		status = stripe.InvoiceStatusPaid
+	}
+	in := f.newInvoice(s, status)
+	s.LatestInvoice = clone(in)
+	if status == stripe.InvoiceStatusPaid {
+		s.Status = stripe.SubscriptionStatusActive
+		f.emit("invoice.paid", in)
+	} else {
+		s.Status = stripe.SubscriptionStatusPastDue
+		f.emit("invoice.payment_failed", in)
+	}
+	f.emit("customer.subscription.resumed", s)
+	return clone(s), nil
+}
+
+func (f *fakeStripeClient) NewSubscriptionSchedule(params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subID := stringValue(params.FromSubscription)
+	s, ok := f.subscriptions[subID]
+	if !ok || s.Status == stripe.SubscriptionStatusCanceled {
+		return nil, fakeResourceMissing("subscription", subID)
+	}
+	if s.Schedule != nil {
+		return nil, fakeInvalidRequest("from_subscription", "You cannot migrate a subscription that is already attached to a schedule.")
+	}
+
+	// The first phase is the current period of the subscription.
+	phase := &stripe.SubscriptionSchedulePhase{
+		StartDate: s.CurrentPeriodStart,
+		EndDate:   s.CurrentPeriodEnd,
+	}
+	for _, item := range s.Items.Data {
+		phase.Items = append(phase.Items, &stripe.SubscriptionSchedulePhaseItem{Price: clone(item.Price), Quantity: item.Quantity})
+	}
+	sched := &stripe.SubscriptionSchedule{
+		ID:           f.id("sub_sched"),
+		Object:       "subscription_schedule",
+		Created:      f.now().Unix(),
+		Customer:     &stripe.Customer{ID: s.Customer.ID},
+		CurrentPhase: &stripe.SubscriptionScheduleCurrentPhase{StartDate: phase.StartDate, EndDate: phase.EndDate},
+		EndBehavior:  stripe.SubscriptionScheduleEndBehaviorRelease,
+		Phases:       []*stripe.SubscriptionSchedulePhase{phase},
+		Status:       stripe.SubscriptionScheduleStatusActive,
+		Subscription: &stripe.Subscription{ID: s.ID},
+	}
+	f.schedules[sched.ID] = sched
+	s.Schedule = &stripe.SubscriptionSchedule{ID: sched.ID}
+	f.emit("subscription_schedule.created", sched)
+	return clone(sched), nil
+}
+
+func (f *fakeStripeClient) GetSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sched, ok := f.schedules[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription_schedule", id)
+	}
+	return clone(sched), nil
+}
+
+// UpdateSubscriptionSchedule replaces the phases of the schedule. The first
+// phase must keep the start of the current one, the following ones start at
+// the end of the previous phase.
+func (f *fakeStripeClient) UpdateSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleParams) (*stripe.SubscriptionSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sched, ok := f.schedules[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription_schedule", id)
+	}
+	if sched.Status != stripe.SubscriptionScheduleStatusActive {
+		return nil, fakeInvalidRequest("", fmt.Sprintf("You cannot update a subscription schedule that is currently in the `%s` status.", sched.Status))
+	}
+	if params.EndBehavior != nil {
+		sched.EndBehavior = stripe.SubscriptionScheduleEndBehavior(*params.EndBehavior)
+	}
+	if params.Phases == nil {
+		f.emit("subscription_schedule.updated", sched)
+		return clone(sched), nil
+	}
+
+	var phases []*stripe.SubscriptionSchedulePhase
+	start := sched.CurrentPhase.StartDate
+	for i, pp := range params.Phases {
+		if i == 0 && pp.StartDate != nil && *pp.StartDate != start {
+			return nil, fakeInvalidRequest("phases[0][start_date]", "You can not modify the start date of the current phase.")
+		}
+		phase := &stripe.SubscriptionSchedulePhase{
+			StartDate:         start,
+			ProrationBehavior: stripe.SubscriptionSchedulePhaseProrationBehavior(stringValue(pp.ProrationBehavior)),
+		}
+		for _, ip := range pp.Items {
+			priceID := stringValue(ip.Price)
+			pr, ok := f.prices[priceID]
+			if !ok {
+				return nil, fakeResourceMissing("price", priceID)
+			}
+			item := &stripe.SubscriptionSchedulePhaseItem{Price: clone(pr), Quantity: 1}
+			if pr.Recurring != nil && pr.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+				if ip.Quantity != nil {
+					return nil, fakeInvalidRequest(fmt.Sprintf("phases[%d][items][quantity]", i), "Quantity should not be specified where usage_type is `metered`.")
+				}
+				item.Quantity = 0
+			}
+			if ip.Quantity != nil {
+				item.Quantity = *ip.Quantity
+			}
+			phase.Items = append(phase.Items, item)
+		}
+		if len(phase.Items) == 0 {
+			return nil, fakeInvalidRequest(fmt.Sprintf("phases[%d][items]", i), "Missing required param: items.")
+		}
+		switch {
+		case pp.EndDate != nil:
+			phase.EndDate = *pp.EndDate
+		case pp.Iterations != nil:
+			end := time.Unix(start, 0)
+			for n := int64(0); n < *pp.Iterations; n++ {
+				end = periodEnd(end, phase.Items[0].Price.Recurring)
+			}
+			phase.EndDate = end.Unix()
+		default:
+			return nil, fakeInvalidRequest(fmt.Sprintf("phases[%d][end_date]", i), "The last phase must have an end_date or iterations.")
+		}
+		if phase.EndDate <= start {
+			return nil, fakeInvalidRequest(fmt.Sprintf("phases[%d][end_date]", i), "The end date of a phase must be after its start date.")
+		}
+		phases = append(phases, phase)
+		start = phase.EndDate
+	}
+	sched.Phases = phases
+	sched.CurrentPhase.EndDate = phases[0].EndDate
+	f.emit("subscription_schedule.updated", sched)
+	return clone(sched), nil
+}
+
+// ReleaseSubscriptionSchedule detaches the schedule from its subscription,
+// which keeps its current items.
+func (f *fakeStripeClient) ReleaseSubscriptionSchedule(id string, params *stripe.SubscriptionScheduleReleaseParams) (*stripe.SubscriptionSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sched, ok := f.schedules[id]
+	if !ok {
+		return nil, fakeResourceMissing("subscription_schedule", id)
+	}
+	if sched.Status != stripe.SubscriptionScheduleStatusActive {
+		return nil, fakeInvalidRequest("", fmt.Sprintf("You cannot release a subscription schedule that is currently in the `%s` status.", sched.Status))
+	}
+	f.releaseSchedule(sched)
+	return clone(sched), nil
+}
+
+func (f *fakeStripeClient) releaseSchedule(sched *stripe.SubscriptionSchedule) {
+	sched.Status = stripe.SubscriptionScheduleStatusReleased
+	sched.ReleasedAt = f.now().Unix()
+	sched.ReleasedSubscription = sched.Subscription
+	sched.Subscription = nil
+	sched.CurrentPhase = nil
+	if s, ok := f.subscriptions[sched.ReleasedSubscription.ID]; ok {
+		s.Schedule = nil
+	}
+	f.emit("subscription_schedule.released", sched)
+}
+
+// cancelSchedule cancels the schedule of a subscription that ended.
+func (f *fakeStripeClient) cancelSchedule(s *stripe.Subscription) {
+	if s.Schedule == nil {
+		return
+	}
+	sched := f.schedules[s.Schedule.ID]
+	sched.Status = stripe.SubscriptionScheduleStatusCanceled
+	sched.CanceledAt = f.now().Unix()
+	sched.CurrentPhase = nil
+	s.Schedule = nil
+	f.emit("subscription_schedule.canceled", sched)
+}
+
+// applyPhase sets the items of the subscription to the ones of the schedule
+// phase, the items of a price the subscription already has are kept.
+func (f *fakeStripeClient) applyPhase(s *stripe.Subscription, phase *stripe.SubscriptionSchedulePhase) error {
+	var items []*stripe.SubscriptionItem
+	for _, pi := range phase.Items {
+		var item *stripe.SubscriptionItem
+		for _, current := range s.Items.Data {
+			if current.Price.ID == pi.Price.ID {
+				item = current
+			}
+		}
+		if item == nil {
+			var err error
+			item, err = f.newSubscriptionItem(s.ID, &stripe.SubscriptionItemsParams{Price: stripe.String(pi.Price.ID)})
+			if err != nil {
+				return err
+			}
+		}
+		item.Quantity = pi.Quantity
+		items = append(items, item)
+	}
+	s.Items.Data = items
+	return nil
+}
+
+func (f *fakeStripeClient) GetProduct(id string, params *stripe.ProductParams) (*stripe.Product, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.products[id]
+	if !ok {
+		return nil, fakeResourceMissing("product", id)
+	}
+	return clone(p), nil
+}
+
+func (f *fakeStripeClient) GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pr, ok := f.prices[id]
+	if !ok {
+		return nil, fakeResourceMissing("price", id)
+	}
+	return clone(pr), nil
+}
+
+func (f *fakeStripeClient) ListPrices(params *stripe.PriceListParams) ([]*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var prices []*stripe.Price
+	for _, pr := range f.prices {
+		if params != nil && params.Active != nil && pr.Active != *params.Active {
+			continue
+		}
+		prices = append(prices, clone(pr))
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].ID < prices[j].ID })
+	return prices, nil
+}
+
+func (f *fakeStripeClient) GetCoupon(id string, params *stripe.CouponParams) (*stripe.Coupon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.coupons[id]
+	if !ok {
+		return nil, fakeResourceMissing("coupon", id)
+	}
+	return clone(c), nil
+}
+
+// ListPromotionCodes filters the promotion codes by code, case-insensitive,
+// and by active. Their coupon is always expanded.
+func (f *fakeStripeClient) ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var codes []*stripe.PromotionCode
+	for _, pc := range f.promotionCodes {
+		if params != nil && params.Code != nil && !strings.EqualFold(pc.Code, *params.Code) {
+			continue
+		}
+		if params != nil && params.Active != nil && pc.Active != *params.Active {
+			continue
+		}
+		pc = clone(pc)
+		pc.Coupon = clone(f.coupons[pc.Coupon.ID])
+		codes = append(codes, pc)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID < codes[j].ID })
+	return codes, nil
+}
+
+func (f *fakeStripeClient) ListPaymentMethods(params *stripe.PaymentMethodListParams) ([]*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	customerID := stringValue(params.Customer)
+	if _, ok := f.customers[customerID]; !ok {
+		return nil, fakeResourceMissing("customer", customerID)
+	}
+	var pms []*stripe.PaymentMethod
+	for _, pm := range f.paymentMethods {
+		if pm.Customer != nil && pm.Customer.ID == customerID {
+			pms = append(pms, clone(pm))
+		}
+	}
+	sort.Slice(pms, func(i, j int) bool { return pms[i].ID < pms[j].ID })
+	return pms, nil
+}
+
+// AttachPaymentMethod accepts any ID starting with "pm_", such as the
+// "pm_card_visa" test payment method, and creates a card for it.
+func (f *fakeStripeClient) AttachPaymentMethod(id string, params *stripe.PaymentMethodAttachParams) (*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	customerID := stringValue(params.Customer)
+	if _, ok := f.customers[customerID]; !ok {
+		return nil, fakeResourceMissing("customer", customerID)
+	}
+	if !strings.HasPrefix(id, "pm_") {
+		return nil, fakeResourceMissing("payment_method", id)
+	}
+	pm, ok := f.paymentMethods[id]
+	if !ok {
+		pm = &stripe.PaymentMethod{
+			ID:      id,
+			Object:  "payment_method",
+			Created: f.now().Unix(),
+			Type:    stripe.PaymentMethodTypeCard,
+			Card:    &stripe.PaymentMethodCard{Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: int64(f.now().Year() + 3)},
+		}
+		f.paymentMethods[id] = pm
+	}
+	pm.Customer = &stripe.Customer{ID: customerID}
+	f.emit("payment_method.attached", pm)
+	return clone(pm), nil
+}
+
+// FailUsageRecords makes the next n usage records fail, like an outage of the
+// Stripe API would.
+func (f *fakeStripeClient) FailUsageRecords(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.usageErrors = n
+}
+
+// Usage returns the usage recorded on a metered subscription item.
+func (f *fakeStripeClient) Usage(itemID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.usage[itemID]
+}
+
+// UsageRecords returns the usage records of a metered subscription item,
+// oldest first.
+func (f *fakeStripeClient) UsageRecords(itemID string) []*stripe.UsageRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var records []*stripe.UsageRecord
+	for _, ur := range f.usageRecords {
+		if ur.SubscriptionItem == itemID {
+			records = append(records, clone(ur))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Timestamp < records[j].Timestamp })
+	return records
+}
+
+func (f *fakeStripeClient) NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.usageErrors > 0 {
+		f.usageErrors--
+		return nil, &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusServiceUnavailable, Msg: "Stripe is unavailable."}
+	}
+	itemID := stringValue(params.SubscriptionItem)
+	if params.IdempotencyKey != nil {
+		key := *params.IdempotencyKey
+		sent := fmt.Sprint(itemID, int64Value(params.Quantity), int64Value(params.Timestamp), stringValue(params.Action))
+		if first, ok := f.usageKeys[key]; ok && first != sent {
+			return nil, &stripe.Error{Type: stripe.ErrorTypeIdempotency, HTTPStatusCode: http.StatusBadRequest,
+				Msg: "Keys for idempotent requests can only be used with the same parameters they were first used with."}
+		}
+		f.usageKeys[key] = sent
+		if ur, ok := f.usageRecords[key]; ok {
+			return clone(ur), nil
+		}
+	}
+
+	var sub *stripe.Subscription
+	var item *stripe.SubscriptionItem
+	for _, s := range f.subscriptions {
+		for _, si := range s.Items.Data {
+			if si.ID == itemID {
+				sub, item = s, si
+			}
+		}
+	}
+	if item == nil {
+		return nil, fakeResourceMissing("subscription_item", itemID)
+	}
+	if item.Price.Recurring == nil || item.Price.Recurring.UsageType != stripe.PriceRecurringUsageTypeMetered {
+		return nil, fakeInvalidRequest("subscription_item", "Usage records can only be created for metered prices.")
+	}
+	// The usage of a period whose invoice is finalized can no longer change.
+	if params.Timestamp != nil && (*params.Timestamp < sub.CurrentPeriodStart || *params.Timestamp > sub.CurrentPeriodEnd) {
+		return nil, fakeInvalidRequest("timestamp", "Cannot create the usage record with this timestamp because timestamps must be after the subscription's last invoice period (or current period start time).")
+	}
+
+	ur := &stripe.UsageRecord{
+		ID:               f.id("mbur"),
+		Object:           "usage_record",
+		SubscriptionItem: itemID,
+		Timestamp:        f.now().Unix(),
+	}
+	if params.Quantity != nil {
+		ur.Quantity = *params.Quantity
+	}
+	if params.Timestamp != nil {
+		ur.Timestamp = *params.Timestamp
+	}
+	if stringValue(params.Action) == "set" {
+		f.usage[itemID] = ur.Quantity
+	} else {
+		f.usage[itemID] += ur.Quantity
+	}
+	if params.IdempotencyKey != nil {
+		f.usageRecords[*params.IdempotencyKey] = ur
+	}
+	return clone(ur), nil
+}
+
+func (f *fakeStripeClient) GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.invoices[id]
+	if !ok {
+		return nil, fakeResourceMissing("invoice", id)
+	}
+	return clone(in), nil
+}
+
+// UpcomingInvoice bills the items the subscription would have after the
+// SubscriptionItems changes, for a full period and without prorations.
+// ListInvoices filters the invoices by customer, subscription and status,
+// newest first like Stripe.
+func (f *fakeStripeClient) ListInvoices(params *stripe.InvoiceListParams) ([]*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var invoices []*stripe.Invoice
+	for _, in := range f.invoices {
+		switch {
+		case params.Customer != nil && in.Customer.ID != *params.Customer:
+			continue
+		case params.Subscription != nil && (in.Subscription == nil || in.Subscription.ID != *params.Subscription):
+			continue
+		case params.Status != nil && string(in.Status) != *params.Status:
+			continue
+		}
+		invoices = append(invoices, clone(in))
+	}
+	sort.Slice(invoices, func(i, j int) bool {
+		if invoices[i].Created != invoices[j].Created {
+			return invoices[i].Created > invoices[j].Created
+		}
+		return invoices[i].ID > invoices[j].ID
+	})
+	return invoices, nil
+}
+
+func (f *fakeStripeClient) UpcomingInvoice(params *stripe.InvoiceUpcomingParams) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	subID := stringValue(params.Subscription)
+	s, ok := f.subscriptions[subID]
+	if !ok {
+		return nil, fakeResourceMissing("subscription", subID)
+	}
+	// Changed items are prorated from the proration date to the end of the
+	// current period, unless prorations are disabled.
+	prorationDate := f.now().Unix()
+	if params.SubscriptionProrationDate != nil {
+		prorationDate = *params.SubscriptionProrationDate
+	}
+	prorate := stringValue(params.SubscriptionProrationBehavior) != "none"
+	var prorations []*stripe.InvoiceLineItem
+
+	preview := clone(s)
+	for _, ip := range params.SubscriptionItems {
+		deleted := ip.Deleted != nil && *ip.Deleted
+		switch {
+		case ip.ID != nil:
+			for i, item := range preview.Items.Data {
+				if item.ID != *ip.ID {
+					continue
+				}
+				old := clone(item)
+				if deleted {
+					preview.Items.Data = append(preview.Items.Data[:i], preview.Items.Data[i+1:]...)
+				} else {
+					if ip.Price != nil {
+						pr, ok := f.prices[*ip.Price]
+						if !ok {
+							return nil, fakeResourceMissing("price", *ip.Price)
+						}
+						item.Price = clone(pr)
+					}
+					if ip.Quantity != nil {
+						item.Quantity = *ip.Quantity
+					}
+				}
+				if prorate && (deleted || item.Price.ID != old.Price.ID || item.Quantity != old.Quantity) {
+					prorations = append(prorations, f.prorationLine(s, old, -1, prorationDate))
+					if !deleted {
+						prorations = append(prorations, f.prorationLine(s, item, 1, prorationDate))
+					}
+				}
+				break
+			}
+		case !deleted:
+			item, err := f.newSubscriptionItem(s.ID, ip)
+			if err != nil {
+				return nil, err
+			}
+			preview.Items.Data = append(preview.Items.Data, item)
+			if prorate {
+				prorations = append(prorations, f.prorationLine(s, item, 1, prorationDate))
+			}
+		}
+	}
+
+	in := &stripe.Invoice{
+		Object:       "invoice",
+		Customer:     &stripe.Customer{ID: s.Customer.ID},
+		Subscription: &stripe.Subscription{ID: s.ID},
+		Currency:     s.Currency,
+		Status:       stripe.InvoiceStatusDraft,
+		PeriodStart:  s.CurrentPeriodEnd,
+		PeriodEnd:    periodEnd(time.Unix(s.CurrentPeriodEnd, 0), preview.Items.Data[0].Price.Recurring).Unix(),
+		Lines:        &stripe.InvoiceLineItemList{Data: prorations},
+	}
+	// A reset billing cycle starts the next period at the proration date.
+	if params.SubscriptionBillingCycleAnchorNow != nil && *params.SubscriptionBillingCycleAnchorNow {
+		in.PeriodStart = prorationDate
+		in.PeriodEnd = periodEnd(time.Unix(prorationDate, 0), preview.Items.Data[0].Price.Recurring).Unix()
+	}
+	for _, line := range prorations {
+		in.Subtotal += line.Amount
+	}
+	for _, item := range preview.Items.Data {
+		amount := item.Price.UnitAmount * item.Quantity
+		in.Lines.Data = append(in.Lines.Data, &stripe.InvoiceLineItem{
+			ID:       f.id("il"),
+			Object:   "line_item",
+			Amount:   amount,
+			Currency: item.Price.Currency,
+			Price:    clone(item.Price),
+			Quantity: item.Quantity,
+			Period:   &stripe.Period{Start: in.PeriodStart, End: in.PeriodEnd},
+		})
+		in.Subtotal += amount
+	}
+	in.Total = in.Subtotal
+	// A negative total is credited to the customer balance.
+	if in.Total > 0 {
+		in.AmountDue = in.Total
+		in.AmountRemaining = in.Total
+	}
+	return in, nil
+}
+
+// NewRefund refunds a payment intent of a paid invoice, up to the amount
+// paid that is not refunded yet.
+func (f *fakeStripeClient) NewRefund(params *stripe.RefundParams) (*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	piID := stringValue(params.PaymentIntent)
+	var paid *stripe.Invoice
+	for _, in := range f.invoices {
+		if in.PaymentIntent != nil && in.PaymentIntent.ID == piID {
+			paid = in
+		}
+	}
+	if paid == nil {
+		return nil, fakeResourceMissing("payment_intent", piID)
+	}
+	if paid.PaymentIntent.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, fakeInvalidRequest("payment_intent", "This PaymentIntent does not have a successful charge to refund.")
+	}
+	left := paid.AmountPaid - f.refunded[piID]
+	amount := left
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+	if amount <= 0 || amount > left {
+		return nil, fakeInvalidRequest("amount", fmt.Sprintf("Refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, left))
+	}
+	f.refunded[piID] += amount
+	return &stripe.Refund{
+		ID:            f.id("re"),
+		Object:        "refund",
+		Amount:        amount,
+		Created:       f.now().Unix(),
+		Currency:      paid.Currency,
+		PaymentIntent: &stripe.PaymentIntent{ID: piID},
+		Reason:        stripe.RefundReason(stringValue(params.Reason)),
+		Status:        stripe.RefundStatusSucceeded,
+	}, nil
+}
+
+// Refunded returns the amount refunded of the payment intent.
+func (f *fakeStripeClient) Refunded(piID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.refunded[piID]
+}
+
+// prorationLine credits, with a sign of -1, or charges the time of item left
+// in the current period of s from date.
+func (f *fakeStripeClient) prorationLine(s *stripe.Subscription, item *stripe.SubscriptionItem, sign int64, date int64) *stripe.InvoiceLineItem {
+	var amount int64
+	if total := s.CurrentPeriodEnd - s.CurrentPeriodStart; total > 0 && date < s.CurrentPeriodEnd {
+		amount = sign * item.Price.UnitAmount * item.Quantity * (s.CurrentPeriodEnd - date) / total
+	}
+	description := "Remaining time on %d × %s"
+	if sign < 0 {
+		description = "Unused time on %d × %s"
+	}
+	return &stripe.InvoiceLineItem{
+		ID:          f.id("il"),
+		Object:      "line_item",
+		Amount:      amount,
+		Currency:    item.Price.Currency,
+		Description: fmt.Sprintf(description, item.Quantity, item.Price.ID),
+		Price:       clone(item.Price),
+		Proration:   true,
+		Quantity:    item.Quantity,
+		Period:      &stripe.Period{Start: date, End: s.CurrentPeriodEnd},
+	}
+}
+
+func (f *fakeStripeClient) GetEvent(id string, params *stripe.EventParams) (*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, ev := range f.events {
+		if ev.ID == id {
+			return clone(ev), nil
+		}
+	}
+	return nil, fakeResourceMissing("event", id)
+}
+
+// ListEvents returns the recorded events, newest first like Stripe.
+func (f *fakeStripeClient) ListEvents(params *stripe.EventListParams) ([]*stripe.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	types := map[string]bool{}
+	if params != nil {
+		for _, t := range params.Types {
+			types[*t] = true
+		}
+		if params.Type != nil {
+			types[*params.Type] = true
+		}
+	}
+	var events []*stripe.Event
+	for i := len(f.events) - 1; i >= 0; i-- {
+		ev := f.events[i]
+		if len(types) > 0 && !types[ev.Type] {
+			continue
+		}
+		if params != nil && params.CreatedRange != nil {
+			r := params.CreatedRange
+			if (r.GreaterThanOrEqual > 0 && ev.Created < r.GreaterThanOrEqual) ||
+				(r.LesserThanOrEqual > 0 && ev.Created > r.LesserThanOrEqual) {
+				continue
+			}
+		}
+		events = append(events, clone(ev))
+	}
+	return events, nil
+}
+
+// customer returns a copy of the customer with its subscriptions expanded.
+func (f *fakeStripeClient) customer(id string) *stripe.Customer {
+	c := clone(f.customers[id])
+	c.Subscriptions = &stripe.SubscriptionList{}
+	for _, s := range f.sortedSubscriptions() {
+		if s.Customer.ID == id && s.Status != stripe.SubscriptionStatusCanceled {
+			c.Subscriptions.Data = append(c.Subscriptions.Data, clone(s))
+		}
+	}
+	return c
+}
+
+func (f *fakeStripeClient) sortedSubscriptions() []*stripe.Subscription {
+	var subs []*stripe.Subscription
+	for _, s := range f.subscriptions {
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+// applyDiscount redeems the coupon or the promotion code of params on the
+// subscription, replacing its discount.
+func (f *fakeStripeClient) applyDiscount(s *stripe.Subscription, params *stripe.SubscriptionParams) error {
+	var pc *stripe.PromotionCode
+	couponID := stringValue(params.Coupon)
+	if params.PromotionCode != nil {
+		var ok bool
+		if pc, ok = f.promotionCodes[*params.PromotionCode]; !ok {
+			return fakeResourceMissing("promotion_code", *params.PromotionCode)
+		}
+		if !pc.Active || (pc.MaxRedemptions != 0 && pc.TimesRedeemed >= pc.MaxRedemptions) {
+			return fakeInvalidRequest("promotion_code", fmt.Sprintf("This promotion code cannot be redeemed: `%s`.", pc.ID))
+		}
+		couponID = pc.Coupon.ID
+	}
+	if couponID == "" {
+		return nil
+	}
+	c, ok := f.coupons[couponID]
+	if !ok {
+		return fakeResourceMissing("coupon", couponID)
+	}
+	if !c.Valid {
+		return fakeInvalidRequest("coupon", fmt.Sprintf("Coupon expired: %s", c.ID))
+	}
+
+	now := f.now()
+	d := &stripe.Discount{
+		ID:           f.id("di"),
+		Object:       "discount",
+		Coupon:       clone(c),
+		Customer:     &stripe.Customer{ID: s.Customer.ID},
+		Start:        now.Unix(),
+		Subscription: s.ID,
+	}
+	if c.Duration == stripe.CouponDurationRepeating {
+		d.End = now.AddDate(0, int(c.DurationInMonths), 0).Unix()
+	}
+	if pc != nil {
+		pc.TimesRedeemed++
+		d.PromotionCode = clone(pc)
+		d.PromotionCode.Coupon = &stripe.Coupon{ID: c.ID}
+	}
+	c.TimesRedeemed++
+	if c.MaxRedemptions != 0 && c.TimesRedeemed >= c.MaxRedemptions {
+		c.Valid = false
+	}
+	s.Discount = d
+	return nil
+}
+
+func (f *fakeStripeClient) hasPaymentMethod(customerID string) bool {
+	for _, pm := range f.paymentMethods {
+		if pm.Customer != nil && pm.Customer.ID == customerID {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeStripeClient) newSubscriptionItem(subID string, ip *stripe.SubscriptionItemsParams) (*stripe.SubscriptionItem, error) {
+	priceID := stringValue(ip.Price)
+	pr, ok := f.prices[priceID]
+	if !ok {
+		return nil, fakeResourceMissing("price", priceID)
+	}
+	item := &stripe.SubscriptionItem{
+		ID:           f.id("si"),
+		Object:       "subscription_item",
+		Created:      f.now().Unix(),
+		Price:        clone(pr),
+		Plan:         planFromPrice(pr),
+		Quantity:     1,
+		Subscription: subID,
+	}
+	if pr.Recurring != nil && pr.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+		if ip.Quantity != nil {
+			return nil, fakeInvalidRequest("quantity", "Quantity should not be specified where usage_type is `metered`.")
+		}
+		item.Quantity = 0
+	}
+	if ip.Quantity != nil {
+		item.Quantity = *ip.Quantity
+	}
+	return item, nil
+}
+
+// newInvoice stores an invoice billing lines, or the current items of s for
+// its current period when there are none.
+func (f *fakeStripeClient) newInvoice(s *stripe.Subscription, status stripe.InvoiceStatus, lines ...*stripe.InvoiceLineItem) *stripe.Invoice {
+	in := &stripe.Invoice{
+		ID:           f.id("in"),
+		Object:       "invoice",
+		Created:      f.now().Unix(),
+		Customer:     &stripe.Customer{ID: s.Customer.ID},
+		Subscription: &stripe.Subscription{ID: s.ID},
+		Currency:     s.Currency,
+		Status:       status,
+		PeriodStart:  s.CurrentPeriodStart,
+		PeriodEnd:    s.CurrentPeriodEnd,
+		Lines:        &stripe.InvoiceLineItemList{Data: lines},
+	}
+	in.Number = strings.ToUpper(strings.TrimPrefix(in.ID, "in_"))
+	in.HostedInvoiceURL = "https://invoice.stripe.test/" + in.ID
+	in.InvoicePDF = in.HostedInvoiceURL + "/pdf"
+	if len(lines) == 0 {
+		in.Lines.Data = f.periodLines(s)
+	}
+	for _, line := range in.Lines.Data {
+		in.Total += line.Amount
+	}
+	if d := s.Discount; d != nil && in.Total > 0 && (d.End == 0 || d.End > in.Created) {
+		off := d.Coupon.AmountOff
+		if d.Coupon.PercentOff > 0 {
+			off = int64(float64(in.Total) * d.Coupon.PercentOff / 100)
+		}
+		if off > in.Total {
+			off = in.Total
+		}
+		in.Total -= off
+		in.Discount = clone(d)
+		// The discount is split between the lines charged, like Stripe.
+		var charged int64
+		for _, line := range in.Lines.Data {
+			if line.Amount > 0 {
+				charged += line.Amount
+			}
+		}
+		left, unshared := off, charged
+		for _, line := range in.Lines.Data {
+			if line.Amount <= 0 {
+				continue
+			}
+			share := off * line.Amount / charged
+			if unshared -= line.Amount; unshared == 0 {
+				share = left
+			}
+			left -= share
+			line.DiscountAmounts = []*stripe.InvoiceLineItemDiscountAmount{{Amount: share, Discount: clone(d)}}
+		}
+	}
+	// A negative total is credited to the customer balance.
+	if in.Total > 0 {
+		in.AmountDue = in.Total
+	}
+	in.AmountRemaining = in.AmountDue
+	pi := &stripe.PaymentIntent{ID: f.id("pi"), Object: "payment_intent", Amount: in.AmountDue, Status: stripe.PaymentIntentStatusRequiresPaymentMethod}
+	pi.ClientSecret = pi.ID + "_secret_fake"
+	if status == stripe.InvoiceStatusPaid {
+		in.Paid = true
+		in.AmountPaid = in.AmountDue
+		in.AmountRemaining = 0
+		pi.Status = stripe.PaymentIntentStatusSucceeded
+	}
+	in.PaymentIntent = pi
+	f.invoices[in.ID] = in
+	return in
+}
+
+// periodLines bills the items of s for its current period.
+func (f *fakeStripeClient) periodLines(s *stripe.Subscription) []*stripe.InvoiceLineItem {
+	var lines []*stripe.InvoiceLineItem
+	for _, item := range s.Items.Data {
+		lines = append(lines, &stripe.InvoiceLineItem{
+			ID:       f.id("il"),
+			Object:   "line_item",
+			Amount:   item.Price.UnitAmount * item.Quantity,
+			Currency: item.Price.Currency,
+			Price:    clone(item.Price),
+			Quantity: item.Quantity,
+			Period:   &stripe.Period{Start: s.CurrentPeriodStart, End: s.CurrentPeriodEnd},
+		})
+	}
+	return lines
+}
+
+// emit records the event Stripe would send for obj.
+func (f *fakeStripeClient) emit(eventType string, obj interface{}) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	ev := &stripe.Event{
+		ID:         f.id("evt"),
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    f.now().Unix(),
+		Type:       eventType,
+		Data:       &stripe.EventData{Raw: raw},
+	}
+	if err := json.Unmarshal(raw, &ev.Data.Object); err != nil {
+		panic(err)
+	}
+	f.events = append(f.events, ev)
+	if f.deliveries != nil {
+		f.deliveries <- clone(ev)
+	}
+}
+
+func (f *fakeStripeClient) id(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake%s%06d", prefix, f.run, f.seq)
+}
+
+func planFromPrice(pr *stripe.Price) *stripe.Plan {
+	p := &stripe.Plan{
+		ID:       pr.ID,
+		Object:   "plan",
+		Active:   pr.Active,
+		Amount:   pr.UnitAmount,
+		Currency: pr.Currency,
+		Product:  clone(pr.Product),
+		Metadata: pr.Metadata,
+	}
+	if pr.Recurring != nil {
+		p.Interval = stripe.PlanInterval(pr.Recurring.Interval)
+		p.IntervalCount = pr.Recurring.IntervalCount
+		p.UsageType = stripe.PlanUsageType(pr.Recurring.UsageType)
+	}
+	return p
+}
+
+func periodEnd(start time.Time, r *stripe.PriceRecurring) time.Time {
+	count := 1
+	interval := stripe.PriceRecurringIntervalMonth
+	if r != nil {
+		if r.IntervalCount > 0 {
+			count = int(r.IntervalCount)
+		}
+		interval = r.Interval
+	}
+	switch interval {
+	case stripe.PriceRecurringIntervalDay:
+		return start.AddDate(0, 0, count)
+	case stripe.PriceRecurringIntervalWeek:
+		return start.AddDate(0, 0, 7*count)
+	case stripe.PriceRecurringIntervalYear:
+		return start.AddDate(count, 0, 0)
+	}
+	return start.AddDate(0, count, 0)
+}
+
+func fakeResourceMissing(kind, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", kind, id),
+	}
+}
+
+func fakeInvalidRequest(param, msg string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		HTTPStatusCode: http.StatusBadRequest,
+		Param:          param,
+		Msg:            msg,
+	}
+}
+
+// clone deep copies a Stripe object the way it would come out of the API.
+func clone[T any](v *T) *T {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	c := new(T)
+	if err := json.Unmarshal(b, c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func int64Value(i *int64) int64 {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
+
+// fakeRoutes lets a developer drive the payments of the fake, which Stripe
+// would otherwise take from the customer.
+func (f *fakeStripeClient) fakeRoutes(mux *bone.Mux) {
+	mux.Post("/fake/subscriptions/:subId/pay", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.handlePayment(w, f.PayLatestInvoice(bone.GetValue(r, "subId")))
+	}))
+	mux.Post("/fake/subscriptions/:subId/fail", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.handlePayment(w, f.FailPayment(bone.GetValue(r, "subId")))
+	}))
+	mux.Post("/fake/subscriptions/:subId/renew", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.handlePayment(w, f.RenewSubscription(bone.GetValue(r, "subId")))
+	}))
+}
+
+func (f *fakeStripeClient) handlePayment(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, "")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// newTestFake returns a fake holding one monthly price, with a clock stopped
+// at the start of 2024.
+func newTestFake(t *testing.T) (*fakeStripeClient, func() []string) {
+	f := newFakeStripeClient()
+	f.now = func() time.Time { return time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC) }
+	f.AddPrice(&stripe.Price{
+		ID:         "price_test",
+		Object:     "price",
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		UnitAmount: 1000,
+		Type:       stripe.PriceTypeRecurring,
+		Product:    &stripe.Product{ID: "prod_test", Active: true, Name: "Test"},
+	})
+	// events returns the types of the events emitted since the last call.
+	seen := 0
+	events := func() []string {
+		t.Helper()
+		var types []string
+		for _, ev := range f.events[seen:] {
+			types = append(types, ev.Type)
+		}
+		seen = len(f.events)
+		return types
+	}
+	return f, events
+}
+
+func newTestFakeSubscription(t *testing.T, api StripeClient, params *stripe.SubscriptionParams) (*stripe.Customer, *stripe.Subscription) {
+	t.Helper()
+	c, err := api.NewCustomer(&stripe.CustomerParams{Email: stripe.String("a@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Customer = stripe.String(c.ID)
+	params.Items = []*stripe.SubscriptionItemsParams{{Price: stripe.String("price_test")}}
+	s, err := api.NewSubscription(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func isResourceMissing(err error) bool {
+	var serr *stripe.Error
+	return errors.As(err, &serr) && serr.Code == stripe.ErrorCodeResourceMissing
+}
+
+func TestFakeStripeClient(t *testing.T) {
+	t.Run("missing resources", func(t *testing.T) {
+		f, _ := newTestFake(t)
+		var api StripeClient = f
+		if _, err := api.GetCustomer("cus_missing", nil); !isResourceMissing(err) {
+			t.Fatalf("got %v getting a missing customer, want resource_missing", err)
+		}
+		if _, err := api.GetSubscription("sub_missing", nil); !isResourceMissing(err) {
+			t.Fatalf("got %v getting a missing subscription, want resource_missing", err)
+		}
+		params := &stripe.SubscriptionParams{
+			Customer: stripe.String("cus_missing"),
+			Items:    []*stripe.SubscriptionItemsParams{{Price: stripe.String("price_test")}},
+		}
+		if _, err := api.NewSubscription(params); !isResourceMissing(err) {
+			t.Fatalf("got %v subscribing a missing customer, want resource_missing", err)
+		}
+	})
+
+	t.Run("incomplete until paid", func(t *testing.T) {
+		f, events := newTestFake(t)
+		_, s := newTestFakeSubscription(t, f, &stripe.SubscriptionParams{})
+		if s.Status != stripe.SubscriptionStatusIncomplete || s.LatestInvoice.Status != stripe.InvoiceStatusOpen {
+			t.Fatalf("got subscription %s with invoice %s, want it incomplete until paid", s.Status, s.LatestInvoice.Status)
+		}
+		if err := f.PayLatestInvoice(s.ID); err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.GetSubscription(s.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != stripe.SubscriptionStatusActive || got.LatestInvoice.Status != stripe.InvoiceStatusPaid || got.LatestInvoice.AmountPaid != 1000 {
+			t.Fatalf("got subscription %s with invoice %s paying %d, want it active", got.Status, got.LatestInvoice.Status, got.LatestInvoice.AmountPaid)
+		}
+		want := []string{"customer.created", "customer.subscription.created", "invoice.paid", "customer.subscription.updated"}
+		if got := events(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+	})
+
+	t.Run("renewals", func(t *testing.T) {
+		f, events := newTestFake(t)
+		c, err := f.NewCustomer(&stripe.CustomerParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.AttachPaymentMethod("pm_card_visa", &stripe.PaymentMethodAttachParams{Customer: stripe.String(c.ID)}); err != nil {
+			t.Fatal(err)
+		}
+		params := &stripe.SubscriptionParams{
+			Customer: stripe.String(c.ID),
+			Items:    []*stripe.SubscriptionItemsParams{{Price: stripe.String("price_test")}},
+		}
+		s, err := f.NewSubscription(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != stripe.SubscriptionStatusActive {
+			t.Fatalf("got subscription %s with a payment method, want it active", s.Status)
+		}
+		end := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC).Unix()
+		if s.CurrentPeriodEnd != end {
+			t.Fatalf("got period end %d, want %d", s.CurrentPeriodEnd, end)
+		}
+		events()
+
+		if err := f.RenewSubscription(s.ID); err != nil {
+			t.Fatal(err)
+		}
+		if s, err = f.GetSubscription(s.ID, nil); err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != stripe.SubscriptionStatusActive || s.CurrentPeriodStart != end || s.CurrentPeriodEnd != time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix() {
+			t.Fatalf("got subscription %s from %d to %d after the renewal", s.Status, s.CurrentPeriodStart, s.CurrentPeriodEnd)
+		}
+		if got, want := events(), []string{"invoice.paid", "customer.subscription.updated"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+
+		if err := f.FailPayment(s.ID); err != nil {
+			t.Fatal(err)
+		}
+		if s, err = f.GetSubscription(s.ID, nil); err != nil || s.Status != stripe.SubscriptionStatusPastDue {
+			t.Fatalf("got subscription %+v (%v) after a failed payment, want it past_due", s, err)
+		}
+		if got, want := events(), []string{"invoice.payment_failed", "customer.subscription.updated"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got events %v, want %v", got, want)
+		}
+
+		if s, err = f.CancelSubscription(s.ID, nil); err != nil || s.Status != stripe.SubscriptionStatusCanceled || s.EndedAt == 0 {
+			t.Fatalf("got subscription %+v (%v) after the cancellation, want it canceled", s, err)
+		}
+		if _, err := f.CancelSubscription(s.ID, nil); !isResourceMissing(err) {
+			t.Fatalf("got %v canceling a canceled subscription, want resource_missing", err)
+		}
+		if err := f.RenewSubscription(s.ID); !isResourceMissing(err) {
+			t.Fatalf("got %v renewing a canceled subscription, want resource_missing", err)
+		}
+	})
+
+	t.Run("trials", func(t *testing.T) {
+		for _, tt := range []struct {
+			behavior string
+			status   stripe.SubscriptionStatus
+			event    string
+		}{
+			{"create_invoice", stripe.SubscriptionStatusPastDue, "customer.subscription.updated"},
+			{"pause", stripe.SubscriptionStatusPaused, "customer.subscription.paused"},
+			{"cancel", stripe.SubscriptionStatusCanceled, "customer.subscription.deleted"},
+		} {
+			f, events := newTestFake(t)
+			_, s := newTestFakeSubscription(t, f, &stripe.SubscriptionParams{
+				TrialPeriodDays: stripe.Int64(14),
+				TrialSettings: &stripe.SubscriptionTrialSettingsParams{
+					EndBehavior: &stripe.SubscriptionTrialSettingsEndBehaviorParams{MissingPaymentMethod: stripe.String(tt.behavior)},
+				},
+			})
+			if s.Status != stripe.SubscriptionStatusTrialing || s.PendingSetupIntent == nil || s.LatestInvoice.AmountDue != 0 {
+				t.Fatalf("got subscription %s, want a free trial collecting a payment method", s.Status)
+			}
+			events()
+			if err := f.RenewSubscription(s.ID); err != nil {
+				t.Fatal(err)
+			}
+			got, err := f.GetSubscription(s.ID, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			evs := events()
+			if got.Status != tt.status || evs[len(evs)-1] != tt.event {
+				t.Fatalf("got subscription %s and events %v at the end of a trial ending with %s, want %s and %s", got.Status, evs, tt.behavior, tt.status, tt.event)
+			}
+		}
+	})
+}
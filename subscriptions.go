@@ -0,0 +1,910 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/stripe/stripe-go/v74"
+)
+
+// Subscription is the local copy of a Stripe subscription, kept current by the
+// customer.subscription.* webhooks and the subscription handlers.
+type Subscription struct {
+	ID                 string `json:"id"                   db:"id"`
+	OrgID              int    `json:"org_id"               db:"org_id"`
+	CustomerID         string `json:"customer_id"          db:"customer_id"`
+	Status             string `json:"status"               db:"status"`
+	Currency           string `json:"currency"             db:"currency"`
+	CurrentPeriodStart int64  `json:"current_period_start" db:"current_period_start"`
+	CurrentPeriodEnd   int64  `json:"current_period_end"   db:"current_period_end"`
+	CancelAt           int64  `json:"cancel_at"            db:"cancel_at"`
+	CancelAtPeriodEnd  bool   `json:"cancel_at_period_end" db:"cancel_at_period_end"`
+	CanceledAt         int64  `json:"canceled_at"          db:"canceled_at"`
+	TrialEnd           int64  `json:"trial_end"            db:"trial_end"`
+	Created            int64  `json:"created"              db:"created"`
+	// PauseBehavior is the behavior of the pause_collection of the
+	// subscription, empty when it is not paused.
+	PauseBehavior  string `json:"pause_behavior"   db:"pause_behavior"`
+	PauseResumesAt int64  `json:"pause_resumes_at" db:"pause_resumes_at"`
+	PausedBy       string `json:"paused_by"        db:"paused_by"`
+	PausedAt       int64  `json:"paused_at"        db:"paused_at"`
+	// TrialEndBehavior is what ends the trial when the customer has no
+	// payment method by then, cancel or pause. TrialWillEndAt is when Stripe
+	// announced the end of the trial.
+	TrialEndBehavior string `json:"trial_end_behavior" db:"trial_end_behavior"`
+	TrialWillEndAt   int64  `json:"trial_will_end_at"  db:"trial_will_end_at"`
+	// Primary is set on the subscription the single subscription routes of the
+	// organization work on.
+	Primary bool `json:"primary" db:"-"`
+
+	Items []SubscriptionItem `json:"items" db:"-"`
+	// PendingChange is the plan change scheduled at the end of the current
+	// period.
+	PendingChange *PendingChange `json:"pending_change,omitempty" db:"-"`
+}
+
+// SubscriptionItem is a price of a subscription with its quantity.
+type SubscriptionItem struct {
+	ID                 string `json:"id"                  db:"id"`
+	SubscriptionID     string `json:"subscription_id"     db:"subscription_id"`
+	PriceID            string `json:"price_id"            db:"price_id"`
+	PriceActive        bool   `json:"price_active"        db:"price_active"`
+	ProductID          string `json:"product_id"          db:"product_id"`
+	ProductName        string `json:"product_name"        db:"product_name"`
+	ProductDescription string `json:"product_description" db:"product_description"`
+	ProductActive      bool   `json:"product_active"      db:"product_active"`
+	Quantity           int64  `json:"quantity"            db:"quantity"`
+	UnitAmount         int64  `json:"unit_amount"         db:"unit_amount"`
+	Currency           string `json:"currency"            db:"currency"`
+	// PlanKey is the catalog plan of the price, it is not stored but joined
+	// from the plans table.
+	PlanKey string `json:"plan_key" db:"plan_key"`
+}
+
+// newSubscription converts a Stripe subscription. The product of every item is
+// fetched for its name and description.
+func newSubscription(s stripe.Subscription) Subscription {
+	sub := Subscription{
+		ID:                 s.ID,
+		Status:             string(s.Status),
+		Currency:           string(s.Currency),
+		CurrentPeriodStart: s.CurrentPeriodStart,
+		CurrentPeriodEnd:   s.CurrentPeriodEnd,
+		CancelAt:           s.CancelAt,
+		CancelAtPeriodEnd:  s.CancelAtPeriodEnd,
+		CanceledAt:         s.CanceledAt,
+		TrialEnd:           s.TrialEnd,
+		Created:            s.Created,
+	}
+	if s.Customer != nil {
+		sub.CustomerID = s.Customer.ID
+	}
+	if s.PauseCollection != nil {
+		sub.PauseBehavior = string(s.PauseCollection.Behavior)
+		sub.PauseResumesAt = s.PauseCollection.ResumesAt
+	}
+	sub.TrialEndBehavior = trialEndBehavior(s)
+	if s.Items == nil {
+		return sub
+	}
+	for _, item := range s.Items.Data {
+		sub.Items = append(sub.Items, newSubscriptionItem(s.ID, item))
+	}
+	return sub
+}
+
+func newSubscriptionItem(subID string, item *stripe.SubscriptionItem) SubscriptionItem {
+	si := SubscriptionItem{
+		ID:             item.ID,
+		SubscriptionID: subID,
+		Quantity:       item.Quantity,
+	}
+	var productID string
+	switch {
+	case item.Price != nil:
+		si.PriceID = item.Price.ID
+		si.PriceActive = item.Price.Active
+		si.UnitAmount = item.Price.UnitAmount
+		si.Currency = string(item.Price.Currency)
+		if item.Price.Product != nil {
+			productID = item.Price.Product.ID
+		}
+	case item.Plan != nil:
+		si.PriceID = item.Plan.ID
+		si.PriceActive = item.Plan.Active
+		si.UnitAmount = item.Plan.Amount
+		si.Currency = string(item.Plan.Currency)
+		if item.Plan.Product != nil {
+			productID = item.Plan.Product.ID
+		}
+	}
+
+	si.ProductID = productID
+	si.ProductActive = true
+	if productID != "" {
+		if prod, err := stripeAPI.GetProduct(productID, &stripe.ProductParams{}); err == nil {
+			si.ProductName = prod.Name
+			si.ProductActive = prod.Active
+			si.ProductDescription = prod.Description
+		}
+	}
+	// Retired catalog plans are still resolved here on purpose.
+	if cp, err := getCatalogPlanByPrice(si.PriceID); err == nil {
+		si.PlanKey = cp.Key
+	}
+	return si
+}
+
+// Plan returns the item in the shape of the plans of an organization.
+func (si SubscriptionItem) Plan() Plan {
+	return Plan{
+		ID:       si.PriceID,
+		Key:      si.PlanKey,
+		SiID:     si.ID,
+		SubID:    si.SubscriptionID,
+		Active:   si.PriceActive,
+		Quantity: si.Quantity,
+		Amount:   si.UnitAmount,
+		Product: Product{
+			ID:          si.ProductID,
+			Active:      si.ProductActive,
+			Name:        si.ProductName,
+			Description: si.ProductDescription,
+		},
+	}
+}
+
+func createSub(sub stripe.Subscription) error {
+	return store.CreateSub(newSubscription(sub))
+}
+
+func updateSub(sub stripe.Subscription) error {
+	return store.UpdateSub(newSubscription(sub))
+}
+
+func createSubForOrg(sub stripe.Subscription, orgID int) error {
+	return store.CreateSubForOrg(orgID, newSubscription(sub))
+}
+
+// deleteSub records the final state of a subscription that ended and removes
+// it from its organization.
+func deleteSub(sub stripe.Subscription) error {
+	return store.DeleteSub(endedSubscription(newSubscription(sub)))
+}
+
+// endedSubscription returns the subscription with a final status.
+func endedSubscription(s Subscription) Subscription {
+	if !isFinalSubStatus(s.Status) {
+		s.Status = string(stripe.SubscriptionStatusCanceled)
+	}
+	return s
+}
+
+// nextPrimarySub returns the subscription replacing the primary subscription
+// of the organization when it ends, the same one DeleteSub picks.
+func nextPrimarySub(orgID int, endingID string) (Subscription, error) {
+	subs, err := store.ListSubscriptions(orgID)
+	if err != nil {
+		return Subscription{}, err
+	}
+	for _, sub := range subs {
+		if sub.ID != endingID && sub.Status != "" && !isFinalSubStatus(sub.Status) {
+			return sub, nil
+		}
+	}
+	return Subscription{}, nil
+}
+
+// subscriptionResult is the answer of the routes creating or changing a
+// subscription, the client secret confirms the payment of its latest invoice,
+// or the setup intent of a trial.
+type subscriptionResult struct {
+	SubscriptionID     string `json:"subscriptionId"`
+	SubscriptionStatus string `json:"subscriptionStatus"`
+	ClientSecret       string `json:"clientSecret"`
+	CancelAtPeriodEnd  bool   `json:"cancelAtPeriodEnd"`
+	CancelAt           int64  `json:"cancelAt,omitempty"`
+	TrialEnd           int64  `json:"trialEnd,omitempty"`
+	// TrialEndBehavior is what ends the trial without a payment method.
+	// TrialWillEndAt is set once Stripe announced the end of the trial.
+	TrialEndBehavior string `json:"trialEndBehavior,omitempty"`
+	TrialWillEndAt   int64  `json:"trialWillEndAt,omitempty"`
+	// Discount is the active discount of the subscription.
+	Discount *SubscriptionDiscount `json:"discount,omitempty"`
+	// PendingChange is set when the change is scheduled at the period end.
+	PendingChange *PendingChange `json:"pendingChange,omitempty"`
+}
+
+func newSubscriptionResult(s *stripe.Subscription) subscriptionResult {
+	res := subscriptionResult{
+		SubscriptionID:     s.ID,
+		SubscriptionStatus: string(s.Status),
+		CancelAtPeriodEnd:  s.CancelAtPeriodEnd,
+		CancelAt:           s.CancelAt,
+		TrialEnd:           s.TrialEnd,
+		TrialEndBehavior:   trialEndBehavior(*s),
+		Discount:           newSubscriptionDiscount(s.Discount),
+	}
+	if s.LatestInvoice != nil && s.LatestInvoice.PaymentIntent != nil {
+		res.ClientSecret = s.LatestInvoice.PaymentIntent.ClientSecret
+	}
+	// The first invoice of a trial has nothing to pay.
+	if s.PendingSetupIntent != nil && s.PendingSetupIntent.ClientSecret != "" {
+		res.ClientSecret = s.PendingSetupIntent.ClientSecret
+	}
+	return res
+}
+
+func listOrgSubscriptions(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	subs, err := store.ListSubscriptions(organization.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Ended subscriptions are only listed with all=true.
+	all := r.URL.Query().Get("all") == "true"
+	list := []Subscription{}
+	for _, sub := range subs {
+		if sub.Status == "" || (!all && isFinalSubStatus(sub.Status)) {
+			continue
+		}
+		sub.Primary = sub.ID == organization.StripeSubID
+		list = append(list, sub)
+	}
+	writeJSON(w, list)
+}
+
+func addOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	var req subscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// A plan is only billed once, by one of the running subscriptions.
+	subs, err := store.ListSubscriptions(organization.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, sub := range subs {
+		if isFinalSubStatus(sub.Status) {
+			continue
+		}
+		for _, item := range sub.Items {
+			if item.PlanKey != "" && item.PlanKey == req.Plan {
+				http.Error(w, "plan "+req.Plan+" is already subscribed by subscription "+sub.ID, http.StatusUnprocessableEntity)
+				return
+			}
+		}
+	}
+
+	subscribePlan(w, organization, req)
+}
+
+func getOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+	sub, ok := orgSubscription(w, organization, bone.GetValue(r, "subId"))
+	if !ok {
+		return
+	}
+
+	res := struct {
+		Subscription
+		ClientSecret string `json:"client_secret,omitempty"`
+	}{Subscription: sub}
+
+	// The stored copy is answered when the subscription is gone from Stripe.
+	params := &stripe.SubscriptionParams{}
+	params.AddExpand("latest_invoice.payment_intent")
+	s, err := stripeAPI.GetSubscription(sub.ID, params)
+	switch {
+	case err != nil && strings.Contains(err.Error(), "resource_missing"):
+	case err != nil:
+		http.Error(w, "failed to retrieve the subscription : "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	default:
+		if isFinalSubStatus(string(s.Status)) {
+			err = deleteSub(*s)
+		} else {
+			err = updateSub(*s)
+		}
+		if err != nil {
+			http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		touchSubEventAt(organization.ID, s.ID)
+		if res.Subscription, err = store.GetSubscription(s.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.ClientSecret = newSubscriptionResult(s).ClientSecret
+	}
+
+	organization, err = store.GetOrganization(bone.GetValue(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Primary = res.ID == organization.StripeSubID
+	writeJSON(w, res)
+}
+
+func updateOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+	sub, ok := orgSubscription(w, organization, bone.GetValue(r, "subId"))
+	if !ok {
+		return
+	}
+
+	var req planChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	changeSubscriptionPlan(w, organization, sub.ID, req)
+}
+
+// Cancellation modes of a subscription. A subscription canceled at the period
+// end keeps running until then, and can be reactivated meanwhile.
+const (
+	cancelAtPeriodEnd = "at_period_end"
+	cancelImmediately = "immediately"
+)
+
+// cancelOrgSubscription cancels the subscription in the mode query parameter,
+// at the period end by default. refund=true refunds the unused time of an
+// immediate cancellation.
+func cancelOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = cancelAtPeriodEnd
+	}
+	var refund bool
+	if v := query.Get("refund"); v != "" {
+		var err error
+		if refund, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid refund "+v, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	switch {
+	case mode == cancelAtPeriodEnd && refund:
+		http.Error(w, "refund only applies to mode "+cancelImmediately, http.StatusUnprocessableEntity)
+	case mode == cancelAtPeriodEnd:
+		setCancelAtPeriodEnd(w, organization, sub.ID, true)
+	case mode == cancelImmediately:
+		endSubscription(w, organization, sub.ID, refund)
+	default:
+		http.Error(w, fmt.Sprintf("invalid mode %q, use %s or %s", mode, cancelAtPeriodEnd, cancelImmediately), http.StatusUnprocessableEntity)
+	}
+}
+
+// reactivateOrgSubscription clears the pending cancellation of the
+// subscription, which renews again at the end of its period.
+func reactivateOrgSubscription(w http.ResponseWriter, r *http.Request) {
+	organization, sub, ok := routeSubscription(w, r)
+	if !ok {
+		return
+	}
+	if isFinalSubStatus(sub.Status) {
+		http.Error(w, "subscription "+sub.ID+" already ended, subscribe again", http.StatusUnprocessableEntity)
+		return
+	}
+	if !sub.CancelAtPeriodEnd {
+		http.Error(w, "subscription "+sub.ID+" is not canceled", http.StatusUnprocessableEntity)
+		return
+	}
+	setCancelAtPeriodEnd(w, organization, sub.ID, false)
+}
+
+// orgSubscription returns the stored subscription subID of the organization,
+// it answers 404 when the organization has no such subscription.
+func orgSubscription(w http.ResponseWriter, org Organization, subID string) (Subscription, bool) {
+	sub, err := store.GetSubscription(subID)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && (sub.OrgID != org.ID || sub.Status == "")):
+		http.Error(w, "subscription not found", http.StatusNotFound)
+		return sub, false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return sub, false
+	}
+	return sub, true
+}
+
+// subscribeRequest is the body of the routes creating a subscription.
+type subscribeRequest struct {
+	Plan   string         `json:"plan"`
+	AddOns []addOnRequest `json:"addons"`
+	// TrialDays overrides the trial of the plan, 0 subscribes without one.
+	TrialDays *int64 `json:"trial_days"`
+	// TrialEndBehavior is what ends a trial without a payment method,
+	// cancel by default or pause.
+	TrialEndBehavior string `json:"trial_end_behavior"`
+	// PromotionCode is the code of a Stripe promotion code to redeem.
+	PromotionCode string `json:"promotion_code"`
+}
+
+// subscribePlan creates a subscription of the organization to the catalog
+// plan and its add-ons. Its first invoice is left open until the payment is
+// confirmed with the client secret of the answer. A subscription starting
+// with a trial is not billed until it ends, the client secret of its setup
+// intent saves a payment method meanwhile.
+func subscribePlan(w http.ResponseWriter, organization Organization, req subscribeRequest) {
+	plan, addOns := req.Plan, req.AddOns
+	items := getSubItemsPrice(plan)
+
+	if items == nil {
+		http.Error(w, "Invalid plan :"+plan, http.StatusUnprocessableEntity)
+		return
+	}
+	base, _ := getSubscribablePlan(plan)
+	members, err := countMembers(organization.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	seats := syncedSeats(base, members)
+	if err := checkSeats(base, seats, members); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	items[0].Quantity = stripe.Int64(seats)
+
+	attached := map[string]bool{}
+	for _, a := range addOns {
+		if a.Quantity == 0 {
+			a.Quantity = 1
+		}
+		addOn, err := checkAddOn(base, a.AddOn, a.Quantity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if attached[addOn.Key] {
+			http.Error(w, "add-on "+addOn.Key+" is listed twice", http.StatusUnprocessableEntity)
+			return
+		}
+		attached[addOn.Key] = true
+		items = append(items, &stripe.SubscriptionItemsParams{Price: stripe.String(addOn.PriceID), Quantity: stripe.Int64(a.Quantity)})
+	}
+
+	metered, err := meteredItemsPrice(base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	items = append(items, metered...)
+
+	// Automatically save the payment method to the subscription
+	// when the first payment is successful.
+	paymentSettings := &stripe.SubscriptionPaymentSettingsParams{
+		SaveDefaultPaymentMethod: stripe.String("on_subscription"),
+	}
+
+	subscriptionParams := &stripe.SubscriptionParams{
+		Customer:        stripe.String(organization.StripeID),
+		Items:           items,
+		PaymentSettings: paymentSettings,
+		PaymentBehavior: stripe.String("default_incomplete"),
+	}
+	subscriptionParams.AddExpand("latest_invoice.payment_intent")
+	if err := applyTrial(subscriptionParams, base, req); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if code := strings.TrimSpace(req.PromotionCode); code != "" {
+		pc, err := findPromotionCode(organization, code, base, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		subscriptionParams.PromotionCode = stripe.String(pc.ID)
+		subscriptionParams.AddExpand("discount.promotion_code")
+	}
+
+	s, err := stripeAPI.NewSubscription(subscriptionParams)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("sub.New: %v", err)
+		return
+	}
+
+	if err := createSubForOrg(*s, organization.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+
+	writeJSON(w, newSubscriptionResult(s))
+}
+
+// changeSubscriptionPlan moves the base plan item of the subscription to the
+// catalog plan, its add-ons must be allowed with the new plan. The proration
+// follows the request or the rule of the direction of the change, which may
+// schedule the change at the end of the period instead.
+func changeSubscriptionPlan(w http.ResponseWriter, organization Organization, subID string, req planChangeRequest) {
+	s, err := stripeAPI.GetSubscription(subID, nil)
+	if err != nil {
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		log.Printf("sub.Get: %v", err)
+		return
+	}
+
+	updateItem, status, err := planChangeItem(organization, s, req.Plan)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	opts, err := resolvePlanChange(s, updateItem, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	var promotionCode *stripe.PromotionCode
+	if code := strings.TrimSpace(req.PromotionCode); code != "" {
+		if opts.AtPeriodEnd {
+			http.Error(w, "promotion_code only applies to a plan change made right away", http.StatusUnprocessableEntity)
+			return
+		}
+		cp, _ := getSubscribablePlan(req.Plan)
+		if promotionCode, err = findPromotionCode(organization, code, cp, s.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if opts.AtPeriodEnd {
+		if s.CancelAtPeriodEnd {
+			http.Error(w, "subscription "+s.ID+" is canceled at the period end, reactivate it first", http.StatusUnprocessableEntity)
+			return
+		}
+		pc, err := schedulePlanChange(s, req.Plan, updateItem)
+		if err != nil {
+			http.Error(w, "failed to schedule the plan change : "+err.Error(), http.StatusUnprocessableEntity)
+			log.Printf("subscriptionschedule.Update: %v", err)
+			return
+		}
+		res := newSubscriptionResult(s)
+		res.PendingChange = &pc
+		writeJSON(w, res)
+		return
+	}
+
+	// A change applied right away replaces the one pending at the period end.
+	var scheduleID string
+	if s.Schedule != nil {
+		scheduleID = s.Schedule.ID
+	}
+	if err := releaseSchedule(s.ID, scheduleID); err != nil {
+		http.Error(w, "failed to cancel the pending plan change : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	paymentSettings := &stripe.SubscriptionPaymentSettingsParams{
+		SaveDefaultPaymentMethod: stripe.String("on_subscription"),
+	}
+
+	subscriptionParams := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+		Items:             []*stripe.SubscriptionItemsParams{updateItem},
+		PaymentSettings:   paymentSettings,
+		PaymentBehavior:   stripe.String("default_incomplete"),
+		ProrationBehavior: stripe.String(opts.ProrationBehavior),
+	}
+	if opts.ResetBillingCycle {
+		subscriptionParams.BillingCycleAnchorNow = stripe.Bool(true)
+	}
+	if promotionCode != nil {
+		subscriptionParams.PromotionCode = stripe.String(promotionCode.ID)
+	}
+	subscriptionParams.AddExpand("latest_invoice.payment_intent")
+	subscriptionParams.AddExpand("discount.promotion_code")
+
+	updatedSubscription, err := stripeAPI.UpdateSubscription(s.ID, subscriptionParams)
+
+	if err != nil {
+		http.Error(w, "Failed to update subscription"+err.Error(), http.StatusInternalServerError)
+		log.Printf("sub.Update: %v", err)
+		return
+	}
+
+	if err := updateSub(*updatedSubscription); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, updatedSubscription.ID)
+
+	writeJSON(w, newSubscriptionResult(updatedSubscription))
+}
+
+// planChangeItem returns the change of the base plan item of the subscription
+// to the catalog plan. The seats are kept within the bounds of the new plan
+// and the add-ons of the subscription must be allowed with it. The status is
+// the one to answer with when the change is not possible.
+func planChangeItem(organization Organization, s *stripe.Subscription, plan string) (*stripe.SubscriptionItemsParams, int, error) {
+	if (s.Items.Data == nil) || (len(s.Items.Data) < 1) {
+		return nil, http.StatusInternalServerError, fmt.Errorf("no subscription items")
+	}
+
+	// Subscriptions of prices that are not in the catalog have their first
+	// item changed.
+	baseItem, _, ok := subscriptionBaseItem(s)
+	if !ok {
+		baseItem = s.Items.Data[0]
+	}
+	updateItem := updateSubItemPrice(plan, baseItem.ID)
+	if updateItem == nil {
+		return nil, http.StatusUnprocessableEntity, fmt.Errorf("Invalid plan :%s", plan)
+	}
+	cp, _ := getSubscribablePlan(plan)
+
+	members, err := countMembers(organization.ID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	seats := baseItem.Quantity
+	if organization.SeatSync || seats < cp.MinSeats {
+		seats = syncedSeats(cp, members)
+	}
+	if err := checkSeats(cp, seats, members); err != nil {
+		return nil, http.StatusUnprocessableEntity, err
+	}
+	updateItem.Quantity = stripe.Int64(seats)
+
+	for _, item := range s.Items.Data {
+		if item == baseItem || item.Price == nil {
+			continue
+		}
+		addOn, err := getCatalogPlanByPrice(item.Price.ID)
+		if err != nil || addOn.Kind != catalogKindAddOn {
+			continue
+		}
+		if err := checkAddOnAllowed(cp, addOn, item.Quantity); err != nil {
+			return nil, http.StatusUnprocessableEntity, fmt.Errorf("%v, remove it first", err)
+		}
+	}
+	return updateItem, 0, nil
+}
+
+// setCancelAtPeriodEnd sets or clears the cancellation of the subscription at
+// the end of its period, and answers the stored subscription. A cancellation
+// drops the pending plan change, which the schedule would otherwise apply.
+func setCancelAtPeriodEnd(w http.ResponseWriter, organization Organization, subID string, cancel bool) {
+	s, err := stripeAPI.GetSubscription(subID, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "resource_missing") {
+			if err := removeMissingSub(organization, subID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeStoredSubscription(w, organization, subID)
+			return
+		}
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cancel && s.Schedule != nil {
+		if err := releaseSchedule(s.ID, s.Schedule.ID); err != nil {
+			http.Error(w, "failed to cancel the pending plan change : "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	s, err = stripeAPI.UpdateSubscription(subID, &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(cancel)})
+	if err != nil {
+		http.Error(w, "Failed to update subscription "+err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("sub.Update: %v", err)
+		return
+	}
+	if err := updateSub(*s); err != nil {
+		http.Error(w, "failed to update the subscription in platform : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	writeStoredSubscription(w, organization, subID)
+}
+
+// endSubscription cancels the subscription immediately, with a refund of the
+// unused time of its period when refund is set. A subscription Stripe no
+// longer has is only removed locally. A failed refund does not undo the
+// cancellation, it is answered in refund_error.
+func endSubscription(w http.ResponseWriter, organization Organization, subID string, refund bool) {
+	current, err := stripeAPI.GetSubscription(subID, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "resource_missing") {
+			if err := removeMissingSub(organization, subID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeStoredSubscription(w, organization, subID)
+			return
+		}
+		http.Error(w, "unable to get stripe subscription "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s, err := stripeAPI.CancelSubscription(subID, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := deleteSub(*s); err != nil {
+		http.Error(w, "Unsubscribe but failed to remove recode "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	touchSubEventAt(organization.ID, s.ID)
+	// The event of the cancellation no longer sees the primary subscription,
+	// its dunning ends here.
+	if subID == organization.StripeSubID {
+		if dt, ok := dunningOnPaymentSucceeded(organization); ok {
+			if _, err := applyDunningTransition(dt, organization.DunningDeadline); err != nil {
+				log.Printf("applyDunningTransition: %v", err)
+			}
+		}
+	}
+
+	var refunded int64
+	var refundErr string
+	if refund {
+		refunds, err := periodRefunds(current, time.Now().Unix())
+		for _, params := range refunds {
+			if err != nil {
+				break
+			}
+			var re *stripe.Refund
+			if re, err = stripeAPI.NewRefund(params); err == nil {
+				refunded += re.Amount
+			}
+		}
+		if err != nil {
+			refundErr = "subscription canceled but the refund failed : " + err.Error()
+			log.Printf("refund.New: %v", err)
+		}
+	}
+
+	sub, err := store.GetSubscription(subID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Subscription
+		RefundedAmount int64  `json:"refunded_amount"`
+		RefundError    string `json:"refund_error,omitempty"`
+	}{sub, refunded, refundErr})
+}
+
+// periodRefunds returns the refunds of the unused time of the current period
+// of s from now. It is what the paid invoices billing the period charged for
+// its licensed items, after discounts and with the tax added, credits of plan
+// changes deducted. The refunds go to the payment intents of these invoices,
+// newest first and each up to what it was paid.
+func periodRefunds(s *stripe.Subscription, now int64) ([]*stripe.RefundParams, error) {
+	if now >= s.CurrentPeriodEnd {
+		return nil, nil
+	}
+	invoices, err := stripeAPI.ListInvoices(&stripe.InvoiceListParams{
+		Subscription: stripe.String(s.ID),
+		Status:       stripe.String(string(stripe.InvoiceStatusPaid)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the invoices of subscription %s : %w", s.ID, err)
+	}
+	var unused int64
+	var paid []*stripe.Invoice
+	for _, in := range invoices {
+		if in.Lines == nil {
+			continue
+		}
+		billed := false
+		for _, line := range in.Lines.Data {
+			period := line.Period
+			if period == nil || period.End != s.CurrentPeriodEnd || period.End <= period.Start {
+				continue
+			}
+			if line.Price != nil && line.Price.Recurring != nil && line.Price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+				continue
+			}
+			amount := line.Amount
+			for _, d := range line.DiscountAmounts {
+				amount -= d.Amount
+			}
+			for _, t := range line.TaxAmounts {
+				if !t.Inclusive {
+					amount += t.Amount
+				}
+			}
+			start := period.Start
+			if now > start {
+				start = now
+			}
+			unused += amount * (period.End - start) / (period.End - period.Start)
+			billed = true
+		}
+		if billed && in.AmountPaid > 0 && in.PaymentIntent != nil {
+			paid = append(paid, in)
+		}
+	}
+
+	var refunds []*stripe.RefundParams
+	for _, in := range paid {
+		if unused <= 0 {
+			break
+		}
+		amount := unused
+		if amount > in.AmountPaid {
+			amount = in.AmountPaid
+		}
+		unused -= amount
+		refunds = append(refunds, &stripe.RefundParams{
+			PaymentIntent: stripe.String(in.PaymentIntent.ID),
+			Amount:        stripe.Int64(amount),
+			Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+		})
+	}
+	return refunds, nil
+}
+
+// removeMissingSub marks the subscription Stripe no longer has canceled.
+func removeMissingSub(organization Organization, subID string) error {
+	sub, err := store.GetSubscription(subID)
+	switch {
+	case err == nil:
+		sub.Status = string(stripe.SubscriptionStatusCanceled)
+		return store.DeleteSub(sub)
+	case err != sql.ErrNoRows:
+		return err
+	case subID == organization.StripeSubID:
+		return store.DeleteSubByOrgID(organization.ID)
+	}
+	return nil
+}
+
+// writeStoredSubscription answers the stored subscription.
+func writeStoredSubscription(w http.ResponseWriter, organization Organization, subID string) {
+	sub, err := store.GetSubscription(subID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sub.Primary = sub.ID == organization.StripeSubID
+	writeJSON(w, sub)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"autha-stripe/entitlements"
+)
+
+// SigningKey is an Ed25519 key used to sign entitlement tokens. Only the
+// seed of the private key is stored. Retired keys are not used for signing
+// anymore but stay published until the tokens they signed have expired.
+type SigningKey struct {
+	Kid       string `db:"kid"`
+	Seed      []byte `db:"seed"`
+	CreatedAt int64  `db:"created_at"`
+	RetiredAt int64  `db:"retired_at"`
+}
+
+func (k SigningKey) privateKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(k.Seed)
+}
+
+func (k SigningKey) publicKey() ed25519.PublicKey {
+	return k.privateKey().Public().(ed25519.PublicKey)
+}
+
+func entitlementTokenTTL() time.Duration {
+	return durationEnv("ENTITLEMENT_TOKEN_TTL", 5*time.Minute)
+}
+
+func entitlementTokenIssuer() string {
+	if iss := os.Getenv("ENTITLEMENT_TOKEN_ISSUER"); iss != "" {
+		return iss
+	}
+	return "autha-stripe"
+}
+
+// issueEntitlementToken returns a short-lived token carrying the entitlements
+// of the organization.
+func issueEntitlementToken(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	e, err := resolveOrgEntitlements(organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key, err := currentSigningKey()
+	if err != nil {
+		http.Error(w, "failed to get signing key : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	claims := entitlements.Claims{
+		Issuer:       entitlementTokenIssuer(),
+		Subject:      strconv.Itoa(organization.ID),
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    now.Add(entitlementTokenTTL()).Unix(),
+		Entitlements: e,
+	}
+	token, err := entitlements.Sign(claims, key.Kid, key.privateKey())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, struct {
+		Token     string `json:"token"`
+		ExpiresAt int64  `json:"expires_at"`
+	}{
+		Token:     token,
+		ExpiresAt: claims.ExpiresAt,
+	})
+}
+
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	keys, err := listPublishedSigningKeys(time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jwks := entitlements.JWKS{Keys: []entitlements.JWK{}}
+	for _, k := range keys {
+		jwks.Keys = append(jwks.Keys, entitlements.NewJWK(k.Kid, k.publicKey()))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	writeJSON(w, jwks)
+}
+
+func adminRotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	key, err := rotateSigningKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entitlements.NewJWK(key.Kid, key.publicKey()))
+}
+
+// runKeyRotation rotates the signing key once it is older than every.
+func runKeyRotation(every time.Duration) {
+	for {
+		key, err := currentSigningKey()
+		switch {
+		case err != nil:
+			log.Printf("currentSigningKey: %v", err)
+		case time.Since(time.Unix(key.CreatedAt, 0)) >= every:
+			if _, err := rotateSigningKey(); err != nil {
+				log.Printf("rotateSigningKey: %v", err)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// currentSigningKey returns the newest key, one is created if there is none.
+func currentSigningKey() (SigningKey, error) {
+	var keys []SigningKey
+	if err := db.Select(&keys, db.Rebind("SELECT * FROM signing_keys WHERE retired_at = 0 ORDER BY created_at DESC LIMIT 1")); err != nil {
+		return SigningKey{}, err
+	}
+	if len(keys) == 0 {
+		return rotateSigningKey()
+	}
+	return keys[0], nil
+}
+
+// rotateSigningKey creates a new signing key and retires the previous ones.
+func rotateSigningKey() (SigningKey, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return SigningKey{}, err
+	}
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return SigningKey{}, err
+	}
+	key := SigningKey{Kid: hex.EncodeToString(kid), Seed: seed, CreatedAt: time.Now().Unix()}
+
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return key, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(tx.Rebind("UPDATE signing_keys SET retired_at = ? WHERE retired_at = 0"), key.CreatedAt); err != nil {
+		return key, err
+	}
+	if _, err := tx.Exec(tx.Rebind("INSERT INTO signing_keys (kid, seed, created_at, retired_at) VALUES (?, ?, ?, 0)"), key.Kid, key.Seed, key.CreatedAt); err != nil {
+		return key, err
+	}
+	// Keys retired long enough ago can not have signed a valid token.
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM signing_keys WHERE retired_at > 0 AND retired_at < ?"), time.Now().Add(-2*entitlementTokenTTL()).Unix()); err != nil {
+		return key, err
+	}
+	return key, tx.Commit()
+}
+
+// listPublishedSigningKeys returns the keys that may have signed a token
+// that is still valid at now.
+func listPublishedSigningKeys(now time.Time) ([]SigningKey, error) {
+	var keys []SigningKey
+	query := "SELECT * FROM signing_keys WHERE retired_at = 0 OR retired_at >= ? ORDER BY created_at DESC"
+	err := db.Select(&keys, db.Rebind(query), now.Add(-entitlementTokenTTL()).Unix())
+	return keys, err
+}
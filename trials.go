@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// maxTrialDays is the longest trial Stripe allows.
+const maxTrialDays = 730
+
+// What ends a trial when the customer has no payment method by then, Stripe
+// either cancels the subscription or pauses it until it is resumed.
+const (
+	trialEndCancel = string(stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodCancel)
+	trialEndPause  = string(stripe.SubscriptionTrialSettingsEndBehaviorMissingPaymentMethodPause)
+)
+
+func checkTrialDays(days int64) error {
+	if days < 0 || days > maxTrialDays {
+		return fmt.Errorf("trial_days must be between 0 and %d", maxTrialDays)
+	}
+	return nil
+}
+
+// applyTrial sets the trial of a new subscription to the base plan, the one
+// of the catalog unless the request overrides it. A trial needs no payment
+// method, the pending setup intent of the subscription collects one.
+func applyTrial(params *stripe.SubscriptionParams, base CatalogPlan, req subscribeRequest) error {
+	days := base.TrialDays
+	if req.TrialDays != nil {
+		days = *req.TrialDays
+	}
+	if err := checkTrialDays(days); err != nil {
+		return err
+	}
+	behavior := req.TrialEndBehavior
+	if days == 0 {
+		if behavior != "" {
+			return fmt.Errorf("trial_end_behavior requires a trial")
+		}
+		return nil
+	}
+	switch behavior {
+	case "":
+		behavior = trialEndCancel
+	case trialEndCancel, trialEndPause:
+	default:
+		return fmt.Errorf("invalid trial_end_behavior %q, use %s or %s", behavior, trialEndCancel, trialEndPause)
+	}
+
+	params.TrialPeriodDays = stripe.Int64(days)
+	params.TrialSettings = &stripe.SubscriptionTrialSettingsParams{
+		EndBehavior: &stripe.SubscriptionTrialSettingsEndBehaviorParams{
+			MissingPaymentMethod: stripe.String(behavior),
+		},
+	}
+	params.AddExpand("pending_setup_intent")
+	return nil
+}
+
+// trialWillEnd records that Stripe announced the end of the trial of the
+// subscription, which is billed, canceled or paused three days later.
+func trialWillEnd(change subscriptionChange, announcedAt int64) error {
+	sub := change.Sub
+	if sub.Status != stripe.SubscriptionStatusTrialing {
+		return nil
+	}
+	if err := store.SetTrialWillEnd(sub.ID, announcedAt); err != nil {
+		return err
+	}
+	log.Printf("trial of subscription %s of organization %d ends %s, %s without a payment method",
+		sub.ID, change.Org.ID, time.Unix(sub.TrialEnd, 0).UTC().Format(time.RFC3339), trialEndBehavior(sub))
+	return nil
+}
+
+// pendingTrialEnd returns when Stripe announced the end of the trial of the
+// subscription, 0 when it did not yet or the subscription is not trialing.
+func pendingTrialEnd(s stripe.Subscription) (int64, error) {
+	if s.Status != stripe.SubscriptionStatusTrialing {
+		return 0, nil
+	}
+	stored, err := store.GetSubscription(s.ID)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	return stored.TrialWillEndAt, nil
+}
+
+// trialEndBehavior is what ends the trial of the subscription without a
+// payment method, empty when it has no trial.
+func trialEndBehavior(s stripe.Subscription) string {
+	if s.TrialEnd == 0 || s.TrialSettings == nil || s.TrialSettings.EndBehavior == nil {
+		return ""
+	}
+	return string(s.TrialSettings.EndBehavior.MissingPaymentMethod)
+}
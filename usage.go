@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+)
+
+// UsageEvent is a usage of a metered metric by an organization. Events are
+// deduplicated on their idempotency key, per organization.
+type UsageEvent struct {
+	ID             int    `json:"-"               db:"id"`
+	OrgID          int    `json:"-"               db:"org_id"`
+	Metric         string `json:"metric"          db:"metric"`
+	IdempotencyKey string `json:"idempotency_key" db:"idempotency_key"`
+	Quantity       int64  `json:"quantity"        db:"quantity"`
+	OccurredAt     int64  `json:"timestamp"       db:"occurred_at"`
+	ReportID       string `json:"-"               db:"report_id"`
+	Created        int64  `json:"-"               db:"created"`
+}
+
+// UsageReport is the usage of a metric aggregated from the events received
+// since the previous report, sent to the metered subscription item as a
+// usage record. Its ID is the idempotency key of the usage record so that a
+// retry is not counted twice. UsageAt is the time of the latest event, no
+// earlier than the start of the current period since Stripe rejects the usage
+// of a period already invoiced. A report still failing after usageMaxAttempts
+// is given up at FailedAt.
+type UsageReport struct {
+	ID                 string `db:"id"`
+	OrgID              int    `db:"org_id"`
+	Metric             string `db:"metric"`
+	SubscriptionItemID string `db:"subscription_item_id"`
+	Quantity           int64  `db:"quantity"`
+	UsageAt            int64  `db:"usage_at"`
+	Attempts           int    `db:"attempts"`
+	NextAttemptAt      int64  `db:"next_attempt_at"`
+	LastError          string `db:"last_error"`
+	ReportedAt         int64  `db:"reported_at"`
+	FailedAt           int64  `db:"failed_at"`
+	Created            int64  `db:"created"`
+}
+
+// MeteredUsage is the usage of a metric during the current period against
+// the allowance of the plans, the limit of the feature of the same name. A nil
+// Allowance is unlimited.
+type MeteredUsage struct {
+	Metric             string `json:"metric"`
+	SubscriptionItemID string `json:"subscription_item_id"`
+	PeriodStart        int64  `json:"period_start"`
+	PeriodEnd          int64  `json:"period_end"`
+	Usage              int64  `json:"usage"`
+	Reported           int64  `json:"reported"`
+	Allowance          *int64 `json:"allowance"`
+	Overage            int64  `json:"overage"`
+}
+
+// meteredItem is the subscription item billing a metric of an organization.
+type meteredItem struct {
+	ID                 string `db:"id"`
+	SubscriptionID     string `db:"subscription_id"`
+	CurrentPeriodStart int64  `db:"current_period_start"`
+	CurrentPeriodEnd   int64  `db:"current_period_end"`
+}
+
+// postOrgUsage records usage events. Events already received are counted as
+// duplicates and ignored.
+func postOrgUsage(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	var events []UsageEvent
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		http.Error(w, "invalid body "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if len(events) == 0 {
+		http.Error(w, "no usage events", http.StatusUnprocessableEntity)
+		return
+	}
+	metrics, err := meteredMetrics()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	for i := range events {
+		events[i].OrgID = organization.ID
+		events[i].IdempotencyKey = strings.TrimSpace(events[i].IdempotencyKey)
+		events[i].Created = now
+		switch {
+		case events[i].IdempotencyKey == "":
+			http.Error(w, "idempotency_key is required", http.StatusUnprocessableEntity)
+			return
+		case !metrics[events[i].Metric]:
+			http.Error(w, "unknown metric "+events[i].Metric, http.StatusUnprocessableEntity)
+			return
+		case events[i].Quantity <= 0:
+			http.Error(w, "quantity must be positive", http.StatusUnprocessableEntity)
+			return
+		case events[i].OccurredAt > now+int64(time.Minute.Seconds()):
+			http.Error(w, "timestamp can not be in the future", http.StatusUnprocessableEntity)
+			return
+		}
+		if events[i].OccurredAt <= 0 {
+			events[i].OccurredAt = now
+		}
+	}
+
+	accepted, err := insertUsageEvents(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int64{"accepted": accepted, "duplicates": int64(len(events)) - accepted})
+}
+
+// getOrgUsage returns the usage of every metric the organization is billed for
+// or has used.
+func getOrgUsage(w http.ResponseWriter, r *http.Request) {
+	org := r.Context().Value(ctxOrgKey)
+	organization, ok := org.(Organization)
+	if !ok {
+		http.Error(w, "invalid organization context", http.StatusInternalServerError)
+		return
+	}
+
+	e, err := resolveOrgEntitlements(organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metrics, err := meteredMetrics()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var keys []string
+	for metric := range metrics {
+		keys = append(keys, metric)
+	}
+	sort.Strings(keys)
+
+	// Usage without a metered item is counted over the period of the primary
+	// subscription.
+	var primary Subscription
+	if organization.StripeSubID != "" {
+		if primary, err = store.GetSubscription(organization.StripeSubID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	list := []MeteredUsage{}
+	for _, metric := range keys {
+		u := MeteredUsage{Metric: metric, PeriodStart: primary.CurrentPeriodStart, PeriodEnd: primary.CurrentPeriodEnd}
+		item, ok, err := getMeteredItem(organization.ID, metric)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			u.SubscriptionItemID = item.ID
+			u.PeriodStart = item.CurrentPeriodStart
+			u.PeriodEnd = item.CurrentPeriodEnd
+		}
+		if u.Usage, u.Reported, err = periodUsage(organization.ID, metric, u.PeriodStart, u.PeriodEnd); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok && u.Usage == 0 {
+			continue
+		}
+
+		var none int64
+		u.Allowance = &none
+		if g, granted := e.Features[metric]; granted && g.Enabled {
+			u.Allowance = g.Limit
+		}
+		if u.Allowance != nil && u.Usage > *u.Allowance {
+			u.Overage = u.Usage - *u.Allowance
+		}
+		list = append(list, u)
+	}
+	writeJSON(w, list)
+}
+
+// runUsageFlusher reports the usage received to Stripe every interval.
+func runUsageFlusher(interval time.Duration) {
+	for {
+		if err := flushUsage(time.Now().Unix()); err != nil {
+			log.Printf("flushUsage: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// flushUsage aggregates the usage events not reported yet and sends the
+// reports that are due.
+func flushUsage(now int64) error {
+	if err := aggregateUsage(now); err != nil {
+		return err
+	}
+	return sendUsageReports(now)
+}
+
+// aggregateUsage moves the pending events of every metric into a usage report
+// of the current period. Events of an organization without a metered item for
+// the metric are kept until it has one, and so are the events after the end of
+// the period until the renewal of the subscription is stored.
+func aggregateUsage(now int64) error {
+	var pending []struct {
+		OrgID  int    `db:"org_id"`
+		Metric string `db:"metric"`
+	}
+	if err := db.Select(&pending, db.Rebind("SELECT DISTINCT org_id, metric FROM usage_events WHERE report_id = '' ORDER BY org_id, metric")); err != nil {
+		return err
+	}
+	for _, p := range pending {
+		item, ok, err := getMeteredItem(p.OrgID, p.Metric)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := createUsageReport(p.OrgID, p.Metric, item, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usageMaxAttempts is the number of attempts to send a usage report before it
+// is given up, about half a day with usageRetryDelay.
+const usageMaxAttempts = 18
+
+// sendUsageReports sends the usage reports due, a failed report is retried
+// later with a growing delay until usageMaxAttempts. A report goes to the
+// current metered item of its metric within its current period, a plan change
+// may have replaced the item and the subscription may have renewed since the
+// report was created.
+func sendUsageReports(now int64) error {
+	var reports []UsageReport
+	query := "SELECT * FROM usage_reports WHERE reported_at = 0 AND failed_at = 0 AND next_attempt_at <= ? ORDER BY created, id"
+	if err := db.Select(&reports, db.Rebind(query), now); err != nil {
+		return err
+	}
+	for _, r := range reports {
+		item, ok, err := getMeteredItem(r.OrgID, r.Metric)
+		if err != nil {
+			return err
+		}
+		if ok && (item.ID != r.SubscriptionItemID || r.UsageAt < item.CurrentPeriodStart) {
+			r.SubscriptionItemID = item.ID
+			r.UsageAt = usageReportAt(r.UsageAt, item)
+			query := "UPDATE usage_reports SET subscription_item_id = ?, usage_at = ? WHERE id = ?"
+			if _, err := db.ExecContext(context.Background(), db.Rebind(query), r.SubscriptionItemID, r.UsageAt, r.ID); err != nil {
+				return err
+			}
+		}
+		if err := sendUsageReport(r); err != nil {
+			log.Printf("usage report %s of organization %d, attempt %d : %v", r.ID, r.OrgID, r.Attempts+1, err)
+			if r.Attempts+1 >= usageMaxAttempts {
+				log.Printf("usage report %s of organization %d given up after %d attempts", r.ID, r.OrgID, r.Attempts+1)
+				query := "UPDATE usage_reports SET attempts = attempts + 1, failed_at = ?, last_error = ? WHERE id = ?"
+				if _, err := db.ExecContext(context.Background(), db.Rebind(query), now, err.Error(), r.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			query := "UPDATE usage_reports SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?"
+			next := now + int64(usageRetryDelay(r.Attempts+1).Seconds())
+			if _, err := db.ExecContext(context.Background(), db.Rebind(query), next, err.Error(), r.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		query := "UPDATE usage_reports SET attempts = attempts + 1, reported_at = ?, last_error = '' WHERE id = ?"
+		if _, err := db.ExecContext(context.Background(), db.Rebind(query), now, r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendUsageReport(r UsageReport) error {
+	if r.Quantity == 0 {
+		return nil
+	}
+	params := &stripe.UsageRecordParams{
+		SubscriptionItem: stripe.String(r.SubscriptionItemID),
+		Quantity:         stripe.Int64(r.Quantity),
+		Timestamp:        stripe.Int64(r.UsageAt),
+		Action:           stripe.String("increment"),
+	}
+	params.SetIdempotencyKey(usageRecordKey(r))
+	_, err := stripeAPI.NewUsageRecord(params)
+	return err
+}
+
+// usageRecordKey is the idempotency key of the usage record of the report.
+// Stripe rejects a key sent again with other parameters, the key changes with
+// the item and the time the report is moved to.
+func usageRecordKey(r UsageReport) string {
+	return fmt.Sprintf("%s-%s-%d", r.ID, r.SubscriptionItemID, r.UsageAt)
+}
+
+// usageReportAt returns the time of usage at, or the start of the current
+// period of the item when at is before it.
+func usageReportAt(at int64, item meteredItem) int64 {
+	if at < item.CurrentPeriodStart {
+		return item.CurrentPeriodStart
+	}
+	return at
+}
+
+// usageRetryDelay doubles from a minute, up to an hour.
+func usageRetryDelay(attempts int) time.Duration {
+	if attempts > 6 {
+		return time.Hour
+	}
+	return time.Minute << (attempts - 1)
+}
+
+// meteredItemsPrice returns the items of the metered plans allowed with the
+// base plan, which are added to its subscriptions.
+func meteredItemsPrice(base CatalogPlan) ([]*stripe.SubscriptionItemsParams, error) {
+	addOns, err := listPlanAddOns(base.Key)
+	if err != nil {
+		return nil, err
+	}
+	var items []*stripe.SubscriptionItemsParams
+	for _, a := range addOns {
+		if cp, ok := getAvailablePlan(a.AddOnKey); ok && cp.Kind == catalogKindMetered {
+			items = append(items, &stripe.SubscriptionItemsParams{Price: stripe.String(cp.PriceID)})
+		}
+	}
+	return items, nil
+}
+
+// meteredMetrics returns the metrics of the metered plans of the catalog.
+func meteredMetrics() (map[string]bool, error) {
+	var metrics []string
+	query := "SELECT DISTINCT metric FROM plans WHERE kind = ? AND metric <> ''"
+	if err := db.Select(&metrics, db.Rebind(query), catalogKindMetered); err != nil {
+		return nil, err
+	}
+	m := map[string]bool{}
+	for _, metric := range metrics {
+		m[metric] = true
+	}
+	return m, nil
+}
+
+// getMeteredItem returns the item billing metric in the oldest paid for
+// subscription of the organization.
+func getMeteredItem(orgID int, metric string) (meteredItem, bool, error) {
+	var items []meteredItem
+	query := `
+	SELECT si.id, si.subscription_id, s.current_period_start, s.current_period_end
+	FROM subscription_items si
+	JOIN subscriptions s ON s.id = si.subscription_id
+	JOIN plan_prices pp ON pp.price_id = si.price_id
+	JOIN plans p ON p.key = pp.plan_key
+	WHERE s.org_id = ? AND p.kind = ? AND p.metric = ? AND s.status IN (?, ?, ?)
+	ORDER BY s.created, s.id
+	LIMIT 1
+	`
+	err := db.Select(&items, db.Rebind(query), orgID, catalogKindMetered, metric,
+		string(stripe.SubscriptionStatusActive), string(stripe.SubscriptionStatusTrialing), string(stripe.SubscriptionStatusPastDue))
+	if err != nil || len(items) == 0 {
+		return meteredItem{}, false, err
+	}
+	return items[0], true, nil
+}
+
+// periodUsage sums the usage of metric from start, until end unless it is 0,
+// and the part of it already reported to Stripe.
+func periodUsage(orgID int, metric string, start, end int64) (int64, int64, error) {
+	if end == 0 {
+		end = 1<<63 - 1
+	}
+	var usage struct {
+		Usage    int64 `db:"usage"`
+		Reported int64 `db:"reported"`
+	}
+	query := `
+	SELECT
+		COALESCE(SUM(e.quantity), 0) AS usage,
+		COALESCE(SUM(CASE WHEN r.reported_at > 0 THEN e.quantity ELSE 0 END), 0) AS reported
+	FROM usage_events e
+	LEFT JOIN usage_reports r ON r.id = e.report_id
+	WHERE e.org_id = ? AND e.metric = ? AND e.occurred_at >= ? AND e.occurred_at < ?
+	`
+	err := db.Get(&usage, db.Rebind(query), orgID, metric, start, end)
+	return usage.Usage, usage.Reported, err
+}
+
+// insertUsageEvents stores the events that were not received yet and returns
+// how many there were.
+func insertUsageEvents(events []UsageEvent) (int64, error) {
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var accepted int64
+	query := `
+	INSERT INTO usage_events (org_id, metric, idempotency_key, quantity, occurred_at, created)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (org_id, idempotency_key) DO NOTHING
+	`
+	for _, e := range events {
+		res, err := tx.Exec(tx.Rebind(query), e.OrgID, e.Metric, e.IdempotencyKey, e.Quantity, e.OccurredAt, e.Created)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		accepted += n
+	}
+	return accepted, tx.Commit()
+}
+
+// createUsageReport moves the pending events of the metric that occurred
+// before the end of the current period of the item into a new report, none is
+// created without events. The quantity is summed from the events moved so that
+// events received meanwhile wait for the next report.
+func createUsageReport(orgID int, metric string, item meteredItem, now int64) error {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := "ur_" + hex.EncodeToString(b)
+
+	tx, err := db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE usage_events SET report_id = ?
+	WHERE org_id = ? AND metric = ? AND report_id = '' AND occurred_at < ?
+	`
+	end := item.CurrentPeriodEnd
+	if end == 0 {
+		end = math.MaxInt64
+	}
+	res, err := tx.Exec(tx.Rebind(query), id, orgID, metric, end)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	var report struct {
+		Quantity int64 `db:"quantity"`
+		UsageAt  int64 `db:"usage_at"`
+	}
+	query = "SELECT COALESCE(SUM(quantity), 0) AS quantity, COALESCE(MAX(occurred_at), 0) AS usage_at FROM usage_events WHERE report_id = ?"
+	if err := tx.Get(&report, tx.Rebind(query), id); err != nil {
+		return err
+	}
+	query = `
+	INSERT INTO usage_reports (id, org_id, metric, subscription_item_id, quantity, usage_at, next_attempt_at, created)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	if _, err := tx.Exec(tx.Rebind(query), id, orgID, metric, item.ID, report.Quantity, usageReportAt(report.UsageAt, item), now, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+// handleWebhook stores every delivery in stripe_events before processing it.
+// Events already processed are acknowledged without being processed again,
+// and a failed processing is answered with a 5xx so that Stripe retries it.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("ioutil.ReadAll: %v", err)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(b, r.Header.Get("Stripe-Signature"), os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("webhook.ConstructEvent: %v", err)
+		return
+	}
+
+	if err := recordEvent(event, b); err != nil {
+		http.Error(w, "failed to store event : "+err.Error(), http.StatusInternalServerError)
+		log.Printf("recordEvent: %v", err)
+		return
+	}
+
+	claimed, err := claimEvent(event.ID)
+	if err != nil {
+		http.Error(w, "failed to claim event : "+err.Error(), http.StatusInternalServerError)
+		log.Printf("claimEvent: %v", err)
+		return
+	}
+	if !claimed {
+		se, err := getStoredEvent(event.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if se.Status == eventStatusProcessed {
+			writeJSON(w, "")
+			return
+		}
+		// Another delivery is processing it, let Stripe retry later.
+		http.Error(w, "event is being processed", http.StatusConflict)
+		return
+	}
+
+	if _, err := processEvent(event, eventOptions{}); err != nil {
+		log.Printf("processEvent %s %s: %v", event.ID, event.Type, err)
+		if err := markEventFailed(event.ID, err); err != nil {
+			log.Printf("markEventFailed: %v", err)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := markEventProcessed(event.ID); err != nil {
+		log.Printf("markEventProcessed: %v", err)
+	}
+	writeJSON(w, "")
+}
+
+// eventOptions change how processEvent handles an event, webhook deliveries
+// use the zero value.
+type eventOptions struct {
+	// DryRun only reports what the event would change.
+	DryRun bool
+	// IgnoreOrder applies subscription events even when they are older than
+	// the last event applied to the subscription.
+	IgnoreOrder bool
+}
+
+// processEvent applies a single Stripe event, unhandled event types are
+// ignored. It returns a description of the changes made, or that would be
+// made in dry-run mode.
+func processEvent(event stripe.Event, opts eventOptions) ([]string, error) {
+	switch event.Type {
+	case "checkout.session.completed":
+		if opts.DryRun {
+			return []string{"would log the checkout session of customer " + event.GetObjectValue("customer")}, nil
+		}
+		cust, err := stripeAPI.GetCustomer(event.GetObjectValue("customer"), nil)
+		if err != nil {
+			return nil, fmt.Errorf("customer.Get: %w", err)
+		}
+
+		// Sessions without display items would make GetObjectValue panic.
+		if items, _ := event.Data.Object["display_items"].([]interface{}); len(items) > 0 &&
+			event.GetObjectValue("display_items", "0", "custom") != "" &&
+			event.GetObjectValue("display_items", "0", "custom", "name") == "Pasha e-book" {
+			log.Printf("customer %s bought an e-book, send it to %s", cust.ID, cust.Email)
+		}
+	case "customer.subscription.updated",
+		"customer.subscription.created",
+		"customer.subscription.deleted",
+		"customer.subscription.paused",
+		"customer.subscription.pending_update_applied",
+		"customer.subscription.pending_update_expired",
+		"customer.subscription.resumed",
+		"customer.subscription.trial_will_end":
+
+		var sub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal subscription : %w", err)
+		}
+		change, err := planSubscriptionEvent(event, sub, opts.IgnoreOrder)
+		if err != nil {
+			return nil, err
+		}
+		if change.Action == "" {
+			return []string{change.String()}, nil
+		}
+		changes := []string{change.String()}
+		dt, dunning := subscriptionDunning(change, event.Created)
+		if dunning {
+			changes = append(changes, dt.String())
+		}
+		trialEnding := event.Type == "customer.subscription.trial_will_end"
+		if trialEnding {
+			changes = append(changes, fmt.Sprintf("announce the end of the trial of subscription %s at %d", sub.ID, sub.TrialEnd))
+		}
+		if opts.DryRun {
+			return changes, nil
+		}
+		if err := applySubscriptionChange(event, change, opts.IgnoreOrder); err != nil {
+			return nil, err
+		}
+		if dunning {
+			if _, err := applyDunningTransition(dt, change.Org.DunningDeadline); err != nil {
+				return nil, err
+			}
+		}
+		if trialEnding {
+			if err := trialWillEnd(change, event.Created); err != nil {
+				return nil, err
+			}
+		}
+		return changes, nil
+	case "invoice.paid",
+		"invoice.payment_failed",
+		"invoice.finalized":
+		return handleInvoiceEvent(event, opts)
+	case "subscription_schedule.aborted",
+		"subscription_schedule.canceled",
+		"subscription_schedule.completed",
+		"subscription_schedule.released":
+		return handleScheduleEvent(event, opts)
+	case "price.created",
+		"price.updated",
+		"price.deleted",
+		"product.created",
+		"product.updated",
+		"product.deleted":
+		if opts.DryRun {
+			return []string{"would update the plan catalog from " + event.GetObjectValue("object") + " " + event.GetObjectValue("id")}, nil
+		}
+		if err := handleCatalogEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// subscriptionChange is what a customer.subscription.* event does to the
+// organization it belongs to.
+type subscriptionChange struct {
+	Org Organization
+	Sub stripe.Subscription
+	// Stored is the stored copy of the subscription, zero when it is new.
+	Stored Subscription
+	// EventAt is the creation time of the last event applied to the
+	// subscription.
+	EventAt int64
+	// Next replaces the primary subscription of the organization when the
+	// change deletes it.
+	Next Subscription
+	// Action is "create", "update" or "delete", it is empty when the event
+	// is skipped for Reason.
+	Action string
+	Reason string
+}
+
+func (c subscriptionChange) String() string {
+	if c.Action == "" {
+		return "skip : " + c.Reason
+	}
+	return fmt.Sprintf("%s organization %d subscription %s : stripe_sub %q -> %q, sub_status %q -> %q",
+		c.Action, c.Org.ID, c.Sub.ID, c.Org.StripeSubID, c.newStripeSubID(), c.Org.SubStatus, c.newSubStatus())
+}
+
+func (c subscriptionChange) newStripeSubID() string {
+	switch {
+	case c.Action == "delete" && c.Org.StripeSubID == c.Sub.ID:
+		return c.Next.ID
+	case c.Action == "create" && c.Org.StripeSubID != c.Sub.ID && c.Org.StripeSubID != "" && !isFinalSubStatus(c.Org.SubStatus):
+		return c.Org.StripeSubID
+	case c.Action == "update" && c.Org.StripeSubID != c.Sub.ID:
+		return c.Org.StripeSubID
+	case c.Action == "delete":
+		return c.Org.StripeSubID
+	}
+	return c.Sub.ID
+}
+
+func (c subscriptionChange) newSubStatus() string {
+	switch {
+	case c.Action == "delete" && c.Org.StripeSubID == c.Sub.ID:
+		return c.Next.Status
+	case c.newStripeSubID() != c.Sub.ID:
+		return c.Org.SubStatus
+	}
+	return string(c.Sub.Status)
+}
+
+// planSubscriptionEvent decides what a customer.subscription.* event does.
+// Stripe does not guarantee delivery order, so the event creation time is
+// compared with the event_at marker of the subscription, older events
+// are skipped. Events created in the same second as the marker can not be
+// ordered, for those the subscription is fetched again from Stripe and its
+// current state is used instead of the event payload.
+func planSubscriptionEvent(event stripe.Event, s stripe.Subscription, ignoreOrder bool) (subscriptionChange, error) {
+	change := subscriptionChange{Sub: s}
+	if s.Customer == nil {
+		return change, fmt.Errorf("subscription %s has no customer", s.ID)
+	}
+	org, err := store.GetOrganizationByStripeID(s.Customer.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			change.Reason = "no organization for customer " + s.Customer.ID
+			return change, nil
+		}
+		return change, err
+	}
+	change.Org = org
+	change.Stored, err = store.GetSubscription(s.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return change, err
+	}
+	if change.EventAt, err = store.GetSubEventAt(s.ID); err != nil {
+		return change, err
+	}
+
+	if !ignoreOrder && event.Created < change.EventAt {
+		change.Reason = fmt.Sprintf("stale event, subscription %s already applied an event created at %d", s.ID, change.EventAt)
+		return change, nil
+	}
+
+	eventType := event.Type
+	if !ignoreOrder && event.Created == change.EventAt {
+		latest, err := stripeAPI.GetSubscription(s.ID, nil)
+		switch {
+		case err != nil && strings.Contains(err.Error(), "resource_missing"):
+			eventType = "customer.subscription.deleted"
+		case err != nil:
+			return change, fmt.Errorf("failed to re-fetch subscription %s : %w", s.ID, err)
+		default:
+			change.Sub = *latest
+			if latest.Status == stripe.SubscriptionStatusCanceled {
+				eventType = "customer.subscription.deleted"
+			}
+		}
+	}
+
+	// A subscription that reached a final status never comes back.
+	if isFinalSubStatus(change.Stored.Status) && !isFinalSubStatus(string(change.Sub.Status)) {
+		change.Reason = fmt.Sprintf("subscription %s is already %s", change.Sub.ID, change.Stored.Status)
+		return change, nil
+	}
+
+	switch eventType {
+	case "customer.subscription.created":
+		change.Action = "create"
+	case "customer.subscription.deleted":
+		change.Action = "delete"
+		if org.StripeSubID == change.Sub.ID {
+			if change.Next, err = nextPrimarySub(org.ID, change.Sub.ID); err != nil {
+				return change, err
+			}
+		}
+	default:
+		change.Action = "update"
+	}
+	return change, nil
+}
+
+// applySubscriptionChange writes a change planned by planSubscriptionEvent
+// and moves the event_at marker of the subscription to the event creation
+// time, both or neither.
+func applySubscriptionChange(event stripe.Event, change subscriptionChange, ignoreOrder bool) error {
+	sub := newSubscription(change.Sub)
+	if change.Action == "delete" {
+		sub = endedSubscription(sub)
+	}
+	applied, err := store.ApplySubEvent(change.Org.ID, change.Action, sub, event.Created, ignoreOrder)
+	if err != nil {
+		return err
+	}
+	// A newer event got applied since the change was planned.
+	if !applied {
+		log.Printf("ignoring stale event %s %s for subscription %s", event.ID, event.Type, change.Sub.ID)
+	}
+	return nil
+}
+
+// subscriptionDunning returns the dunning transition caused by the change, only
+// the primary subscription of the organization drives its dunning.
+func subscriptionDunning(change subscriptionChange, at int64) (dunningTransition, bool) {
+	if change.newStripeSubID() != change.Sub.ID {
+		if change.Action == "delete" && change.Org.StripeSubID == change.Sub.ID {
+			return dunningOnPaymentSucceeded(change.Org)
+		}
+		return dunningTransition{}, false
+	}
+	return dunningOnSubscriptionStatus(change.Org, change.Sub.Status, at, loadDunningConfig())
+}
+
+func isFinalSubStatus(status string) bool {
+	switch stripe.SubscriptionStatus(status) {
+	case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+		return true
+	}
+	return false
+}